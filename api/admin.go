@@ -0,0 +1,86 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"signing-service-challenge/dto"
+	"strings"
+)
+
+type contextKey int
+
+const adminCallerKey contextKey = iota
+
+// adminMiddleware lets only requests carrying an admin token as bearer token through,
+// the caller holding the token is passed on in the context of the request.
+// Without a configured token the admin routes are disabled.
+func (s *Server) adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(s.adminTokens) == 0 {
+			WriteErrorResponse(w, http.StatusForbidden, []string{"admin API is disabled"})
+			return
+		}
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		caller, ok := "", false
+		if found {
+			caller, ok = s.adminCaller(token)
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			WriteErrorResponse(w, http.StatusUnauthorized, []string{http.StatusText(http.StatusUnauthorized)})
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminCallerKey, caller)))
+	})
+}
+
+// adminCaller returns the caller holding the token. Every configured token is
+// compared in constant time, so the time taken does not tell which one was close.
+func (s *Server) adminCaller(token string) (string, bool) {
+	caller, ok := "", false
+	for adminToken, adminCaller := range s.adminTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+			caller, ok = adminCaller, true
+		}
+	}
+	return caller, ok
+}
+
+// AdminCaller returns the caller authenticated by the admin middleware.
+func AdminCaller(ctx context.Context) string {
+	caller, _ := ctx.Value(adminCallerKey).(string)
+	return caller
+}
+
+// RewrapKeys re-encrypts the device private keys wrapped under retired key-encryption
+// keys under the current one. The keys are configured on the server, never sent with
+// the request.
+func (s *Server) RewrapKeys(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		WriteErrorResponse(response, http.StatusMethodNotAllowed, []string{
+			http.StatusText(http.StatusMethodNotAllowed),
+		})
+		return
+	}
+	rewrapped, err := s.signatureDeviceService.RewrapKeys()
+	if err != nil {
+		WriteError(response, err)
+		return
+	}
+	WriteAPIResponse(response, http.StatusOK, dto.RewrapKeysResponse{
+		RewrappedDevices:   rewrapped,
+		KeyEncryptionKeyId: s.signatureDeviceService.KeyEncryptionKeyId(),
+	})
+}
+
+// Metrics writes the counters of the signer cache.
+func (s *Server) Metrics(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		WriteErrorResponse(response, http.StatusMethodNotAllowed, []string{
+			http.StatusText(http.StatusMethodNotAllowed),
+		})
+		return
+	}
+	WriteAPIResponse(response, http.StatusOK, s.signatureDeviceService.Metrics())
+}
@@ -5,8 +5,11 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"signing-service-challenge/crypto"
 	"signing-service-challenge/domain"
 	"signing-service-challenge/dto"
+	"strconv"
+	"strings"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
@@ -33,9 +36,54 @@ func (s *Server) CreateDevice(response http.ResponseWriter, request *http.Reques
 		return
 	}
 	id := uuid.NewString()
-	newDevice, err := s.signatureDeviceService.CreateSignatureDevice(id, deviceRequest.Algorithm, deviceRequest.Label)
+	options := crypto.Options{
+		KeySize: deviceRequest.KeySize,
+		Padding: deviceRequest.Padding,
+		Curve:   deviceRequest.Curve,
+		Hash:    deviceRequest.Hash,
+	}
+	newDevice, err := s.signatureDeviceService.CreateSignatureDevice(id, deviceRequest.Algorithm, deviceRequest.Label, deviceRequest.Exportable, options)
+	if err != nil {
+		WriteError(response, err)
+		return
+	}
+	WriteAPIResponse(response, http.StatusCreated, newDevice)
+}
+
+// ImportDevice creates a device for an existing private key (bring your own key).
+func (s *Server) ImportDevice(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		WriteErrorResponse(response, http.StatusMethodNotAllowed, []string{
+			http.StatusText(http.StatusMethodNotAllowed),
+		})
+		return
+	}
+	reqBody, _ := io.ReadAll(request.Body)
+	var importRequest dto.ImportSignatureDeviceRequest
+	err := json.Unmarshal(reqBody, &importRequest)
+	if err != nil {
+		WriteErrorResponse(response, http.StatusUnprocessableEntity, []string{err.Error()})
+		return
+	}
+	valid, err := dto.ValidateImportSignatureDeviceRequest(importRequest)
+	if !valid {
+		WriteErrorResponse(response, http.StatusBadRequest, []string{err.Error()})
+		return
+	}
+	id := uuid.NewString()
+	options := crypto.Options{
+		Padding: importRequest.Padding,
+		Hash:    importRequest.Hash,
+	}
+	newDevice, err := s.signatureDeviceService.ImportSignatureDevice(
+		id,
+		importRequest.Label,
+		importRequest.Exportable,
+		[]byte(importRequest.PrivateKey),
+		options,
+	)
 	if err != nil {
-		WriteErrorResponse(response, http.StatusInternalServerError, []string{err.Error()})
+		WriteError(response, err)
 		return
 	}
 	WriteAPIResponse(response, http.StatusCreated, newDevice)
@@ -60,22 +108,150 @@ func (s *Server) Sign(response http.ResponseWriter, request *http.Request) {
 		WriteErrorResponse(response, http.StatusBadRequest, []string{err.Error()})
 		return
 	}
-	signedData, err := s.signatureDeviceService.SignTransaction(signRequest.Id, signRequest.Data)
-	if err != nil {
-		WriteErrorResponse(response, http.StatusInternalServerError, []string{err.Error()})
+	if request.URL.Query().Get("async") == "true" {
+		s.submitSigningJob(response, signRequest)
 		return
 	}
-	// save new signature in DB
-	newSignature := domain.Signature{
-		Id:        uuid.NewString(),
-		Signature: signedData.Signature,
-		Data:      signedData.SignedData,
-		SignedBy:  signRequest.Id,
+	// waiting for the device lock ends when the client goes away
+	signedData, err := s.signatureDeviceService.SignTransaction(request.Context(), signRequest.Id, signRequest.Data)
+	if err != nil {
+		WriteError(response, err)
+		return
 	}
-	s.signatureService.Save(newSignature)
 	WriteAPIResponse(response, http.StatusAccepted, signedData)
 }
 
+// InstanceIdHeader names the instance which accepted a signing job, a load balancer
+// routes the polls of the job to it.
+const InstanceIdHeader = "X-Instance-Id"
+
+// submitSigningJob queues the signature request, the client polls the job at the returned
+// location. Jobs are kept by the instance which accepted them, the job id starts with the
+// id of the instance.
+func (s *Server) submitSigningJob(response http.ResponseWriter, signRequest dto.SignatureRequest) {
+	job, err := s.signingJobs.Submit(signRequest.Id, signRequest.Data)
+	if err != nil {
+		WriteError(response, err)
+		return
+	}
+	response.Header().Set("Location", "/api/v0/jobs/"+job.Id)
+	response.Header().Set(InstanceIdHeader, job.InstanceId)
+	WriteAPIResponse(response, http.StatusAccepted, job)
+}
+
+// GetSigningJob returns the status of an asynchronous signing job and, once it is
+// finished, its signature or its error. A job of another instance is answered with
+// 421 Misdirected Request.
+func (s *Server) GetSigningJob(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		WriteErrorResponse(response, http.StatusMethodNotAllowed, []string{
+			http.StatusText(http.StatusMethodNotAllowed),
+		})
+		return
+	}
+	vars := mux.Vars(request)
+	job, err := s.signingJobs.Get(vars["id"])
+	if err != nil {
+		WriteError(response, err)
+		return
+	}
+	if job.Err != nil {
+		job.Error = jobError(job.Id, job.Err)
+	}
+	WriteAPIResponse(response, http.StatusOK, job)
+}
+
+// SignBatch signs an ordered list of payloads with one device. The batch is atomic,
+// if any payload cannot be signed no signature of the batch is stored.
+func (s *Server) SignBatch(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		WriteErrorResponse(response, http.StatusMethodNotAllowed, []string{
+			http.StatusText(http.StatusMethodNotAllowed),
+		})
+		return
+	}
+	reqBody, _ := io.ReadAll(request.Body)
+	var batchRequest dto.BatchSignatureRequest
+	err := json.Unmarshal(reqBody, &batchRequest)
+	if err != nil {
+		WriteErrorResponse(response, http.StatusUnprocessableEntity, []string{err.Error()})
+		return
+	}
+	valid, err := dto.ValidateBatchSignatureRequest(batchRequest)
+	if !valid {
+		WriteErrorResponse(response, http.StatusBadRequest, []string{err.Error()})
+		return
+	}
+	vars := mux.Vars(request)
+	signed, err := s.signatureDeviceService.SignBatch(request.Context(), vars["id"], batchRequest.Data)
+	if err != nil {
+		WriteError(response, err)
+		return
+	}
+	WriteAPIResponse(response, http.StatusAccepted, signed)
+}
+
+// RotateKey replaces the key pair of a device. The key rollover record is
+// stored like any other signature of the device.
+func (s *Server) RotateKey(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		WriteErrorResponse(response, http.StatusMethodNotAllowed, []string{
+			http.StatusText(http.StatusMethodNotAllowed),
+		})
+		return
+	}
+	vars := mux.Vars(request)
+	rotation, err := s.signatureDeviceService.RotateKeyPair(vars["id"])
+	if err != nil {
+		WriteError(response, err)
+		return
+	}
+	WriteAPIResponse(response, http.StatusOK, rotation)
+}
+
+// ActivateDevice lets an initialized or suspended device sign.
+func (s *Server) ActivateDevice(response http.ResponseWriter, request *http.Request) {
+	s.transitionDevice(response, request, domain.StateActive)
+}
+
+// SuspendDevice stops a device from signing until it is activated again.
+func (s *Server) SuspendDevice(response http.ResponseWriter, request *http.Request) {
+	s.transitionDevice(response, request, domain.StateSuspended)
+}
+
+// DecommissionDevice retires a device for good, its private key is destroyed.
+func (s *Server) DecommissionDevice(response http.ResponseWriter, request *http.Request) {
+	s.transitionDevice(response, request, domain.StateDecommissioned)
+}
+
+func (s *Server) transitionDevice(response http.ResponseWriter, request *http.Request, state string) {
+	if request.Method != http.MethodPost {
+		WriteErrorResponse(response, http.StatusMethodNotAllowed, []string{
+			http.StatusText(http.StatusMethodNotAllowed),
+		})
+		return
+	}
+	reqBody, _ := io.ReadAll(request.Body)
+	var transitionRequest dto.TransitionDeviceRequest
+	err := json.Unmarshal(reqBody, &transitionRequest)
+	if err != nil {
+		WriteErrorResponse(response, http.StatusUnprocessableEntity, []string{err.Error()})
+		return
+	}
+	valid, err := dto.ValidateTransitionDeviceRequest(transitionRequest)
+	if !valid {
+		WriteErrorResponse(response, http.StatusBadRequest, []string{err.Error()})
+		return
+	}
+	vars := mux.Vars(request)
+	device, err := s.signatureDeviceService.TransitionState(request.Context(), vars["id"], state, transitionRequest.Reason)
+	if err != nil {
+		WriteError(response, err)
+		return
+	}
+	WriteAPIResponse(response, http.StatusOK, device)
+}
+
 func (s *Server) Verify(response http.ResponseWriter, request *http.Request) {
 	if request.Method != http.MethodPost {
 		WriteErrorResponse(response, http.StatusMethodNotAllowed, []string{
@@ -101,7 +277,7 @@ func (s *Server) Verify(response http.ResponseWriter, request *http.Request) {
 		verifyRequest.Data,
 	)
 	if err != nil {
-		WriteErrorResponse(response, http.StatusInternalServerError, []string{err.Error()})
+		WriteError(response, err)
 		return
 	}
 	WriteAPIResponse(response, http.StatusAccepted, verification)
@@ -114,9 +290,40 @@ func (s *Server) GetAllDevices(response http.ResponseWriter, request *http.Reque
 		})
 		return
 	}
-	result, err := s.signatureDeviceService.GetAll()
+	query := request.URL.Query()
+	listRequest := dto.ListDevicesRequest{
+		Cursor:      query.Get("cursor"),
+		Sort:        query.Get("sort"),
+		Order:       query.Get("order"),
+		Algorithm:   query.Get("algorithm"),
+		LabelPrefix: query.Get("label_prefix"),
+	}
+	for _, tag := range query["tag"] {
+		key, value, found := strings.Cut(tag, ":")
+		if !found {
+			WriteErrorResponse(response, http.StatusBadRequest, []string{"tag must be key:value"})
+			return
+		}
+		if listRequest.Tags == nil {
+			listRequest.Tags = map[string]string{}
+		}
+		listRequest.Tags[key] = value
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit == 0 {
+			WriteErrorResponse(response, http.StatusBadRequest, []string{"limit must be a positive number"})
+			return
+		}
+		listRequest.Limit = limit
+	}
+	if ok, err := dto.ValidateListDevicesRequest(listRequest); !ok {
+		WriteErrorResponse(response, http.StatusBadRequest, []string{err.Error()})
+		return
+	}
+	result, err := s.signatureDeviceService.ListDevices(listRequest)
 	if err != nil {
-		WriteAPIResponse(response, http.StatusNotFound, []string{err.Error()})
+		WriteError(response, err)
 		return
 	}
 	WriteAPIResponse(response, http.StatusOK, result)
@@ -132,9 +339,116 @@ func (s *Server) GetDevice(response http.ResponseWriter, request *http.Request)
 	vars := mux.Vars(request)
 	result, err := s.signatureDeviceService.GetById(vars["id"])
 	if err != nil {
-		WriteErrorResponse(response, http.StatusNotFound, []string{err.Error()})
+		WriteError(response, err)
 		return
 	}
+	response.Header().Set("ETag", versionETag(result.Version))
 	WriteAPIResponse(response, http.StatusOK, result)
 
 }
+
+// UpdateDevice changes the label and the tags of a device. With an If-Match header
+// carrying the ETag of a previous read, or a list of ETags, the update only succeeds if
+// the device still has one of them.
+func (s *Server) UpdateDevice(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPatch {
+		WriteErrorResponse(response, http.StatusMethodNotAllowed, []string{
+			http.StatusText(http.StatusMethodNotAllowed),
+		})
+		return
+	}
+	reqBody, _ := io.ReadAll(request.Body)
+	var updateRequest dto.UpdateDeviceRequest
+	err := json.Unmarshal(reqBody, &updateRequest)
+	if err != nil {
+		WriteErrorResponse(response, http.StatusUnprocessableEntity, []string{err.Error()})
+		return
+	}
+	valid, err := dto.ValidateUpdateDeviceRequest(updateRequest)
+	if !valid {
+		WriteErrorResponse(response, http.StatusBadRequest, []string{err.Error()})
+		return
+	}
+	if ifMatch := request.Header.Values("If-Match"); len(ifMatch) > 0 {
+		updateRequest.ExpectedVersions = parseIfMatch(strings.Join(ifMatch, ","))
+	}
+	vars := mux.Vars(request)
+	device, err := s.signatureDeviceService.UpdateDevice(request.Context(), vars["id"], updateRequest)
+	if err != nil {
+		WriteError(response, err)
+		return
+	}
+	response.Header().Set("ETag", versionETag(device.Version))
+	WriteAPIResponse(response, http.StatusOK, device)
+}
+
+// parseIfMatch returns the device versions of the ETags listed in an If-Match header,
+// nil for "*". Weak ETags are taken like strong ones, as the version changes with every
+// write. Values which are no ETag of a device match no version, the update then fails
+// with 412 Precondition Failed like for any other ETag.
+func parseIfMatch(header string) []int {
+	versions := []int{}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return nil
+		}
+		version, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(tag, "W/"), `"`))
+		if err != nil {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	return versions
+}
+
+func versionETag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// ExportKey returns the private key of an exportable device, encrypted for the
+// public key supplied by the caller. It is an admin route, the export is recorded
+// with the authenticated caller.
+func (s *Server) ExportKey(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		WriteErrorResponse(response, http.StatusMethodNotAllowed, []string{
+			http.StatusText(http.StatusMethodNotAllowed),
+		})
+		return
+	}
+	reqBody, _ := io.ReadAll(request.Body)
+	var exportRequest dto.ExportKeyRequest
+	err := json.Unmarshal(reqBody, &exportRequest)
+	if err != nil {
+		WriteErrorResponse(response, http.StatusUnprocessableEntity, []string{err.Error()})
+		return
+	}
+	valid, err := dto.ValidateExportKeyRequest(exportRequest)
+	if !valid {
+		WriteErrorResponse(response, http.StatusBadRequest, []string{err.Error()})
+		return
+	}
+	vars := mux.Vars(request)
+	exported, err := s.signatureDeviceService.ExportPrivateKey(vars["id"], []byte(exportRequest.PublicKey), AdminCaller(request.Context()))
+	if err != nil {
+		WriteError(response, err)
+		return
+	}
+	WriteAPIResponse(response, http.StatusOK, exported)
+}
+
+func (s *Server) GetKeyExports(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		WriteErrorResponse(response, http.StatusMethodNotAllowed, []string{
+			http.StatusText(http.StatusMethodNotAllowed),
+		})
+		return
+	}
+	vars := mux.Vars(request)
+	result, err := s.signatureDeviceService.GetKeyExports(vars["id"])
+	if err != nil {
+		WriteError(response, err)
+		return
+	}
+	WriteAPIResponse(response, http.StatusOK, result)
+}
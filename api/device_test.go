@@ -0,0 +1,190 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"signing-service-challenge/crypto"
+	"signing-service-challenge/dto"
+	"signing-service-challenge/services"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestDeviceErrorsAreMappedToStatusAndCode(t *testing.T) {
+	s := newTestServer(t, services.DefaultSigningJobsOptions)
+	id := s.createDevice(t)
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		code   string
+	}{
+		{"unknown device", http.MethodGet, "/api/v0/devices/" + uuid.NewString(), "", http.StatusNotFound, CodeDeviceNotFound},
+		{"malformed JSON", http.MethodPost, "/api/v0/devices", "{", http.StatusUnprocessableEntity, CodeMalformedRequest},
+		{"missing label", http.MethodPost, "/api/v0/devices", `{"algorithm":"ED25519"}`, http.StatusBadRequest, CodeInvalidRequest},
+		{"unknown algorithm", http.MethodPost, "/api/v0/devices", `{"algorithm":"DSA","label":"Device"}`, http.StatusBadRequest, CodeAlgorithmNotSupported},
+		{"invalid transition", http.MethodPost, "/api/v0/devices/" + id + "/activate", `{"reason":"audit"}`, http.StatusConflict, CodeInvalidStateTransition},
+		{"forged key rollover", http.MethodPost, "/api/v0/sign", `{"device_id":"` + id + `","data":"KEY_ROLLOVER:2:a2V5"}`, http.StatusBadRequest, CodeInvalidRequest},
+		{"forged key rollover in a batch", http.MethodPost, "/api/v0/devices/" + id + "/sign/batch", `{"data":["a","KEY_ROLLOVER:2:a2V5"]}`, http.StatusBadRequest, CodeInvalidRequest},
+		{"unknown signature", http.MethodGet, "/api/v0/signatures/" + uuid.NewString(), "", http.StatusNotFound, CodeSignatureNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := s.do(test.method, test.path, test.body)
+			expectError(t, recorder, test.status, test.code)
+			if recorder.Header().Get("Retry-After") != "" {
+				t.Error("only transient errors should ask to retry")
+			}
+		})
+	}
+}
+
+func TestRotatingABusyDeviceAsksToRetry(t *testing.T) {
+	s := newTestServer(t, services.DefaultSigningJobsOptions)
+	id := s.createDevice(t)
+	if _, err := s.locker.Lock(id); err != nil {
+		t.Fatal(err)
+	}
+	recorder := s.do(http.MethodPost, "/api/v0/devices/"+id+"/rotate", "")
+	expectError(t, recorder, http.StatusConflict, CodeDeviceBusy)
+	if recorder.Header().Get("Retry-After") != strconv.Itoa(RetryAfterSeconds) {
+		t.Errorf("busy device should ask to retry after %d seconds, got %q", RetryAfterSeconds, recorder.Header().Get("Retry-After"))
+	}
+	if err := s.locker.Unlock(id); err != nil {
+		t.Fatal(err)
+	}
+	if recorder := s.do(http.MethodPost, "/api/v0/devices/"+id+"/rotate", ""); recorder.Code != http.StatusOK {
+		t.Errorf("idle device should be rotated, got %d: %s", recorder.Code, recorder.Body)
+	}
+}
+
+func TestUpdateDeviceChecksIfMatch(t *testing.T) {
+	s := newTestServer(t, services.DefaultSigningJobsOptions)
+	id := s.createDevice(t)
+	path := "/api/v0/devices/" + id
+	etag := s.do(http.MethodGet, path, "").Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("device should be returned with an ETag")
+	}
+	recorder := s.do(http.MethodPatch, path, `{"label":"First"}`, "If-Match", etag)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("update with the current ETag should succeed, got %d: %s", recorder.Code, recorder.Body)
+	}
+	updated := recorder.Header().Get("ETag")
+	if updated == "" || updated == etag {
+		t.Errorf("update should return a new ETag, got %q after %q", updated, etag)
+	}
+	expectError(t, s.do(http.MethodPatch, path, `{"label":"Second"}`, "If-Match", etag), http.StatusPreconditionFailed, CodeVersionMismatch)
+	expectError(t, s.do(http.MethodPatch, path, `{"label":"Second"}`, "If-Match", `"abc"`), http.StatusPreconditionFailed, CodeVersionMismatch)
+	// a weak validator of the current version
+	recorder = s.do(http.MethodPatch, path, `{"label":"Second"}`, "If-Match", "W/"+updated)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("update with the current weak ETag should succeed, got %d: %s", recorder.Code, recorder.Body)
+	}
+	current := recorder.Header().Get("ETag")
+	// a list holding the current version among others
+	if recorder := s.do(http.MethodPatch, path, `{"label":"Third"}`, "If-Match", etag+`, "abc", `+current); recorder.Code != http.StatusOK {
+		t.Errorf("update with a list holding the current ETag should succeed, got %d: %s", recorder.Code, recorder.Body)
+	}
+	expectError(t, s.do(http.MethodPatch, path, `{"label":"Fourth"}`, "If-Match", etag+", W/"+updated), http.StatusPreconditionFailed, CodeVersionMismatch)
+	if recorder := s.do(http.MethodPatch, path, `{"label":"Fourth"}`, "If-Match", "*"); recorder.Code != http.StatusOK {
+		t.Errorf("update with If-Match * should succeed, got %d: %s", recorder.Code, recorder.Body)
+	}
+}
+
+func TestAsyncSignatureIsPolledAtItsLocation(t *testing.T) {
+	options := services.DefaultSigningJobsOptions
+	options.InstanceId = "signing-1"
+	s := newTestServer(t, options)
+	id := s.createDevice(t)
+	recorder := s.do(http.MethodPost, "/api/v0/sign?async=true", `{"device_id":"`+id+`","data":"data"}`)
+	if recorder.Code != http.StatusAccepted {
+		t.Fatalf("job should be accepted, got %d: %s", recorder.Code, recorder.Body)
+	}
+	location := recorder.Header().Get("Location")
+	if !strings.HasPrefix(location, "/api/v0/jobs/signing-1.") || recorder.Header().Get(InstanceIdHeader) != "signing-1" {
+		t.Fatalf("job should be located on instance signing-1, got %q (%q)", location, recorder.Header().Get(InstanceIdHeader))
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		recorder := s.do(http.MethodGet, location, "")
+		var job struct {
+			Data dto.SigningJobResponse `json:"data"`
+		}
+		decodeBody(t, recorder, &job)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("job should be found, got %d: %s", recorder.Code, recorder.Body)
+		}
+		if job.Data.Status == dto.JobSucceeded {
+			if job.Data.Result == nil || job.Data.Result.Counter != 0 {
+				t.Errorf("job should hold the first signature, got %+v", job.Data.Result)
+			}
+			break
+		}
+		if job.Data.Status == dto.JobFailed || time.Now().After(deadline) {
+			t.Fatalf("job should succeed, got %s (%+v)", job.Data.Status, job.Data.Error)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	expectError(t, s.do(http.MethodGet, "/api/v0/jobs/signing-1."+uuid.NewString(), ""), http.StatusNotFound, CodeJobNotFound)
+	expectError(t, s.do(http.MethodGet, "/api/v0/jobs/signing-2."+uuid.NewString(), ""), http.StatusMisdirectedRequest, CodeJobOfOtherInstance)
+}
+
+func TestAsyncSignatureOfAFullQueueAsksToRetry(t *testing.T) {
+	// without workers the queue is not drained
+	s := newTestServer(t, services.SigningJobsOptions{DeviceQueueSize: 1, MaxQueued: 10, Retention: time.Minute, MaxRetained: 10})
+	id := s.createDevice(t)
+	body := `{"device_id":"` + id + `","data":"data"}`
+	if recorder := s.do(http.MethodPost, "/api/v0/sign?async=true", body); recorder.Code != http.StatusAccepted {
+		t.Fatalf("job should be accepted, got %d: %s", recorder.Code, recorder.Body)
+	}
+	recorder := s.do(http.MethodPost, "/api/v0/sign?async=true", body)
+	expectError(t, recorder, http.StatusTooManyRequests, CodeQueueFull)
+	if recorder.Header().Get("Retry-After") != strconv.Itoa(RetryAfterSeconds) {
+		t.Errorf("full queue should ask to retry after %d seconds, got %q", RetryAfterSeconds, recorder.Header().Get("Retry-After"))
+	}
+	if recorder.Header().Get("Location") != "" {
+		t.Error("rejected job should have no location")
+	}
+}
+
+func TestExportKeyIsAnAdminRouteAuditingTheCaller(t *testing.T) {
+	s := newTestServer(t, services.DefaultSigningJobsOptions)
+	s.server.AddAdminToken("auditor", "secret")
+	recorder := s.do(http.MethodPost, "/api/v0/devices", `{"algorithm":"ED25519","label":"Device","exportable":true}`)
+	var created struct {
+		Data struct {
+			Id string `json:"id"`
+		} `json:"data"`
+	}
+	decodeBody(t, recorder, &created)
+	generator := crypto.ECCGenerator{Curve: crypto.CurveP256}
+	recipient, _ := generator.Generate()
+	recipientPublicKey, _, _ := crypto.NewECCMarshaler().Encode(*recipient)
+	body, _ := json.Marshal(dto.ExportKeyRequest{PublicKey: string(recipientPublicKey)})
+	path := "/api/v0/admin/devices/" + created.Data.Id
+
+	if recorder := s.do(http.MethodPost, "/api/v0/devices/"+created.Data.Id+"/export", string(body)); recorder.Code != http.StatusNotFound {
+		t.Errorf("export should not be served outside the admin routes, got %d", recorder.Code)
+	}
+	expectError(t, s.do(http.MethodPost, path+"/export", string(body)), http.StatusUnauthorized, CodeUnauthorized)
+	expectError(t, s.do(http.MethodGet, path+"/exports", ""), http.StatusUnauthorized, CodeUnauthorized)
+	recorder = s.do(http.MethodPost, path+"/export", string(body), "Authorization", "Bearer secret")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("export should succeed with the admin token, got %d: %s", recorder.Code, recorder.Body)
+	}
+	recorder = s.do(http.MethodGet, path+"/exports", "", "Authorization", "Bearer secret")
+	var exports struct {
+		Data []dto.KeyExportResponse `json:"data"`
+	}
+	decodeBody(t, recorder, &exports)
+	if len(exports.Data) != 1 || exports.Data[0].ExportedBy != "auditor" {
+		t.Errorf("export should be recorded with the caller auditor, got %+v", exports.Data)
+	}
+}
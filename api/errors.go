@@ -0,0 +1,141 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"signing-service-challenge/crypto"
+	"signing-service-challenge/domain"
+	"signing-service-challenge/dto"
+	"strconv"
+)
+
+// Error codes are part of the API, clients branch on them. They must never change.
+const (
+	CodeInvalidRequest           = "invalid_request"
+	CodeMalformedRequest         = "malformed_request"
+	CodeMethodNotAllowed         = "method_not_allowed"
+	CodeNotFound                 = "not_found"
+	CodeDeviceNotFound           = "device_not_found"
+	CodeSignatureNotFound        = "signature_not_found"
+	CodeInvalidCursor            = "invalid_cursor"
+	CodeAlgorithmNotSupported    = "algorithm_not_supported"
+	CodeInvalidOptions           = "invalid_options"
+	CodeInvalidImportKey         = "invalid_import_key"
+	CodeUnsupportedRecipientKey  = "unsupported_recipient_key"
+	CodeWeakRecipientKey         = "weak_recipient_key"
+	CodeKeyNotExportable         = "key_not_exportable"
+	CodeKeyPairAlreadyAttached   = "key_pair_already_attached"
+	CodeDuplicateSignature       = "duplicate_signature"
+	CodeSignatureCounterConflict = "signature_counter_conflict"
+	CodeConcurrentModification   = "concurrent_modification"
+	CodeLockLost                 = "lock_lost"
+	CodeDeviceBusy               = "device_busy"
+	CodeInvalidStateTransition   = "invalid_state_transition"
+	CodeDeviceNotActive          = "device_not_active"
+	CodeKeyDestroyed             = "key_destroyed"
+	CodeTooManyTags              = "too_many_tags"
+	CodeReservedData             = "reserved_data"
+	CodeVersionMismatch          = "version_mismatch"
+	CodeJobNotFound              = "job_not_found"
+	CodeJobOfOtherInstance       = "job_of_other_instance"
+	CodeQueueFull                = "queue_full"
+	CodeLockTimeout              = "lock_timeout"
+	CodeRequestCancelled         = "request_cancelled"
+	CodeUnavailable              = "unavailable"
+	CodeConflict                 = "conflict"
+	CodeForbidden                = "forbidden"
+	CodeUnauthorized             = "unauthorized"
+	CodeUnknownKeyEncryptionKey  = "unknown_key_encryption_key"
+	CodeInternalError            = "internal_error"
+)
+
+// errorMapping translates an error, or any error wrapping it, into a response.
+type errorMapping struct {
+	err    error
+	status int
+	code   string
+	// the client is asked to retry the request later
+	retry bool
+}
+
+// errorMappings is searched in order, errors wrapping others come first.
+var errorMappings = []errorMapping{
+	{err: domain.ErrDeviceNotFound, status: http.StatusNotFound, code: CodeDeviceNotFound},
+	{err: domain.ErrSignatureNotFound, status: http.StatusNotFound, code: CodeSignatureNotFound},
+	{err: domain.ErrJobNotFound, status: http.StatusNotFound, code: CodeJobNotFound},
+	{err: domain.ErrJobOfOtherInstance, status: http.StatusMisdirectedRequest, code: CodeJobOfOtherInstance},
+	{err: domain.ErrInvalidCursor, status: http.StatusBadRequest, code: CodeInvalidCursor},
+	{err: crypto.ErrAlgorithmNotSupported, status: http.StatusBadRequest, code: CodeAlgorithmNotSupported},
+	{err: crypto.ErrInvalidOptions, status: http.StatusBadRequest, code: CodeInvalidOptions},
+	{err: crypto.ErrInvalidImportKey, status: http.StatusBadRequest, code: CodeInvalidImportKey},
+	{err: crypto.ErrUnsupportedRecipientKey, status: http.StatusBadRequest, code: CodeUnsupportedRecipientKey},
+	{err: crypto.ErrWeakRecipientKey, status: http.StatusBadRequest, code: CodeWeakRecipientKey},
+	{err: domain.ErrTooManyTags, status: http.StatusBadRequest, code: CodeTooManyTags},
+	{err: domain.ErrReservedData, status: http.StatusBadRequest, code: CodeReservedData},
+	{err: domain.ErrVersionMismatch, status: http.StatusPreconditionFailed, code: CodeVersionMismatch},
+	{err: domain.ErrKeyNotExportable, status: http.StatusForbidden, code: CodeKeyNotExportable},
+	{err: domain.ErrKeyDestroyed, status: http.StatusGone, code: CodeKeyDestroyed},
+	{err: domain.ErrInvalidStateTransition, status: http.StatusConflict, code: CodeInvalidStateTransition},
+	{err: domain.ErrDeviceNotActive, status: http.StatusConflict, code: CodeDeviceNotActive},
+	{err: domain.ErrKeyPairAlreadyAttached, status: http.StatusConflict, code: CodeKeyPairAlreadyAttached},
+	{err: domain.ErrDuplicateSignature, status: http.StatusConflict, code: CodeDuplicateSignature},
+	{err: domain.ErrSignatureCounterConflict, status: http.StatusConflict, code: CodeSignatureCounterConflict},
+	{err: domain.ErrConcurrentModification, status: http.StatusConflict, code: CodeConcurrentModification},
+	{err: domain.ErrStaleFencingToken, status: http.StatusConflict, code: CodeLockLost},
+	{err: domain.ErrDeviceBusy, status: http.StatusConflict, code: CodeDeviceBusy, retry: true},
+	{err: domain.ErrQueueFull, status: http.StatusTooManyRequests, code: CodeQueueFull, retry: true},
+	{err: domain.ErrQueueClosed, status: http.StatusServiceUnavailable, code: CodeUnavailable, retry: true},
+	{err: domain.ErrLockTimeout, status: http.StatusServiceUnavailable, code: CodeLockTimeout, retry: true},
+	{err: context.Canceled, status: http.StatusServiceUnavailable, code: CodeRequestCancelled, retry: true},
+	{err: domain.ErrUnknownKeyEncryptionKey, status: http.StatusInternalServerError, code: CodeUnknownKeyEncryptionKey},
+}
+
+// statusCodes are the codes of errors which are written with a status only,
+// e.g. failed request validation.
+var statusCodes = map[int]string{
+	http.StatusBadRequest:          CodeInvalidRequest,
+	http.StatusUnprocessableEntity: CodeMalformedRequest,
+	http.StatusMethodNotAllowed:    CodeMethodNotAllowed,
+	http.StatusNotFound:            CodeNotFound,
+	http.StatusForbidden:           CodeForbidden,
+	http.StatusUnauthorized:        CodeUnauthorized,
+	http.StatusConflict:            CodeConflict,
+	http.StatusServiceUnavailable:  CodeUnavailable,
+	http.StatusPreconditionFailed:  CodeVersionMismatch,
+}
+
+// WriteError translates an error of the services into an error response. Errors
+// without a mapping are internal errors, their message is only logged.
+func WriteError(w http.ResponseWriter, err error) {
+	mapping, ok := lookupError(err)
+	if !ok {
+		log.Printf("request %s: %v", w.Header().Get(RequestIdHeader), err)
+		writeError(w, http.StatusInternalServerError, CodeInternalError, []string{http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+	if mapping.retry {
+		w.Header().Set("Retry-After", strconv.Itoa(RetryAfterSeconds))
+	}
+	writeError(w, mapping.status, mapping.code, []string{err.Error()})
+}
+
+// jobError translates the error of a failed signing job like WriteError does.
+func jobError(jobId string, err error) *dto.JobError {
+	mapping, ok := lookupError(err)
+	if !ok {
+		log.Printf("job %s: %v", jobId, err)
+		return &dto.JobError{Code: CodeInternalError, Message: http.StatusText(http.StatusInternalServerError)}
+	}
+	return &dto.JobError{Code: mapping.code, Message: err.Error()}
+}
+
+func lookupError(err error) (errorMapping, bool) {
+	for _, mapping := range errorMappings {
+		if errors.Is(err, mapping.err) {
+			return mapping, true
+		}
+	}
+	return errorMapping{}, false
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"signing-service-challenge/services"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 )
 
@@ -13,9 +14,13 @@ type Response struct {
 	Data interface{} `json:"data"`
 }
 
-// ErrorResponse is the generic error API response container.
+// ErrorResponse is the generic error API response container. Code is one of
+// the stable error codes, RequestId is echoed in the X-Request-Id header.
 type ErrorResponse struct {
-	Errors []string `json:"errors"`
+	Code      string   `json:"code"`
+	Message   string   `json:"message"`
+	Errors    []string `json:"errors"`
+	RequestId string   `json:"request_id"`
 }
 
 // Server manages HTTP requests and dispatches them to the appropriate services.
@@ -23,34 +28,90 @@ type Server struct {
 	listenAddress          string
 	signatureDeviceService services.SignatureDeviceService
 	signatureService       services.SignatureService
+	signingJobs            *services.SigningJobs
+	// callers of the admin routes by their bearer token, the routes are disabled without one
+	adminTokens map[string]string
 }
 
 // NewServer is a factory to instantiate a new Server.
-func NewServer(listenAddress string, deviceService services.SignatureDeviceService, signatureService services.SignatureService) *Server {
+func NewServer(listenAddress string, deviceService services.SignatureDeviceService, signatureService services.SignatureService, signingJobs *services.SigningJobs) *Server {
 	return &Server{
 		listenAddress: listenAddress,
 		// TODO: add services / further dependencies here ...
 		signatureDeviceService: deviceService,
 		signatureService:       signatureService,
+		signingJobs:            signingJobs,
 	}
 }
 
-// Run registers all HandlerFuncs for the existing HTTP routes and starts the Server.
+// DefaultAdminCaller names the holder of the token set by SetAdminToken in audit records.
+const DefaultAdminCaller = "admin"
+
+// SetAdminToken enables the admin routes for requests carrying the token.
+func (s *Server) SetAdminToken(token string) {
+	s.AddAdminToken(DefaultAdminCaller, token)
+}
+
+// AddAdminToken enables the admin routes for requests carrying the token. The caller
+// names the holder of the token, key exports record it. An empty token is ignored.
+func (s *Server) AddAdminToken(caller, token string) {
+	if token == "" {
+		return
+	}
+	if s.adminTokens == nil {
+		s.adminTokens = map[string]string{}
+	}
+	s.adminTokens[token] = caller
+}
+
+// Run starts the Server.
 func (s *Server) Run() error {
+	return http.ListenAndServe(s.listenAddress, s.Handler())
+}
+
+// Handler registers all HandlerFuncs for the existing HTTP routes.
+func (s *Server) Handler() http.Handler {
 
 	// gorilla mux router used to handle path variables
 	router := mux.NewRouter()
+	router.Use(requestIdMiddleware)
+	// unmatched requests get structured errors as well
+	router.NotFoundHandler = requestIdMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteErrorResponse(w, http.StatusNotFound, []string{http.StatusText(http.StatusNotFound)})
+	}))
+	router.MethodNotAllowedHandler = requestIdMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteErrorResponse(w, http.StatusMethodNotAllowed, []string{http.StatusText(http.StatusMethodNotAllowed)})
+	}))
 
 	router.HandleFunc("/api/v0/health", s.Health)
 	router.HandleFunc("/api/v0/sign", s.Sign).Methods("POST")
 	router.HandleFunc("/api/v0/verify", s.Verify).Methods("POST")
 	router.HandleFunc("/api/v0/devices", s.CreateDevice).Methods("POST")
 	router.HandleFunc("/api/v0/devices", s.GetAllDevices).Methods("GET")
+	router.HandleFunc("/api/v0/devices/import", s.ImportDevice).Methods("POST")
 	router.HandleFunc("/api/v0/devices/{id}", s.GetDevice).Methods("GET")
+	router.HandleFunc("/api/v0/devices/{id}", s.UpdateDevice).Methods("PATCH")
+	router.HandleFunc("/api/v0/devices/{id}/sign/batch", s.SignBatch).Methods("POST")
+	router.HandleFunc("/api/v0/devices/{id}/rotate", s.RotateKey).Methods("POST")
+	router.HandleFunc("/api/v0/devices/{id}/activate", s.ActivateDevice).Methods("POST")
+	router.HandleFunc("/api/v0/devices/{id}/suspend", s.SuspendDevice).Methods("POST")
+	router.HandleFunc("/api/v0/devices/{id}/decommission", s.DecommissionDevice).Methods("POST")
+	router.HandleFunc("/api/v0/devices/{id}/chain/verify", s.VerifyChain).Methods("GET")
+	router.HandleFunc("/api/v0/devices/{id}/signatures", s.ListDeviceSignatures).Methods("GET")
+	router.HandleFunc("/api/v0/devices/{id}/signatures/{counter:[0-9]+}", s.GetDeviceSignature).Methods("GET")
 	router.HandleFunc("/api/v0/signatures", s.GetAllSignatures).Methods("GET")
 	router.HandleFunc("/api/v0/signatures/{id}", s.GetSignature).Methods("GET")
+	router.HandleFunc("/api/v0/jobs/{id}", s.GetSigningJob).Methods("GET")
 
-	return http.ListenAndServe(s.listenAddress, router)
+	admin := router.PathPrefix("/api/v0/admin").Subrouter()
+	admin.Use(s.adminMiddleware)
+	admin.HandleFunc("/kek/rewrap", s.RewrapKeys).Methods("POST")
+	admin.HandleFunc("/metrics", s.Metrics).Methods("GET")
+	// private keys only leave the service for authenticated callers, who are audited
+	admin.HandleFunc("/devices/{id}/export", s.ExportKey).Methods("POST")
+	admin.HandleFunc("/devices/{id}/exports", s.GetKeyExports).Methods("GET")
+
+	return router
 }
 
 // WriteInternalError writes a default internal error message as an HTTP response.
@@ -61,11 +122,25 @@ func WriteInternalError(w http.ResponseWriter) {
 
 // WriteErrorResponse takes an HTTP status code and a slice of errors
 // and writes those as an HTTP error response in a structured format.
+// The error code is derived from the status, see WriteError for errors of the services.
 func WriteErrorResponse(w http.ResponseWriter, code int, errors []string) {
-	w.WriteHeader(code)
+	errorCode, ok := statusCodes[code]
+	if !ok {
+		errorCode = CodeInternalError
+	}
+	writeError(w, code, errorCode, errors)
+}
+
+func writeError(w http.ResponseWriter, status int, code string, errors []string) {
+	w.WriteHeader(status)
 
 	errorResponse := ErrorResponse{
-		Errors: errors,
+		Code:      code,
+		Errors:    errors,
+		RequestId: w.Header().Get(RequestIdHeader),
+	}
+	if len(errors) > 0 {
+		errorResponse.Message = errors[0]
 	}
 
 	bytes, err := json.Marshal(errorResponse)
@@ -76,6 +151,37 @@ func WriteErrorResponse(w http.ResponseWriter, code int, errors []string) {
 	w.Write(bytes)
 }
 
+// RetryAfterSeconds is the Retry-After of requests turned away because the device is busy.
+const RetryAfterSeconds = 1
+
+// RequestIdHeader carries the id of a request, a valid id sent by the client is kept.
+const RequestIdHeader = "X-Request-Id"
+
+// requestIdMiddleware sets the request id on the response before the handler runs,
+// the error responses read it from there.
+func requestIdMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIdHeader)
+		if !validRequestId(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set(RequestIdHeader, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func validRequestId(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
 // WriteAPIResponse takes an HTTP status code and a generic data struct
 // and writes those as an HTTP response in a structured format.
 func WriteAPIResponse(w http.ResponseWriter, code int, data interface{}) {
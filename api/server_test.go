@@ -0,0 +1,150 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"signing-service-challenge/crypto"
+	"signing-service-challenge/lockers"
+	"signing-service-challenge/persistence"
+	"signing-service-challenge/repositories"
+	"signing-service-challenge/services"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// testServer serves the routes of a server on an in-memory database.
+type testServer struct {
+	handler http.Handler
+	server  *Server
+	locker  *lockers.ShardedDeviceLocker
+	jobs    *services.SigningJobs
+}
+
+func newTestServer(t *testing.T, jobsOptions services.SigningJobsOptions) *testServer {
+	kek, err := crypto.GenerateKeyEncryptionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapper, err := crypto.NewKeyWrapper(kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := persistence.NewInMemoryDB()
+	devices := repositories.NewSignatureDeviceInMemoryRepository(db)
+	locker := lockers.NewShardedDeviceLocker(0)
+	deviceService := services.NewSignatureDeviceService(
+		devices,
+		repositories.NewKeyExportInMemoryRepository(db),
+		repositories.NewInMemoryUnitOfWorkFactory(db),
+		locker,
+		wrapper,
+	)
+	signatureService := services.NewSignatureService(repositories.NewSignatureInMemoryRepository(db), devices)
+	jobs := services.NewSigningJobs(deviceService, jobsOptions)
+	t.Cleanup(jobs.Close)
+	server := NewServer("", *deviceService, *signatureService, jobs)
+	return &testServer{handler: server.Handler(), server: server, locker: locker, jobs: jobs}
+}
+
+// do sends a request through the router, header holds pairs of names and values.
+func (s *testServer) do(method string, path string, body string, header ...string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		request.Header.Set(header[i], header[i+1])
+	}
+	recorder := httptest.NewRecorder()
+	s.handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// createDevice creates an ED25519 device and returns its id.
+func (s *testServer) createDevice(t *testing.T) string {
+	recorder := s.do(http.MethodPost, "/api/v0/devices", `{"algorithm":"ED25519","label":"Device"}`)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("device should be created, got %d: %s", recorder.Code, recorder.Body)
+	}
+	var created struct {
+		Data struct {
+			Id string `json:"id"`
+		} `json:"data"`
+	}
+	decodeBody(t, recorder, &created)
+	return created.Data.Id
+}
+
+func decodeBody(t *testing.T, recorder *httptest.ResponseRecorder, v interface{}) {
+	if err := json.Unmarshal(recorder.Body.Bytes(), v); err != nil {
+		t.Fatalf("response %q is not JSON: %v", recorder.Body, err)
+	}
+}
+
+// expectError checks the status and the code of an error response and returns it.
+func expectError(t *testing.T, recorder *httptest.ResponseRecorder, status int, code string) ErrorResponse {
+	t.Helper()
+	var response ErrorResponse
+	decodeBody(t, recorder, &response)
+	if recorder.Code != status || response.Code != code {
+		t.Errorf("expected %d %s, got %d %s (%s)", status, code, recorder.Code, response.Code, response.Message)
+	}
+	if response.RequestId == "" || response.RequestId != recorder.Header().Get(RequestIdHeader) {
+		t.Errorf("error response should carry the request id %q of the header, got %q",
+			recorder.Header().Get(RequestIdHeader), response.RequestId)
+	}
+	return response
+}
+
+func TestRequestIdIsEchoedOrGenerated(t *testing.T) {
+	s := newTestServer(t, services.DefaultSigningJobsOptions)
+	recorder := s.do(http.MethodGet, "/api/v0/devices/"+uuid.NewString(), "", RequestIdHeader, "client-42")
+	response := expectError(t, recorder, http.StatusNotFound, CodeDeviceNotFound)
+	if response.RequestId != "client-42" {
+		t.Errorf("request id of the client should be echoed, got %q", response.RequestId)
+	}
+	for _, id := range []string{"", "with space", strings.Repeat("x", 129)} {
+		recorder := s.do(http.MethodGet, "/api/v0/health", "", RequestIdHeader, id)
+		generated := recorder.Header().Get(RequestIdHeader)
+		if _, err := uuid.Parse(generated); err != nil {
+			t.Errorf("request id %q should be replaced by a generated one, got %q", id, generated)
+		}
+	}
+}
+
+func TestUnmatchedRoutesGetStructuredErrors(t *testing.T) {
+	s := newTestServer(t, services.DefaultSigningJobsOptions)
+	expectError(t, s.do(http.MethodGet, "/api/v0/unknown", ""), http.StatusNotFound, CodeNotFound)
+	expectError(t, s.do(http.MethodDelete, "/api/v0/devices", ""), http.StatusMethodNotAllowed, CodeMethodNotAllowed)
+}
+
+func TestUnmappedErrorsDoNotLeakTheirMessage(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	recorder.Header().Set(RequestIdHeader, "request-1")
+	WriteError(recorder, errors.New("connection to db-7.internal refused"))
+	response := expectError(t, recorder, http.StatusInternalServerError, CodeInternalError)
+	if response.Message != http.StatusText(http.StatusInternalServerError) || strings.Contains(recorder.Body.String(), "db-7") {
+		t.Errorf("internal error should have a generic message, got %s", recorder.Body)
+	}
+	if recorder.Header().Get("Retry-After") != "" {
+		t.Error("internal error should not ask to retry")
+	}
+}
+
+func TestAdminRoutesRequireTheAdminToken(t *testing.T) {
+	s := newTestServer(t, services.DefaultSigningJobsOptions)
+	expectError(t, s.do(http.MethodGet, "/api/v0/admin/metrics", ""), http.StatusForbidden, CodeForbidden)
+	s.server.SetAdminToken("secret")
+	for _, authorization := range []string{"", "Bearer wrong", "secret"} {
+		recorder := s.do(http.MethodGet, "/api/v0/admin/metrics", "", "Authorization", authorization)
+		expectError(t, recorder, http.StatusUnauthorized, CodeUnauthorized)
+		if recorder.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("unauthorized response should name the scheme, got %q", recorder.Header().Get("WWW-Authenticate"))
+		}
+	}
+	recorder := s.do(http.MethodGet, "/api/v0/admin/metrics", "", "Authorization", "Bearer secret")
+	if recorder.Code != http.StatusOK {
+		t.Errorf("metrics should be served with the token, got %d: %s", recorder.Code, recorder.Body)
+	}
+}
@@ -1,7 +1,13 @@
 package api
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"signing-service-challenge/dto"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -16,7 +22,7 @@ func (s *Server) GetAllSignatures(response http.ResponseWriter, request *http.Re
 	}
 	result, err := s.signatureService.GetAll()
 	if err != nil {
-		WriteErrorResponse(response, http.StatusInternalServerError, []string{err.Error()})
+		WriteError(response, err)
 		return
 	}
 	WriteAPIResponse(response, http.StatusOK, result)
@@ -32,9 +38,124 @@ func (s *Server) GetSignature(response http.ResponseWriter, request *http.Reques
 	vars := mux.Vars(request)
 	result, err := s.signatureService.GetById(vars["id"])
 	if err != nil {
-		WriteErrorResponse(response, http.StatusNotFound, []string{err.Error()})
+		WriteError(response, err)
 		return
 	}
 	WriteAPIResponse(response, http.StatusOK, result)
 
 }
+
+// GetDeviceSignature returns the signature of a device by its counter.
+func (s *Server) GetDeviceSignature(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		WriteErrorResponse(response, http.StatusMethodNotAllowed, []string{
+			http.StatusText(http.StatusMethodNotAllowed),
+		})
+		return
+	}
+	vars := mux.Vars(request)
+	counter, err := strconv.Atoi(vars["counter"])
+	if err != nil {
+		WriteErrorResponse(response, http.StatusBadRequest, []string{"counter must be a number"})
+		return
+	}
+	result, err := s.signatureService.GetByDeviceIdAndCounter(vars["id"], counter)
+	if err != nil {
+		WriteError(response, err)
+		return
+	}
+	WriteAPIResponse(response, http.StatusOK, result)
+}
+
+// ListDeviceSignatures pages through the signatures of a device in counter order.
+func (s *Server) ListDeviceSignatures(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		WriteErrorResponse(response, http.StatusMethodNotAllowed, []string{
+			http.StatusText(http.StatusMethodNotAllowed),
+		})
+		return
+	}
+	listRequest, err := parseListSignaturesRequest(request.URL.Query())
+	if err != nil {
+		WriteErrorResponse(response, http.StatusBadRequest, []string{err.Error()})
+		return
+	}
+	if ok, err := dto.ValidateListSignaturesRequest(listRequest); !ok {
+		WriteErrorResponse(response, http.StatusBadRequest, []string{err.Error()})
+		return
+	}
+	vars := mux.Vars(request)
+	result, err := s.signatureService.ListByDeviceId(vars["id"], listRequest)
+	if err != nil {
+		WriteError(response, err)
+		return
+	}
+	WriteAPIResponse(response, http.StatusOK, result)
+}
+
+func parseListSignaturesRequest(query url.Values) (dto.ListSignaturesRequest, error) {
+	request := dto.ListSignaturesRequest{
+		Cursor: query.Get("cursor"),
+		Order:  query.Get("order"),
+	}
+	var err error
+	if value := query.Get("limit"); value != "" {
+		if request.Limit, err = strconv.Atoi(value); err != nil || request.Limit == 0 {
+			return request, errors.New("limit must be a positive number")
+		}
+	}
+	if request.FromCounter, err = parseCounterParameter(query, "from_counter"); err != nil {
+		return request, err
+	}
+	if request.ToCounter, err = parseCounterParameter(query, "to_counter"); err != nil {
+		return request, err
+	}
+	if request.From, err = parseTimeParameter(query, "from"); err != nil {
+		return request, err
+	}
+	if request.To, err = parseTimeParameter(query, "to"); err != nil {
+		return request, err
+	}
+	return request, nil
+}
+
+func parseCounterParameter(query url.Values, name string) (*int, error) {
+	value := query.Get(name)
+	if value == "" {
+		return nil, nil
+	}
+	counter, err := strconv.Atoi(value)
+	if err != nil || counter < 0 {
+		return nil, fmt.Errorf("%s must be a non-negative number", name)
+	}
+	return &counter, nil
+}
+
+func parseTimeParameter(query url.Values, name string) (time.Time, error) {
+	value := query.Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be an RFC 3339 timestamp", name)
+	}
+	return parsed, nil
+}
+
+// VerifyChain checks the integrity of the complete signature chain of a device.
+func (s *Server) VerifyChain(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		WriteErrorResponse(response, http.StatusMethodNotAllowed, []string{
+			http.StatusText(http.StatusMethodNotAllowed),
+		})
+		return
+	}
+	vars := mux.Vars(request)
+	result, err := s.signatureService.VerifyChain(vars["id"])
+	if err != nil {
+		WriteError(response, err)
+		return
+	}
+	WriteAPIResponse(response, http.StatusOK, result)
+}
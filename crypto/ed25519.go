@@ -0,0 +1,87 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+)
+
+// Ed25519KeyPair is a DTO that holds Ed25519 private and public keys.
+type Ed25519KeyPair struct {
+	Public  ed25519.PublicKey
+	Private ed25519.PrivateKey
+}
+
+// Ed25519Marshaler can encode and decode an Ed25519 key pair.
+type Ed25519Marshaler struct{}
+
+// NewEd25519Marshaler creates a new Ed25519Marshaler.
+func NewEd25519Marshaler() Ed25519Marshaler {
+	return Ed25519Marshaler{}
+}
+
+// Encode takes an Ed25519KeyPair and encodes it to be written on disk.
+// The private key is stored as PKCS#8, the public key as PKIX.
+// It returns the public and the private key as a byte slice.
+func (m Ed25519Marshaler) Encode(keyPair Ed25519KeyPair) ([]byte, []byte, error) {
+	privateKeyBytes, err := x509.MarshalPKCS8PrivateKey(keyPair.Private)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(keyPair.Public)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	encodedPrivate := pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: privateKeyBytes,
+	})
+
+	encodedPublic := pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: publicKeyBytes,
+	})
+
+	return encodedPublic, encodedPrivate, nil
+}
+
+// Decode assembles an Ed25519KeyPair from an encoded private key.
+func (m Ed25519Marshaler) Decode(privateKeyBytes []byte) (*Ed25519KeyPair, error) {
+	block, _ := pem.Decode(privateKeyBytes)
+	if block == nil {
+		return nil, errors.New("invalid PEM encoded private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an Ed25519 key")
+	}
+
+	return &Ed25519KeyPair{
+		Private: privateKey,
+		Public:  privateKey.Public().(ed25519.PublicKey),
+	}, nil
+}
+
+// DecodePublicKey decodes an encoded Ed25519 public key.
+func (m Ed25519Marshaler) DecodePublicKey(publicKeyBytes []byte) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode(publicKeyBytes)
+	if block == nil {
+		return nil, errors.New("invalid PEM encoded public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an Ed25519 key")
+	}
+	return publicKey, nil
+}
@@ -0,0 +1,214 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// supported key export schemes
+const (
+	ExportSchemeRSAOAEP = "RSA-OAEP-256+A256GCM"
+	ExportSchemeECDH    = "ECDH-ES+A256GCM"
+)
+
+// MinRecipientRSAKeySize is the smallest RSA recipient key a private key is exported for.
+const MinRecipientRSAKeySize = 2048
+
+var (
+	ErrUnsupportedRecipientKey = errors.New("recipient public key must be a PEM encoded RSA, EC or X25519 public key")
+	ErrWeakRecipientKey        = fmt.Errorf("RSA recipient public key must have at least %d bits", MinRecipientRSAKeySize)
+)
+
+// ExportedKey is a private key encrypted for a recipient.
+// The key is always sealed with a random AES-256-GCM content key. The content key is
+// either encrypted with RSA-OAEP (SHA-256), or derived from an ECDH agreement between
+// an ephemeral key and the recipient key.
+type ExportedKey struct {
+	Scheme string
+	// RSA-OAEP encrypted content key, only for ExportSchemeRSAOAEP
+	EncryptedKey []byte
+	// PEM encoded ephemeral public key, only for ExportSchemeECDH
+	EphemeralPublicKey []byte
+	Nonce              []byte
+	Ciphertext         []byte
+	// fingerprint of the recipient public key, used for auditing
+	RecipientFingerprint string
+}
+
+// ExportKey encrypts the private key for the holder of the given public key.
+func ExportKey(recipientPublicKey []byte, privateKey []byte) (*ExportedKey, error) {
+	block, _ := pem.Decode(recipientPublicKey)
+	if block == nil {
+		return nil, ErrUnsupportedRecipientKey
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		// keys created by this service are encoded as PKCS#1
+		publicKey, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, ErrUnsupportedRecipientKey
+		}
+	}
+	fingerprint := sha256.Sum256(block.Bytes)
+	exported := &ExportedKey{
+		RecipientFingerprint: hex.EncodeToString(fingerprint[:]),
+	}
+	var contentKey []byte
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		if key.N.BitLen() < MinRecipientRSAKeySize {
+			return nil, ErrWeakRecipientKey
+		}
+		contentKey = make([]byte, 32)
+		if _, err := rand.Read(contentKey); err != nil {
+			return nil, err
+		}
+		exported.Scheme = ExportSchemeRSAOAEP
+		exported.EncryptedKey, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, key, contentKey, nil)
+		if err != nil {
+			return nil, err
+		}
+	case *ecdsa.PublicKey:
+		ecdhKey, err := key.ECDH()
+		if err != nil {
+			return nil, ErrUnsupportedRecipientKey
+		}
+		contentKey, exported.EphemeralPublicKey, err = agreeEphemeralKey(ecdhKey)
+		if err != nil {
+			return nil, err
+		}
+		exported.Scheme = ExportSchemeECDH
+	case *ecdh.PublicKey:
+		contentKey, exported.EphemeralPublicKey, err = agreeEphemeralKey(key)
+		if err != nil {
+			return nil, err
+		}
+		exported.Scheme = ExportSchemeECDH
+	default:
+		return nil, ErrUnsupportedRecipientKey
+	}
+	aead, err := newContentCipher(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	exported.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(exported.Nonce); err != nil {
+		return nil, err
+	}
+	exported.Ciphertext = aead.Seal(nil, exported.Nonce, privateKey, []byte(exported.Scheme))
+	return exported, nil
+}
+
+// OpenExportedKey is the recipient side of ExportKey. It is mainly meant for
+// clients and tests and accepts *rsa.PrivateKey, *ecdsa.PrivateKey or *ecdh.PrivateKey.
+func OpenExportedKey(recipientPrivateKey interface{}, exported ExportedKey) ([]byte, error) {
+	var contentKey []byte
+	var err error
+	switch exported.Scheme {
+	case ExportSchemeRSAOAEP:
+		key, ok := recipientPrivateKey.(*rsa.PrivateKey)
+		if !ok {
+			return nil, ErrUnsupportedRecipientKey
+		}
+		contentKey, err = rsa.DecryptOAEP(sha256.New(), rand.Reader, key, exported.EncryptedKey, nil)
+		if err != nil {
+			return nil, err
+		}
+	case ExportSchemeECDH:
+		var key *ecdh.PrivateKey
+		switch k := recipientPrivateKey.(type) {
+		case *ecdh.PrivateKey:
+			key = k
+		case *ecdsa.PrivateKey:
+			key, err = k.ECDH()
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, ErrUnsupportedRecipientKey
+		}
+		block, _ := pem.Decode(exported.EphemeralPublicKey)
+		if block == nil {
+			return nil, ErrUnsupportedRecipientKey
+		}
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		var ephemeral *ecdh.PublicKey
+		switch p := parsed.(type) {
+		case *ecdh.PublicKey:
+			ephemeral = p
+		case *ecdsa.PublicKey:
+			ephemeral, err = p.ECDH()
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, ErrUnsupportedRecipientKey
+		}
+		sharedSecret, err := key.ECDH(ephemeral)
+		if err != nil {
+			return nil, err
+		}
+		contentKey = deriveContentKey(sharedSecret, ephemeral.Bytes())
+	default:
+		return nil, ErrUnsupportedRecipientKey
+	}
+	aead, err := newContentCipher(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, exported.Nonce, exported.Ciphertext, []byte(exported.Scheme))
+}
+
+// agreeEphemeralKey performs an ECDH agreement between a fresh ephemeral key and
+// the recipient key. It returns the derived content key and the PEM encoded
+// ephemeral public key the recipient needs to derive the same content key.
+func agreeEphemeralKey(recipient *ecdh.PublicKey) ([]byte, []byte, error) {
+	ephemeral, err := recipient.Curve().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	sharedSecret, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, nil, err
+	}
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(ephemeral.PublicKey())
+	if err != nil {
+		return nil, nil, err
+	}
+	encodedPublic := pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: publicKeyBytes,
+	})
+	return deriveContentKey(sharedSecret, ephemeral.PublicKey().Bytes()), encodedPublic, nil
+}
+
+// deriveContentKey hashes the shared secret together with the ephemeral public key,
+// so every export uses an independent content key.
+func deriveContentKey(sharedSecret []byte, ephemeralPublicKey []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte(ExportSchemeECDH))
+	hash.Write(sharedSecret)
+	hash.Write(ephemeralPublicKey)
+	return hash.Sum(nil)
+}
+
+func newContentCipher(contentKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
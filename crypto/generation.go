@@ -2,18 +2,24 @@ package crypto
 
 import (
 	"crypto/ecdsa"
-	"crypto/elliptic"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 )
 
 // RSAGenerator generates a RSA key pair.
-type RSAGenerator struct{}
+type RSAGenerator struct {
+	KeySize int
+}
 
 // Generate generates a new RSAKeyPair.
+// The default key size is used if none is configured.
 func (g *RSAGenerator) Generate() (*RSAKeyPair, error) {
-	// Security has been ignored for the sake of simplicity.
-	key, err := rsa.GenerateKey(rand.Reader, 512)
+	keySize := g.KeySize
+	if keySize == 0 {
+		keySize = RSAKeySize2048
+	}
+	key, err := rsa.GenerateKey(rand.Reader, keySize)
 	if err != nil {
 		return nil, err
 	}
@@ -25,12 +31,22 @@ func (g *RSAGenerator) Generate() (*RSAKeyPair, error) {
 }
 
 // ECCGenerator generates an ECC key pair.
-type ECCGenerator struct{}
+type ECCGenerator struct {
+	Curve string
+}
 
 // Generate generates a new ECCKeyPair.
+// P-384 is used if no curve is configured.
 func (g *ECCGenerator) Generate() (*ECCKeyPair, error) {
-	// Security has been ignored for the sake of simplicity.
-	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	curveName := g.Curve
+	if curveName == "" {
+		curveName = CurveP384
+	}
+	curve, err := ellipticCurve(curveName)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
 	if err != nil {
 		return nil, err
 	}
@@ -40,3 +56,19 @@ func (g *ECCGenerator) Generate() (*ECCKeyPair, error) {
 		Private: key,
 	}, nil
 }
+
+// Ed25519Generator generates an Ed25519 key pair.
+type Ed25519Generator struct{}
+
+// Generate generates a new Ed25519KeyPair.
+func (g *Ed25519Generator) Generate() (*Ed25519KeyPair, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Ed25519KeyPair{
+		Public:  public,
+		Private: private,
+	}, nil
+}
@@ -0,0 +1,83 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidImportKey = errors.New("invalid private key")
+
+// ImportedKey is an existing private key re-encoded the way the key pair handlers expect it.
+type ImportedKey struct {
+	Algorithm string
+	// parameters derived from the key itself (RSA key size, elliptic curve)
+	Options    Options
+	PrivateKey []byte
+	PublicKey  []byte
+}
+
+// ImportKey parses a PEM encoded PKCS#1, PKCS#8 or SEC1 private key, detects its
+// algorithm and validates it against the supported parameters.
+func ImportKey(privateKeyBytes []byte) (*ImportedKey, error) {
+	block, _ := pem.Decode(privateKeyBytes)
+	if block == nil {
+		return nil, fmt.Errorf("%w: no PEM block found", ErrInvalidImportKey)
+	}
+	key, err := parsePrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if err := k.Validate(); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidImportKey, err)
+		}
+		options := Options{KeySize: k.N.BitLen()}
+		if _, err := NormalizeOptions(RSA, options); err != nil {
+			return nil, err
+		}
+		marshaler := NewRSAMarshaler()
+		public, private, err := marshaler.Marshal(RSAKeyPair{Public: &k.PublicKey, Private: k})
+		if err != nil {
+			return nil, err
+		}
+		return &ImportedKey{Algorithm: RSA, Options: options, PrivateKey: private, PublicKey: public}, nil
+	case *ecdsa.PrivateKey:
+		options := Options{Curve: k.Curve.Params().Name}
+		if _, err := NormalizeOptions(ECC, options); err != nil {
+			return nil, err
+		}
+		public, private, err := NewECCMarshaler().Encode(ECCKeyPair{Public: &k.PublicKey, Private: k})
+		if err != nil {
+			return nil, err
+		}
+		return &ImportedKey{Algorithm: ECC, Options: options, PrivateKey: private, PublicKey: public}, nil
+	case ed25519.PrivateKey:
+		public, private, err := NewEd25519Marshaler().Encode(Ed25519KeyPair{Public: k.Public().(ed25519.PublicKey), Private: k})
+		if err != nil {
+			return nil, err
+		}
+		return &ImportedKey{Algorithm: ED25519, PrivateKey: private, PublicKey: public}, nil
+	}
+	return nil, fmt.Errorf("%w: %T keys are not supported", ErrInvalidImportKey, key)
+}
+
+// parsePrivateKey tries the supported encodings one after another,
+// the PEM block type is not reliable enough to select one.
+func parsePrivateKey(der []byte) (interface{}, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: neither a PKCS#1, PKCS#8 nor a SEC1 private key", ErrInvalidImportKey)
+}
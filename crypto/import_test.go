@@ -0,0 +1,83 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"testing"
+)
+
+func encodePEM(blockType string, der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+}
+
+func TestImportPKCS1RSAKey(t *testing.T) {
+	generator := RSAGenerator{}
+	keys, _ := generator.Generate()
+	imported, err := ImportKey(encodePEM("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(keys.Private)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.Algorithm != RSA || imported.Options.KeySize != RSAKeySize2048 {
+		t.Errorf("got %s with %+v, expected 2048 bit RSA", imported.Algorithm, imported.Options)
+	}
+	handler, _ := GenerateKeyPairHandler(RSA, imported.Options)
+	if _, err := handler.Unmarshal(imported.PrivateKey); err != nil {
+		t.Errorf("imported key should be readable by the RSA handler: %s", err)
+	}
+}
+
+func TestImportPKCS8AndSEC1ECCKeys(t *testing.T) {
+	generator := ECCGenerator{Curve: CurveP256}
+	keys, _ := generator.Generate()
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(keys.Private)
+	sec1, _ := x509.MarshalECPrivateKey(keys.Private)
+	for _, encoded := range [][]byte{encodePEM("PRIVATE KEY", pkcs8), encodePEM("EC PRIVATE KEY", sec1)} {
+		imported, err := ImportKey(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if imported.Algorithm != ECC || imported.Options.Curve != CurveP256 {
+			t.Errorf("got %s with %+v, expected ECC on P-256", imported.Algorithm, imported.Options)
+		}
+		handler, _ := GenerateKeyPairHandler(ECC, imported.Options)
+		if _, err := handler.Unmarshal(imported.PrivateKey); err != nil {
+			t.Errorf("imported key should be readable by the ECC handler: %s", err)
+		}
+	}
+}
+
+func TestImportPKCS8Ed25519Key(t *testing.T) {
+	generator := Ed25519Generator{}
+	keys, _ := generator.Generate()
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(keys.Private)
+	imported, err := ImportKey(encodePEM("PRIVATE KEY", pkcs8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.Algorithm != ED25519 {
+		t.Errorf("got %s, expected %s", imported.Algorithm, ED25519)
+	}
+}
+
+func TestImportUnsupportedKeysShouldFail(t *testing.T) {
+	weakRSA, _ := rsa.GenerateKey(rand.Reader, 1024)
+	p224, _ := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	p224Bytes, _ := x509.MarshalECPrivateKey(p224)
+	invalid := [][]byte{
+		[]byte("not a key"),
+		encodePEM("PRIVATE KEY", []byte("garbage")),
+		encodePEM("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(weakRSA)),
+		encodePEM("EC PRIVATE KEY", p224Bytes),
+	}
+	for _, key := range invalid {
+		_, err := ImportKey(key)
+		if !errors.Is(err, ErrInvalidImportKey) && !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("import should be rejected, got error %v", err)
+		}
+	}
+}
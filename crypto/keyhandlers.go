@@ -7,25 +7,34 @@ import (
 
 // supported algorithms
 const (
-	RSA = "RSA"
-	ECC = "ECC"
+	RSA     = "RSA"
+	ECC     = "ECC"
+	ED25519 = "ED25519"
 )
 
+var ErrAlgorithmNotSupported = errors.New("algorithm not supported")
+
 // KeyPairHandler factory creates new instance based on the algorithm.
-func GenerateKeyPairHandler(algorithm string) (KeyPairHandler, error) {
+// The options are expected to be normalized (see NormalizeOptions).
+func GenerateKeyPairHandler(algorithm string, options Options) (KeyPairHandler, error) {
 	switch algorithm {
 	case RSA:
 		return NewRSAKeyPairHandler(
-			RSAGenerator{},
+			RSAGenerator{KeySize: options.KeySize},
 			NewRSAMarshaler(),
 		), nil
 	case ECC:
 		return NewECCKeyPairHandler(
-			ECCGenerator{},
+			ECCGenerator{Curve: options.Curve},
 			NewECCMarshaler(),
 		), nil
+	case ED25519:
+		return NewEd25519KeyPairHandler(
+			Ed25519Generator{},
+			NewEd25519Marshaler(),
+		), nil
 	}
-	return nil, errors.New("algorithm not supported")
+	return nil, ErrAlgorithmNotSupported
 }
 
 // Wrappers around Generator and Marshaler
@@ -33,6 +42,7 @@ type KeyPairHandler interface {
 	GenerateKeyPair() ([]byte, []byte, error)
 	AttachKeyPair(*domain.SignatureDevice, []byte, []byte) (*domain.SignatureDevice, error)
 	Unmarshal([]byte) (interface{}, error)
+	UnmarshalPublicKey([]byte) (interface{}, error)
 }
 
 type RSAKeyPairHandler struct {
@@ -76,6 +86,10 @@ func (kph *RSAKeyPairHandler) Unmarshal(privateKey []byte) (interface{}, error)
 	return key.Private, nil
 }
 
+func (kph *RSAKeyPairHandler) UnmarshalPublicKey(publicKey []byte) (interface{}, error) {
+	return kph.Marshaler.UnmarshalPublicKey(publicKey)
+}
+
 type ECCKeyPairHandler struct {
 	Generator ECCGenerator
 	Marshaler ECCMarshaler
@@ -116,3 +130,52 @@ func (kph *ECCKeyPairHandler) Unmarshal(privateKey []byte) (interface{}, error)
 	}
 	return key.Private, nil
 }
+
+func (kph *ECCKeyPairHandler) UnmarshalPublicKey(publicKey []byte) (interface{}, error) {
+	return kph.Marshaler.DecodePublicKey(publicKey)
+}
+
+type Ed25519KeyPairHandler struct {
+	Generator Ed25519Generator
+	Marshaler Ed25519Marshaler
+}
+
+func NewEd25519KeyPairHandler(generator Ed25519Generator, marshaler Ed25519Marshaler) *Ed25519KeyPairHandler {
+	return &Ed25519KeyPairHandler{
+		Generator: generator,
+		Marshaler: marshaler,
+	}
+}
+
+func (kph *Ed25519KeyPairHandler) GenerateKeyPair() ([]byte, []byte, error) {
+	keyPair, err := kph.Generator.Generate()
+	if err != nil {
+		return nil, nil, err
+	}
+	marshaledPublicKey, marshaledPrivateKey, err := kph.Marshaler.Encode(*keyPair)
+	if err != nil {
+		return nil, nil, err
+	}
+	return marshaledPrivateKey, marshaledPublicKey, nil
+}
+
+func (kph *Ed25519KeyPairHandler) AttachKeyPair(device *domain.SignatureDevice, privateKey []byte, publicKey []byte) (*domain.SignatureDevice, error) {
+	if len(device.PrivateKey) > 0 || len(device.PublicKey) > 0 {
+		return nil, domain.ErrKeyPairAlreadyAttached
+	}
+	device.PrivateKey = privateKey
+	device.PublicKey = publicKey
+	return device, nil
+}
+
+func (kph *Ed25519KeyPairHandler) Unmarshal(privateKey []byte) (interface{}, error) {
+	key, err := kph.Marshaler.Decode(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return key.Private, nil
+}
+
+func (kph *Ed25519KeyPairHandler) UnmarshalPublicKey(publicKey []byte) (interface{}, error) {
+	return kph.Marshaler.DecodePublicKey(publicKey)
+}
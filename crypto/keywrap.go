@@ -0,0 +1,105 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+)
+
+var (
+	ErrInvalidKeyEncryptionKey = errors.New("key-encryption key must be 16, 24 or 32 bytes long")
+	ErrKeyUnwrapFailed         = errors.New("private key could not be unwrapped")
+)
+
+// KeyWrapper implements envelope encryption of device private keys.
+// Private keys are sealed with AES-GCM under a master key-encryption key (KEK).
+// The device id is bound as additional authenticated data, so a wrapped key
+// cannot be moved to another device.
+type KeyWrapper struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// NewKeyWrapper creates a KeyWrapper for the given raw key-encryption key.
+func NewKeyWrapper(kek []byte) (*KeyWrapper, error) {
+	switch len(kek) {
+	case 16, 24, 32:
+	default:
+		return nil, ErrInvalidKeyEncryptionKey
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// the id is a fingerprint of the KEK and never reveals the key itself
+	fingerprint := sha256.Sum256(kek)
+	return &KeyWrapper{
+		id:   hex.EncodeToString(fingerprint[:8]),
+		aead: aead,
+	}, nil
+}
+
+// GenerateKeyEncryptionKey returns a new random 256 bit key-encryption key.
+func GenerateKeyEncryptionKey() ([]byte, error) {
+	kek := make([]byte, 32)
+	if _, err := rand.Read(kek); err != nil {
+		return nil, err
+	}
+	return kek, nil
+}
+
+// DecodeKeyEncryptionKey decodes a base64 encoded key-encryption key.
+func DecodeKeyEncryptionKey(encoded string) ([]byte, error) {
+	kek, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, err
+	}
+	return kek, nil
+}
+
+// LoadKeyEncryptionKeyFile reads a base64 encoded key-encryption key from a file.
+func LoadKeyEncryptionKeyFile(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeKeyEncryptionKey(string(content))
+}
+
+// Id identifies the key-encryption key a private key was wrapped with.
+func (w *KeyWrapper) Id() string {
+	return w.id
+}
+
+// Wrap encrypts the private key for the given device.
+// The result is the random nonce followed by the sealed key.
+func (w *KeyWrapper) Wrap(deviceId string, privateKey []byte) ([]byte, error) {
+	nonce := make([]byte, w.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return w.aead.Seal(nonce, nonce, privateKey, []byte(deviceId)), nil
+}
+
+// Unwrap decrypts a private key previously wrapped for the given device.
+func (w *KeyWrapper) Unwrap(deviceId string, wrappedKey []byte) ([]byte, error) {
+	nonceSize := w.aead.NonceSize()
+	if len(wrappedKey) < nonceSize {
+		return nil, ErrKeyUnwrapFailed
+	}
+	privateKey, err := w.aead.Open(nil, wrappedKey[:nonceSize], wrappedKey[nonceSize:], []byte(deviceId))
+	if err != nil {
+		return nil, ErrKeyUnwrapFailed
+	}
+	return privateKey, nil
+}
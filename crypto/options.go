@@ -0,0 +1,140 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/elliptic"
+	"errors"
+	"fmt"
+	"signing-service-challenge/domain"
+)
+
+var ErrInvalidOptions = errors.New("invalid algorithm parameters")
+
+// supported RSA key sizes
+const (
+	RSAKeySize2048 = 2048
+	RSAKeySize3072 = 3072
+	RSAKeySize4096 = 4096
+)
+
+// supported RSA padding schemes
+const (
+	PaddingPKCS1v15 = "pkcs1v15"
+	PaddingPSS      = "pss"
+)
+
+// supported elliptic curves
+const (
+	CurveP256 = "P-256"
+	CurveP384 = "P-384"
+	CurveP521 = "P-521"
+)
+
+// supported hash functions
+const (
+	HashSHA256 = "SHA-256"
+	HashSHA384 = "SHA-384"
+	HashSHA512 = "SHA-512"
+)
+
+// Options holds algorithm specific parameters used for key generation and signing.
+// Zero values are replaced with defaults by NormalizeOptions.
+type Options struct {
+	KeySize int
+	Padding string
+	Curve   string
+	Hash    string
+}
+
+// OptionsFromDevice extracts the crypto parameters a device was created with.
+func OptionsFromDevice(device domain.SignatureDevice) Options {
+	return Options{
+		KeySize: device.KeySize,
+		Padding: device.Padding,
+		Curve:   device.Curve,
+		Hash:    device.Hash,
+	}
+}
+
+// NormalizeOptions validates the options for the given algorithm and fills in defaults.
+// Parameters which do not apply to the algorithm are rejected.
+func NormalizeOptions(algorithm string, options Options) (Options, error) {
+	switch algorithm {
+	case RSA:
+		if options.KeySize == 0 {
+			options.KeySize = RSAKeySize2048
+		}
+		switch options.KeySize {
+		case RSAKeySize2048, RSAKeySize3072, RSAKeySize4096:
+		default:
+			return Options{}, fmt.Errorf("%w: RSA key size %d not supported", ErrInvalidOptions, options.KeySize)
+		}
+		if options.Curve != "" || options.Hash != "" {
+			return Options{}, fmt.Errorf("%w: curve and hash are only supported for %s", ErrInvalidOptions, ECC)
+		}
+		if options.Padding == "" {
+			options.Padding = PaddingPKCS1v15
+		}
+		switch options.Padding {
+		case PaddingPKCS1v15, PaddingPSS:
+		default:
+			return Options{}, fmt.Errorf("%w: RSA padding %q not supported", ErrInvalidOptions, options.Padding)
+		}
+	case ECC:
+		if options.KeySize != 0 {
+			return Options{}, fmt.Errorf("%w: key size is not supported for %s", ErrInvalidOptions, algorithm)
+		}
+		if options.Padding != "" {
+			return Options{}, fmt.Errorf("%w: padding is not supported for %s", ErrInvalidOptions, algorithm)
+		}
+		if options.Curve == "" {
+			options.Curve = CurveP384
+		}
+		if _, err := ellipticCurve(options.Curve); err != nil {
+			return Options{}, err
+		}
+		if options.Hash == "" {
+			options.Hash = HashSHA256
+		}
+		if _, err := hashFunction(options.Hash); err != nil {
+			return Options{}, err
+		}
+	case ED25519:
+		if options.KeySize != 0 {
+			return Options{}, fmt.Errorf("%w: key size is not supported for %s", ErrInvalidOptions, algorithm)
+		}
+		if options.Padding != "" {
+			return Options{}, fmt.Errorf("%w: padding is not supported for %s", ErrInvalidOptions, algorithm)
+		}
+		if options.Curve != "" || options.Hash != "" {
+			return Options{}, fmt.Errorf("%w: curve and hash are only supported for %s", ErrInvalidOptions, ECC)
+		}
+	default:
+		return Options{}, ErrAlgorithmNotSupported
+	}
+	return options, nil
+}
+
+func ellipticCurve(name string) (elliptic.Curve, error) {
+	switch name {
+	case CurveP256:
+		return elliptic.P256(), nil
+	case CurveP384:
+		return elliptic.P384(), nil
+	case CurveP521:
+		return elliptic.P521(), nil
+	}
+	return nil, fmt.Errorf("%w: curve %q not supported", ErrInvalidOptions, name)
+}
+
+func hashFunction(name string) (crypto.Hash, error) {
+	switch name {
+	case HashSHA256:
+		return crypto.SHA256, nil
+	case HashSHA384:
+		return crypto.SHA384, nil
+	case HashSHA512:
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("%w: hash %q not supported", ErrInvalidOptions, name)
+}
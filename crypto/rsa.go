@@ -4,6 +4,7 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 )
 
 // RSAKeyPair is a DTO that holds RSA private and public keys.
@@ -52,3 +53,12 @@ func (m *RSAMarshaler) Unmarshal(privateKeyBytes []byte) (*RSAKeyPair, error) {
 		Public:  &privateKey.PublicKey,
 	}, nil
 }
+
+// UnmarshalPublicKey takes an encoded RSA public key and transforms it into a rsa.PublicKey.
+func (m *RSAMarshaler) UnmarshalPublicKey(publicKeyBytes []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(publicKeyBytes)
+	if block == nil {
+		return nil, errors.New("invalid PEM encoded public key")
+	}
+	return x509.ParsePKCS1PublicKey(block.Bytes)
+}
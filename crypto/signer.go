@@ -3,9 +3,11 @@ package crypto
 import (
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	_ "crypto/sha512" // registers SHA-384 and SHA-512
 	"errors"
 	// "signing-service-code-challenge/services"
 )
@@ -17,12 +19,26 @@ type Signer interface {
 }
 
 // Signer factory generates new Signer instance based on the data type of the passed private key.
-func GenerateSigner(s interface{}) (Signer, error) {
+// The options carry the parameters the device was created with.
+func GenerateSigner(s interface{}, options Options) (Signer, error) {
 	switch x := s.(type) {
 	case *rsa.PrivateKey:
+		if options.Padding == PaddingPSS {
+			return NewRSAPSSSigner(x), nil
+		}
 		return NewRSASigner(x), nil
 	case *ecdsa.PrivateKey:
-		return NewECCSigner(x), nil
+		hash := crypto.SHA256
+		if options.Hash != "" {
+			h, err := hashFunction(options.Hash)
+			if err != nil {
+				return nil, err
+			}
+			hash = h
+		}
+		return NewECCSignerWithHash(x, hash), nil
+	case ed25519.PrivateKey:
+		return NewEd25519Signer(x), nil
 	}
 	return nil, errors.New("algorithm for the given private key type not supported!")
 }
@@ -52,32 +68,61 @@ func (s RSASigner) Sign(dataToBeSigned []byte) ([]byte, error) {
 }
 
 func (s RSASigner) Verify(signedData []byte, signature []byte) (bool, error) {
-	hash := sha256.New()
-	_, err := hash.Write(signedData)
-	if err != nil {
-		return false, err
+	return NewRSAVerifier(&s.privateKey.PublicKey).Verify(signedData, signature)
+}
+
+// RSAPSSSigner signs with the probabilistic RSASSA-PSS scheme.
+type RSAPSSSigner struct {
+	privateKey *rsa.PrivateKey
+}
+
+func NewRSAPSSSigner(privateKey *rsa.PrivateKey) *RSAPSSSigner {
+	return &RSAPSSSigner{
+		privateKey: privateKey,
 	}
-	hashSum := hash.Sum(nil)
-	err = rsa.VerifyPKCS1v15(&s.privateKey.PublicKey, crypto.SHA256, hashSum, signature)
+}
+
+var pssOptions = &rsa.PSSOptions{
+	SaltLength: rsa.PSSSaltLengthEqualsHash,
+	Hash:       crypto.SHA256,
+}
+
+func (s RSAPSSSigner) Sign(dataToBeSigned []byte) ([]byte, error) {
+	hashSum := sha256.Sum256(dataToBeSigned)
+	signature, err := rsa.SignPSS(rand.Reader, s.privateKey, crypto.SHA256, hashSum[:], pssOptions)
 	if err != nil {
-		return false, nil
+		return []byte{}, err
 	}
-	return true, nil
+	return signature, nil
+}
+
+func (s RSAPSSSigner) Verify(signedData []byte, signature []byte) (bool, error) {
+	return NewRSAPSSVerifier(&s.privateKey.PublicKey).Verify(signedData, signature)
 }
 
 type ECCSigner struct {
 	privateKey *ecdsa.PrivateKey
+	hash       crypto.Hash
 }
 
+// NewECCSigner creates an ECCSigner which hashes with SHA-256.
 func NewECCSigner(privateKey *ecdsa.PrivateKey) *ECCSigner {
+	return NewECCSignerWithHash(privateKey, crypto.SHA256)
+}
+
+func NewECCSignerWithHash(privateKey *ecdsa.PrivateKey, hash crypto.Hash) *ECCSigner {
 	return &ECCSigner{
 		privateKey: privateKey,
+		hash:       hash,
 	}
 }
 
 func (s ECCSigner) Sign(dataToBeSigned []byte) ([]byte, error) {
-	hash := sha256.Sum256(dataToBeSigned)
-	signature, err := ecdsa.SignASN1(rand.Reader, s.privateKey, hash[:])
+	hash, err := digest(s.hash, dataToBeSigned)
+	if err != nil {
+		return []byte{}, err
+	}
+	signature, err := ecdsa.SignASN1(rand.Reader, s.privateKey, hash)
 
 	if err != nil {
 		return []byte{}, err
@@ -86,7 +131,24 @@ func (s ECCSigner) Sign(dataToBeSigned []byte) ([]byte, error) {
 }
 
 func (s ECCSigner) Verify(signedData []byte, signature []byte) (bool, error) {
-	hash := sha256.Sum256(signedData)
-	return ecdsa.VerifyASN1(&s.privateKey.PublicKey, hash[:], signature), nil
+	return NewECCVerifier(&s.privateKey.PublicKey, s.hash).Verify(signedData, signature)
+}
+
+type Ed25519Signer struct {
+	privateKey ed25519.PrivateKey
+}
+
+func NewEd25519Signer(privateKey ed25519.PrivateKey) *Ed25519Signer {
+	return &Ed25519Signer{
+		privateKey: privateKey,
+	}
+}
+
+// Sign signs the data directly; Ed25519 hashes internally and is deterministic.
+func (s Ed25519Signer) Sign(dataToBeSigned []byte) ([]byte, error) {
+	return ed25519.Sign(s.privateKey, dataToBeSigned), nil
+}
 
+func (s Ed25519Signer) Verify(signedData []byte, signature []byte) (bool, error) {
+	return NewEd25519Verifier(s.privateKey.Public().(ed25519.PublicKey)).Verify(signedData, signature)
 }
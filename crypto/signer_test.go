@@ -2,6 +2,7 @@ package crypto
 
 import (
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"reflect"
 	"testing"
@@ -9,23 +10,39 @@ import (
 
 func TestSignerFactoryShouldReturnRSASigner(t *testing.T) {
 	pk := rsa.PrivateKey{}
-	signer, _ := GenerateSigner(&pk)
+	signer, _ := GenerateSigner(&pk, Options{})
 	if reflect.TypeOf(signer) != reflect.TypeOf(&RSASigner{}) {
 		t.Error("expected RSASigner, but another returned")
 	}
 }
 
+func TestSignerFactoryShouldReturnRSAPSSSigner(t *testing.T) {
+	pk := rsa.PrivateKey{}
+	signer, _ := GenerateSigner(&pk, Options{Padding: PaddingPSS})
+	if reflect.TypeOf(signer) != reflect.TypeOf(&RSAPSSSigner{}) {
+		t.Error("expected RSAPSSSigner, but another returned")
+	}
+}
+
 func TestSignerFactoryShouldReturnECCSigner(t *testing.T) {
 	pk := ecdsa.PrivateKey{}
-	signer, _ := GenerateSigner(&pk)
+	signer, _ := GenerateSigner(&pk, Options{})
 	if reflect.TypeOf(signer) != reflect.TypeOf(&ECCSigner{}) {
 		t.Error("expected ECCSigner, but another returned")
 	}
 }
 
+func TestSignerFactoryShouldReturnEd25519Signer(t *testing.T) {
+	pk := ed25519.PrivateKey{}
+	signer, _ := GenerateSigner(pk, Options{})
+	if reflect.TypeOf(signer) != reflect.TypeOf(&Ed25519Signer{}) {
+		t.Error("expected Ed25519Signer, but another returned")
+	}
+}
+
 func TestSignerFactoryShouldReturnNilAndErrorForNotSupportedPrivateKeys(t *testing.T) {
 	pk := struct{}{} // unsupported key
-	signer, err := GenerateSigner(&pk)
+	signer, err := GenerateSigner(&pk, Options{})
 	if signer != nil {
 		t.Error("it should return nil for unsupported private keys")
 	}
@@ -60,6 +77,73 @@ func TestRSASignerTemperedMessageShouldFail(t *testing.T) {
 	}
 }
 
+func TestRSAPSSSignerSameMessageShouldPass(t *testing.T) {
+	generator := RSAGenerator{}
+	keys, _ := generator.Generate()
+	signer := NewRSAPSSSigner(keys.Private)
+	data := []byte("Data for signing")
+	signature, _ := signer.Sign(data)
+	verified, _ := signer.Verify(data, signature)
+	if !verified {
+		t.Errorf("got verified: %t, but should be true", verified)
+	}
+}
+
+func TestRSAPSSSignerTemperedMessageShouldFail(t *testing.T) {
+	generator := RSAGenerator{}
+	keys, _ := generator.Generate()
+	signer := NewRSAPSSSigner(keys.Private)
+	data := []byte("Data for signing")
+	dataTemp := []byte("Data for signing (tempered)")
+	signature, _ := signer.Sign(data)
+	verified, _ := signer.Verify(dataTemp, signature)
+	if verified {
+		t.Errorf("got verified: %t, but should be false", verified)
+	}
+}
+
+func TestRSAGeneratorUsesConfiguredKeySize(t *testing.T) {
+	generator := RSAGenerator{KeySize: RSAKeySize3072}
+	keys, err := generator.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.Private.N.BitLen() != RSAKeySize3072 {
+		t.Errorf("got key size %d, expected %d", keys.Private.N.BitLen(), RSAKeySize3072)
+	}
+}
+
+func TestNormalizeOptionsAppliesRSADefaults(t *testing.T) {
+	options, err := NormalizeOptions(RSA, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.KeySize != RSAKeySize2048 || options.Padding != PaddingPKCS1v15 {
+		t.Errorf("got %+v, expected 2048 bit key with PKCS#1 v1.5 padding", options)
+	}
+}
+
+func TestNormalizeOptionsRejectsInvalidParameters(t *testing.T) {
+	invalid := []struct {
+		algorithm string
+		options   Options
+	}{
+		{RSA, Options{KeySize: 512}},
+		{RSA, Options{Padding: "oaep"}},
+		{ECC, Options{KeySize: RSAKeySize2048}},
+		{ED25519, Options{Padding: PaddingPSS}},
+		{ECC, Options{Curve: "P-224"}},
+		{ECC, Options{Hash: "MD5"}},
+		{RSA, Options{Hash: HashSHA512}},
+		{"UNSUPPORTED", Options{}},
+	}
+	for _, c := range invalid {
+		if _, err := NormalizeOptions(c.algorithm, c.options); err == nil {
+			t.Errorf("options %+v for %s should be rejected", c.options, c.algorithm)
+		}
+	}
+}
+
 func TestECCSignerSameMessageShouldPass(t *testing.T) {
 	generator := ECCGenerator{}
 	keys, _ := generator.Generate()
@@ -72,6 +156,51 @@ func TestECCSignerSameMessageShouldPass(t *testing.T) {
 	}
 }
 
+func TestNormalizeOptionsAppliesECCDefaults(t *testing.T) {
+	options, err := NormalizeOptions(ECC, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.Curve != CurveP384 || options.Hash != HashSHA256 {
+		t.Errorf("got %+v, expected P-384 with SHA-256", options)
+	}
+}
+
+func TestECCGeneratorUsesConfiguredCurve(t *testing.T) {
+	curves := []string{CurveP256, CurveP384, CurveP521}
+	for _, curve := range curves {
+		generator := ECCGenerator{Curve: curve}
+		keys, err := generator.Generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys.Private.Curve.Params().Name != curve {
+			t.Errorf("got curve %s, expected %s", keys.Private.Curve.Params().Name, curve)
+		}
+	}
+}
+
+func TestECCSignerWithSHA512SameMessageShouldPass(t *testing.T) {
+	generator := ECCGenerator{Curve: CurveP521}
+	keys, _ := generator.Generate()
+	signer, err := GenerateSigner(keys.Private, Options{Curve: CurveP521, Hash: HashSHA512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("Data for signing")
+	signature, _ := signer.Sign(data)
+	verified, _ := signer.Verify(data, signature)
+	if !verified {
+		t.Errorf("got verified: %t, but should be true", verified)
+	}
+	// a signer with a different digest must not accept the signature
+	sha256Signer := NewECCSigner(keys.Private)
+	verified, _ = sha256Signer.Verify(data, signature)
+	if verified {
+		t.Error("signature should not verify with a different hash function")
+	}
+}
+
 func TestECCSignerTemperedMessageShouldFail(t *testing.T) {
 	generator := ECCGenerator{}
 	keys, _ := generator.Generate()
@@ -84,3 +213,71 @@ func TestECCSignerTemperedMessageShouldFail(t *testing.T) {
 		t.Errorf("got verified: %t, but should be true", verified)
 	}
 }
+
+func TestEd25519SignerSameMessageShouldPass(t *testing.T) {
+	generator := Ed25519Generator{}
+	keys, _ := generator.Generate()
+	signer := NewEd25519Signer(keys.Private)
+	data := []byte("Data for signing")
+	signature, _ := signer.Sign(data)
+	verified, _ := signer.Verify(data, signature)
+	if !verified {
+		t.Errorf("got verified: %t, but should be true", verified)
+	}
+}
+
+func TestEd25519SignerTemperedMessageShouldFail(t *testing.T) {
+	generator := Ed25519Generator{}
+	keys, _ := generator.Generate()
+	signer := NewEd25519Signer(keys.Private)
+	data := []byte("Data for signing")
+	dataTemp := []byte("Data for signing (tempered)")
+	signature, _ := signer.Sign(data)
+	verified, _ := signer.Verify(dataTemp, signature)
+	if verified {
+		t.Errorf("got verified: %t, but should be false", verified)
+	}
+}
+
+func TestEd25519KeyPairHandlerRoundTrip(t *testing.T) {
+	handler, err := GenerateKeyPairHandler(ED25519, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateKey, publicKey, err := handler.GenerateKeyPair()
+	if err != nil || len(privateKey) == 0 || len(publicKey) == 0 {
+		t.Fatal("key pair should be generated, but it isn't")
+	}
+	key, err := handler.Unmarshal(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := key.(ed25519.PrivateKey); !ok {
+		t.Error("unmarshaled key should be an Ed25519 private key")
+	}
+}
+
+func TestVerifierFromPublicKeyAcceptsSignerOutput(t *testing.T) {
+	algorithms := []string{RSA, ECC, ED25519}
+	for _, algorithm := range algorithms {
+		options, _ := NormalizeOptions(algorithm, Options{})
+		handler, _ := GenerateKeyPairHandler(algorithm, options)
+		privateKey, publicKey, _ := handler.GenerateKeyPair()
+		key, _ := handler.Unmarshal(privateKey)
+		signer, _ := GenerateSigner(key, options)
+		public, err := handler.UnmarshalPublicKey(publicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		verifier, err := GenerateVerifier(public, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := []byte("Data for signing")
+		signature, _ := signer.Sign(data)
+		verified, _ := verifier.Verify(data, signature)
+		if !verified {
+			t.Errorf("%s: got verified: %t, but should be true", algorithm, verified)
+		}
+	}
+}
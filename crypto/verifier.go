@@ -0,0 +1,122 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+)
+
+// Verifier checks signatures with a public key only.
+// It is used for keys whose private part is no longer available, e.g. rotated keys.
+type Verifier interface {
+	Verify(signedData, signature []byte) (bool, error)
+}
+
+// Verifier factory generates new Verifier instance based on the data type of the passed public key.
+// The options carry the parameters the device was created with.
+func GenerateVerifier(p interface{}, options Options) (Verifier, error) {
+	switch x := p.(type) {
+	case *rsa.PublicKey:
+		if options.Padding == PaddingPSS {
+			return NewRSAPSSVerifier(x), nil
+		}
+		return NewRSAVerifier(x), nil
+	case *ecdsa.PublicKey:
+		hash := crypto.SHA256
+		if options.Hash != "" {
+			h, err := hashFunction(options.Hash)
+			if err != nil {
+				return nil, err
+			}
+			hash = h
+		}
+		return NewECCVerifier(x, hash), nil
+	case ed25519.PublicKey:
+		return NewEd25519Verifier(x), nil
+	}
+	return nil, errors.New("algorithm for the given public key type not supported!")
+}
+
+type RSAVerifier struct {
+	publicKey *rsa.PublicKey
+}
+
+func NewRSAVerifier(publicKey *rsa.PublicKey) *RSAVerifier {
+	return &RSAVerifier{
+		publicKey: publicKey,
+	}
+}
+
+func (v RSAVerifier) Verify(signedData []byte, signature []byte) (bool, error) {
+	hashSum := sha256.Sum256(signedData)
+	err := rsa.VerifyPKCS1v15(v.publicKey, crypto.SHA256, hashSum[:], signature)
+	if err != nil {
+		return false, nil
+	}
+	return true, nil
+}
+
+type RSAPSSVerifier struct {
+	publicKey *rsa.PublicKey
+}
+
+func NewRSAPSSVerifier(publicKey *rsa.PublicKey) *RSAPSSVerifier {
+	return &RSAPSSVerifier{
+		publicKey: publicKey,
+	}
+}
+
+func (v RSAPSSVerifier) Verify(signedData []byte, signature []byte) (bool, error) {
+	hashSum := sha256.Sum256(signedData)
+	err := rsa.VerifyPSS(v.publicKey, crypto.SHA256, hashSum[:], signature, pssOptions)
+	if err != nil {
+		return false, nil
+	}
+	return true, nil
+}
+
+type ECCVerifier struct {
+	publicKey *ecdsa.PublicKey
+	hash      crypto.Hash
+}
+
+func NewECCVerifier(publicKey *ecdsa.PublicKey, hash crypto.Hash) *ECCVerifier {
+	return &ECCVerifier{
+		publicKey: publicKey,
+		hash:      hash,
+	}
+}
+
+func (v ECCVerifier) Verify(signedData []byte, signature []byte) (bool, error) {
+	hash, err := digest(v.hash, signedData)
+	if err != nil {
+		return false, err
+	}
+	return ecdsa.VerifyASN1(v.publicKey, hash, signature), nil
+}
+
+type Ed25519Verifier struct {
+	publicKey ed25519.PublicKey
+}
+
+func NewEd25519Verifier(publicKey ed25519.PublicKey) *Ed25519Verifier {
+	return &Ed25519Verifier{
+		publicKey: publicKey,
+	}
+}
+
+func (v Ed25519Verifier) Verify(signedData []byte, signature []byte) (bool, error) {
+	return ed25519.Verify(v.publicKey, signedData, signature), nil
+}
+
+func digest(hash crypto.Hash, data []byte) ([]byte, error) {
+	h := hash.New()
+	_, err := h.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
@@ -2,16 +2,83 @@ package domain
 
 import (
 	"encoding/base64"
+	"fmt"
+	"time"
 )
 
+// Lifecycle states of a device. Only active devices sign. Decommissioning is
+// final, the private key is destroyed and only the public keys are kept.
+const (
+	StateInitialized    = "INITIALIZED"
+	StateActive         = "ACTIVE"
+	StateSuspended      = "SUSPENDED"
+	StateDecommissioned = "DECOMMISSIONED"
+)
+
+// MaxTags is the largest number of tags a device carries.
+const MaxTags = 32
+
+// stateTransitions lists the states a device may move to from each state.
+var stateTransitions = map[string][]string{
+	StateInitialized: {StateActive, StateDecommissioned},
+	StateActive:      {StateSuspended, StateDecommissioned},
+	StateSuspended:   {StateActive, StateDecommissioned},
+}
+
 type SignatureDevice struct {
-	Id               string
-	Algorithm        string
-	PrivateKey       []byte
-	PublicKey        []byte
-	Label            string
-	SignatureCounter int
-	LastSignature    string
+	Id        string
+	Algorithm string
+	// PrivateKey holds the PEM encoded private key wrapped under the
+	// key-encryption key identified by KeyEncryptionKeyId.
+	PrivateKey         []byte
+	KeyEncryptionKeyId string
+	PublicKey          []byte
+	Label              string
+	SignatureCounter   int
+	LastSignature      string
+	// Tags are free key/value metadata, e.g. the store or the cash register of the device
+	Tags map[string]string
+	// State is the lifecycle state, every change of it is recorded in StateHistory
+	State        string
+	StateHistory []StateTransition
+	// the private key never leaves the service unless the device is exportable
+	Exportable bool
+	// RSA specific parameters, empty for other algorithms
+	KeySize int
+	Padding string
+	// ECC specific parameters, empty for other algorithms
+	Curve string
+	Hash  string
+	// KeyVersion is the version of the current key pair, starting with 1.
+	// Retired key pairs are kept in KeyHistory so past signatures remain verifiable.
+	KeyVersion int
+	KeyHistory []KeyVersion
+	CreatedAt  time.Time
+	// Version is incremented by every save. A save only succeeds if the device
+	// still has the version it was read with, see ErrConcurrentModification.
+	Version int
+	// FencingToken is the highest token of a device lock the device was written
+	// under. A save with a lower token comes from a holder whose lock has been
+	// taken over meanwhile, see ErrStaleFencingToken.
+	FencingToken int64
+}
+
+// KeyVersion is a retired public key of a device together with the range
+// of signature counters it has signed.
+type KeyVersion struct {
+	Version      int
+	PublicKey    []byte
+	FirstCounter int
+	LastCounter  int
+	RetiredAt    time.Time
+}
+
+// StateTransition records a change of the lifecycle state of a device.
+type StateTransition struct {
+	From   string
+	To     string
+	Reason string
+	At     time.Time
 }
 
 func NewSignatureDeviceWithoutKeys(id string, algorithm string, label string) *SignatureDevice {
@@ -21,5 +88,105 @@ func NewSignatureDeviceWithoutKeys(id string, algorithm string, label string) *S
 		Label:            label,
 		SignatureCounter: 0,
 		LastSignature:    base64.StdEncoding.EncodeToString([]byte(id)),
+		KeyVersion:       1,
+		State:            StateInitialized,
+	}
+}
+
+// Transition moves the device to another lifecycle state. A decommissioned device
+// loses its private key, its public keys remain for verification.
+func (d *SignatureDevice) Transition(state, reason string, at time.Time) error {
+	allowed := false
+	for _, next := range stateTransitions[d.State] {
+		allowed = allowed || next == state
+	}
+	if !allowed {
+		return fmt.Errorf("%w: %s to %s", ErrInvalidStateTransition, d.State, state)
+	}
+	// copy the history, the slice may be shared with other copies of the device
+	history := make([]StateTransition, len(d.StateHistory), len(d.StateHistory)+1)
+	copy(history, d.StateHistory)
+	d.StateHistory = append(history, StateTransition{
+		From:   d.State,
+		To:     state,
+		Reason: reason,
+		At:     at,
+	})
+	d.State = state
+	if state == StateDecommissioned {
+		d.PrivateKey = nil
+		d.KeyEncryptionKeyId = ""
+	}
+	return nil
+}
+
+// UpdateMetadata replaces the label, unless it is nil, and merges the tags into the
+// tags of the device. A tag without a value is removed. Counter and keys are untouched.
+func (d *SignatureDevice) UpdateMetadata(label *string, tags map[string]*string) error {
+	// copy the tags, the map may be shared with other copies of the device
+	merged := make(map[string]string, len(d.Tags)+len(tags))
+	for key, value := range d.Tags {
+		merged[key] = value
+	}
+	for key, value := range tags {
+		if value == nil {
+			delete(merged, key)
+		} else {
+			merged[key] = *value
+		}
+	}
+	if len(merged) > MaxTags {
+		return fmt.Errorf("%w: a device carries at most %d tags", ErrTooManyTags, MaxTags)
+	}
+	if len(merged) == 0 {
+		merged = nil
+	}
+	if label != nil {
+		d.Label = *label
+	}
+	d.Tags = merged
+	return nil
+}
+
+// CheckActive returns ErrDeviceNotActive unless the device may sign.
+func (d *SignatureDevice) CheckActive() error {
+	if d.State != StateActive {
+		return fmt.Errorf("%w (%s)", ErrDeviceNotActive, d.State)
+	}
+	return nil
+}
+
+// RotateKeyPair replaces the key pair of the device. The current public key is
+// moved to the history; it has signed every counter up to lastCounter.
+func (d *SignatureDevice) RotateKeyPair(privateKey, publicKey []byte, lastCounter int, rotatedAt time.Time) {
+	// copy the history, the slice may be shared with other copies of the device
+	history := make([]KeyVersion, len(d.KeyHistory), len(d.KeyHistory)+1)
+	copy(history, d.KeyHistory)
+	d.KeyHistory = append(history, KeyVersion{
+		Version:      d.KeyVersion,
+		PublicKey:    d.PublicKey,
+		FirstCounter: d.currentKeyFirstCounter(),
+		LastCounter:  lastCounter,
+		RetiredAt:    rotatedAt,
+	})
+	d.KeyVersion = d.KeyVersion + 1
+	d.PrivateKey = privateKey
+	d.PublicKey = publicKey
+}
+
+// PublicKeyForCounter returns the version and the public key which signed the given counter.
+func (d *SignatureDevice) PublicKeyForCounter(counter int) (int, []byte) {
+	for _, version := range d.KeyHistory {
+		if counter >= version.FirstCounter && counter <= version.LastCounter {
+			return version.Version, version.PublicKey
+		}
+	}
+	return d.KeyVersion, d.PublicKey
+}
+
+func (d *SignatureDevice) currentKeyFirstCounter() int {
+	if len(d.KeyHistory) == 0 {
+		return 0
 	}
+	return d.KeyHistory[len(d.KeyHistory)-1].LastCounter + 1
 }
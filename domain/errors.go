@@ -1,9 +1,31 @@
 package domain
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
-	ErrDeviceNotFound         = errors.New("device not found")
-	ErrSignatureNotFound      = errors.New("signature not found")
-	ErrKeyPairAlreadyAttached = errors.New("key pair for this device already attached")
+	ErrDeviceNotFound           = errors.New("device not found")
+	ErrSignatureNotFound        = errors.New("signature not found")
+	ErrKeyPairAlreadyAttached   = errors.New("key pair for this device already attached")
+	ErrUnknownKeyEncryptionKey  = errors.New("private key is wrapped under an unknown key-encryption key")
+	ErrKeyNotExportable         = errors.New("private key of this device is not exportable")
+	ErrDuplicateSignature       = errors.New("a signature with this counter already exists for the device")
+	ErrConcurrentModification   = errors.New("device was modified concurrently")
+	ErrSignatureCounterConflict = fmt.Errorf("%w: signature counter changed", ErrConcurrentModification)
+	ErrInvalidCursor            = errors.New("invalid cursor")
+	ErrStaleFencingToken        = errors.New("device lock was taken over by another holder")
+	ErrLockTimeout              = errors.New("timed out waiting for the device lock")
+	ErrDeviceBusy               = errors.New("device is locked by another request")
+	ErrInvalidStateTransition   = errors.New("device state transition not allowed")
+	ErrDeviceNotActive          = errors.New("device is not active")
+	ErrKeyDestroyed             = errors.New("private key of this device has been destroyed")
+	ErrTooManyTags              = errors.New("too many tags")
+	ErrVersionMismatch          = errors.New("device does not have the expected version")
+	ErrJobNotFound              = errors.New("signing job not found")
+	ErrJobOfOtherInstance       = errors.New("signing job was accepted by another instance")
+	ErrQueueFull                = errors.New("signing queue is full")
+	ErrQueueClosed              = errors.New("signing queue is closed")
+	ErrReservedData             = fmt.Errorf("data must not start with %s, it is reserved for key rollover records", KeyRolloverPrefix)
 )
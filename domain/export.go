@@ -0,0 +1,25 @@
+package domain
+
+import "time"
+
+// KeyExport is the audit record of a private key export.
+type KeyExport struct {
+	Id                   string
+	DeviceId             string
+	Scheme               string
+	RecipientFingerprint string
+	// ExportedBy names the authenticated caller which exported the key
+	ExportedBy string
+	ExportedAt time.Time
+}
+
+func NewKeyExport(id, deviceId, scheme, recipientFingerprint, exportedBy string, exportedAt time.Time) *KeyExport {
+	return &KeyExport{
+		Id:                   id,
+		DeviceId:             deviceId,
+		Scheme:               scheme,
+		RecipientFingerprint: recipientFingerprint,
+		ExportedBy:           exportedBy,
+		ExportedAt:           exportedAt,
+	}
+}
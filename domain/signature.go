@@ -1,10 +1,24 @@
 package domain
 
+import (
+	"strings"
+	"time"
+)
+
+// KeyRolloverPrefix marks the data of key rollover records in the signature chain.
+// Only the rotation of a key pair writes data with this prefix.
+const KeyRolloverPrefix = "KEY_ROLLOVER"
+
 type Signature struct {
 	Id        string
 	Signature string
 	Data      string
 	SignedBy  string
+	// position in the signature chain of the device
+	Counter           int
+	PreviousSignature string
+	CreatedAt         time.Time
+	Algorithm         string
 }
 
 func NewSignature(id, signature, data, deviceId string) *Signature {
@@ -15,3 +29,12 @@ func NewSignature(id, signature, data, deviceId string) *Signature {
 		SignedBy:  deviceId,
 	}
 }
+
+// CheckPayload refuses data to be signed for a client which would pass for a key
+// rollover record, it could bind a public key of the client into the signature chain.
+func CheckPayload(data string) error {
+	if strings.HasPrefix(data, KeyRolloverPrefix) {
+		return ErrReservedData
+	}
+	return nil
+}
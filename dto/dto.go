@@ -1,27 +1,121 @@
 package dto
 
+import "time"
+
 type CreateSignatureDeviceRequest struct {
 	Algorithm string `json:"algorithm" validate:"required"`
 	Label     string `json:"label" validate:"required"`
+	// exportable devices allow an audited export of the private key
+	Exportable bool   `json:"exportable"`
+	KeySize    int    `json:"key_size,omitempty"`
+	Padding    string `json:"padding,omitempty"`
+	Curve      string `json:"curve,omitempty"`
+	Hash       string `json:"hash,omitempty"`
+}
+
+// ImportSignatureDeviceRequest creates a device for an existing private key.
+// The algorithm is detected from the key.
+type ImportSignatureDeviceRequest struct {
+	Label string `json:"label" validate:"required"`
+	// PEM encoded PKCS#1, PKCS#8 or SEC1 private key
+	PrivateKey string `json:"private_key" validate:"required"`
+	Exportable bool   `json:"exportable"`
+	Padding    string `json:"padding,omitempty"`
+	Hash       string `json:"hash,omitempty"`
 }
 
 type CreateSignatureDeviceResponse struct {
 	Id               string `json:"id"`
 	Algorithm        string `json:"algorithm"`
 	Label            string `json:"label"`
-	PrivateKey       string `json:"private_key"`
 	PublicKey        string `json:"public_key"`
+	Exportable       bool   `json:"exportable"`
 	SignatureCounter int    `json:"signature_counter"`
 	LastSignature    string `json:"last_signature"`
+	KeySize          int    `json:"key_size,omitempty"`
+	Padding          string `json:"padding,omitempty"`
+	Curve            string `json:"curve,omitempty"`
+	Hash             string `json:"hash,omitempty"`
+	State            string `json:"state"`
 }
 
 type SignatureDeviceResponse struct {
-	Id               string `json:"id"`
-	Algorithm        string `json:"algorithm"`
-	Label            string `json:"label"`
-	PublicKey        string `json:"public_key"`
-	SignatureCounter int    `json:"signature_counter"`
-	LastSignature    string `json:"last_signature"`
+	Id               string                    `json:"id"`
+	Algorithm        string                    `json:"algorithm"`
+	Label            string                    `json:"label"`
+	PublicKey        string                    `json:"public_key"`
+	Exportable       bool                      `json:"exportable"`
+	SignatureCounter int                       `json:"signature_counter"`
+	LastSignature    string                    `json:"last_signature"`
+	KeySize          int                       `json:"key_size,omitempty"`
+	Padding          string                    `json:"padding,omitempty"`
+	Curve            string                    `json:"curve,omitempty"`
+	Hash             string                    `json:"hash,omitempty"`
+	KeyVersion       int                       `json:"key_version"`
+	KeyHistory       []KeyVersionResponse      `json:"key_history"`
+	CreatedAt        time.Time                 `json:"created_at"`
+	State            string                    `json:"state"`
+	StateHistory     []StateTransitionResponse `json:"state_history"`
+	Tags             map[string]string         `json:"tags"`
+	// Version changes with every write, it is the ETag of the device
+	Version int `json:"version"`
+}
+
+// UpdateDeviceRequest changes the metadata of a device. Omitted fields are left
+// unchanged, a tag set to null is removed.
+type UpdateDeviceRequest struct {
+	Label *string            `json:"label"`
+	Tags  map[string]*string `json:"tags"`
+	// ExpectedVersions are taken from the If-Match header, the device must have one
+	// of them. Nil updates any version, an empty list none.
+	ExpectedVersions []int `json:"-"`
+}
+
+type StateTransitionResponse struct {
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+// TransitionDeviceRequest moves a device to another lifecycle state, the reason is recorded.
+type TransitionDeviceRequest struct {
+	Reason string `json:"reason" validate:"required"`
+}
+
+// ListDevicesRequest selects a page of devices, it is built from the query parameters of the request.
+type ListDevicesRequest struct {
+	Limit       int
+	Cursor      string
+	Sort        string
+	Order       string
+	Algorithm   string
+	LabelPrefix string
+	// Tags is built from the tag parameters, each of the form key:value
+	Tags map[string]string
+}
+
+// DeviceListResponse is one page of devices, Total counts all devices matching the filters.
+type DeviceListResponse struct {
+	Devices    []SignatureDeviceResponse `json:"devices"`
+	NextCursor string                    `json:"next_cursor,omitempty"`
+	Total      int                       `json:"total"`
+}
+
+type KeyVersionResponse struct {
+	Version      int       `json:"version"`
+	PublicKey    string    `json:"public_key"`
+	FirstCounter int       `json:"first_counter"`
+	LastCounter  int       `json:"last_counter"`
+	RetiredAt    time.Time `json:"retired_at"`
+}
+
+// KeyRotationResponse holds the new public key and the key rollover
+// record signed with the previous key.
+type KeyRotationResponse struct {
+	KeyVersion int    `json:"key_version"`
+	PublicKey  string `json:"public_key"`
+	SignatureResponse
 }
 
 type SignatureRequest struct {
@@ -29,16 +123,97 @@ type SignatureRequest struct {
 	Data string `json:"data" validate:"required"`
 }
 
+// BatchSignatureRequest holds the payloads of a batch in the order they are signed.
+type BatchSignatureRequest struct {
+	Data []string `json:"data" validate:"required"`
+}
+
+// BatchSignatureResponse holds the signatures in the order of the payloads,
+// they are consecutive links of the signature chain.
+type BatchSignatureResponse struct {
+	Signatures []SignatureResponse `json:"signatures"`
+}
+
 type SignatureResponse struct {
-	Signature  string `json:"signature"`
-	SignedData string `json:"signed_data"`
+	SignatureId       string `json:"signature_id"`
+	Signature         string `json:"signature"`
+	SignedData        string `json:"signed_data"`
+	Counter           int    `json:"signature_counter"`
+	PreviousSignature string `json:"previous_signature"`
+	Algorithm         string `json:"algorithm"`
+}
+
+// signing job states
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// SigningJobResponse is the state of an asynchronous signing job. Result is set
+// once the job has succeeded, Error once it has failed. The job can only be polled
+// on the instance which accepted it, InstanceId identifies it.
+type SigningJobResponse struct {
+	Id         string             `json:"job_id"`
+	InstanceId string             `json:"instance_id"`
+	DeviceId   string             `json:"device_id"`
+	Status     string             `json:"status"`
+	CreatedAt  time.Time          `json:"created_at"`
+	StartedAt  *time.Time         `json:"started_at,omitempty"`
+	FinishedAt *time.Time         `json:"finished_at,omitempty"`
+	Result     *SignatureResponse `json:"result,omitempty"`
+	Error      *JobError          `json:"error,omitempty"`
+	// Err is the error of a failed job, the API translates it into Error
+	Err error `json:"-"`
+}
+
+type JobError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
 }
 
 type SignatureFullResponse struct {
-	Id         string `json:"signature_id"`
-	Signature  string `json:"signature"`
-	SignedData string `json:"signed_data"`
-	SignedBy   string `json:"signed_by"`
+	Id                string    `json:"signature_id"`
+	Signature         string    `json:"signature"`
+	SignedData        string    `json:"signed_data"`
+	SignedBy          string    `json:"signed_by"`
+	Counter           int       `json:"signature_counter"`
+	PreviousSignature string    `json:"previous_signature"`
+	CreatedAt         time.Time `json:"created_at"`
+	Algorithm         string    `json:"algorithm"`
+}
+
+// ListSignaturesRequest selects a page of the signatures of a device,
+// it is built from the query parameters of the request.
+type ListSignaturesRequest struct {
+	Limit       int
+	Cursor      string
+	Order       string
+	FromCounter *int
+	ToCounter   *int
+	From        time.Time
+	To          time.Time
+}
+
+// SignatureListResponse is one page of signatures, NextCursor is empty on the last page.
+type SignatureListResponse struct {
+	Signatures []SignatureFullResponse `json:"signatures"`
+	NextCursor string                  `json:"next_cursor,omitempty"`
+}
+
+// ChainVerificationResponse is the result of verifying the full signature chain of a device.
+type ChainVerificationResponse struct {
+	Valid              bool                `json:"valid"`
+	VerifiedSignatures int                 `json:"verified_signatures"`
+	BrokenLink         *BrokenLinkResponse `json:"broken_link,omitempty"`
+}
+
+// BrokenLinkResponse describes the first record of a chain which failed verification.
+type BrokenLinkResponse struct {
+	Counter     int    `json:"counter"`
+	SignatureId string `json:"signature_id,omitempty"`
+	Reason      string `json:"reason"`
 }
 
 type VerificationResponse struct {
@@ -50,3 +225,58 @@ type VerificationRequest struct {
 	Signature string `json:"signature"`
 	Data      string `json:"signed_data"`
 }
+
+type ExportKeyRequest struct {
+	// PEM encoded RSA, EC or X25519 public key of the recipient
+	PublicKey string `json:"public_key"`
+}
+
+// ExportKeyResponse holds the private key encrypted for the recipient,
+// binary values are base64 encoded.
+type ExportKeyResponse struct {
+	ExportId           string `json:"export_id"`
+	Scheme             string `json:"scheme"`
+	EncryptedKey       string `json:"encrypted_key,omitempty"`
+	EphemeralPublicKey string `json:"ephemeral_public_key,omitempty"`
+	Nonce              string `json:"nonce"`
+	Ciphertext         string `json:"ciphertext"`
+}
+
+type KeyExportResponse struct {
+	Id                   string    `json:"id"`
+	DeviceId             string    `json:"device_id"`
+	Scheme               string    `json:"scheme"`
+	RecipientFingerprint string    `json:"recipient_fingerprint"`
+	ExportedBy           string    `json:"exported_by"`
+	ExportedAt           time.Time `json:"exported_at"`
+}
+
+type RewrapKeysResponse struct {
+	RewrappedDevices   int    `json:"rewrapped_devices"`
+	KeyEncryptionKeyId string `json:"key_encryption_key_id"`
+}
+
+type SignerCacheMetrics struct {
+	Size      int    `json:"size"`
+	Capacity  int    `json:"capacity"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+// KeyPoolMetrics describes the pool of one key set, misses count the key
+// pairs which had to be generated while the device was created.
+type KeyPoolMetrics struct {
+	Algorithm string `json:"algorithm"`
+	KeySize   int    `json:"key_size,omitempty"`
+	Curve     string `json:"curve,omitempty"`
+	Depth     int    `json:"depth"`
+	Watermark int    `json:"watermark"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+}
+
+type MetricsResponse struct {
+	SignerCache SignerCacheMetrics `json:"signer_cache"`
+	KeyPool     []KeyPoolMetrics   `json:"key_pool"`
+}
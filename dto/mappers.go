@@ -1,37 +1,85 @@
 package dto
 
-import "signing-service-challenge/domain"
+import (
+	"encoding/base64"
+	"signing-service-challenge/crypto"
+	"signing-service-challenge/domain"
+)
 
 func ConvertSignatureDeviceToCreateResponse(device domain.SignatureDevice) CreateSignatureDeviceResponse {
-	// A private key is accessible only initially after the creation of a device
+	// The private key never leaves the service, see the key export for exportable devices
 	return CreateSignatureDeviceResponse{
 		Id:               device.Id,
 		Algorithm:        device.Algorithm,
 		Label:            device.Label,
-		PrivateKey:       string(device.PrivateKey),
 		PublicKey:        string(device.PublicKey),
+		Exportable:       device.Exportable,
 		SignatureCounter: device.SignatureCounter,
 		LastSignature:    device.LastSignature,
+		KeySize:          device.KeySize,
+		Padding:          device.Padding,
+		Curve:            device.Curve,
+		Hash:             device.Hash,
+		State:            device.State,
 	}
 }
 
 func ConvertSignatureDeviceToResponse(device domain.SignatureDevice) SignatureDeviceResponse {
+	keyHistory := []KeyVersionResponse{}
+	for _, version := range device.KeyHistory {
+		keyHistory = append(keyHistory, KeyVersionResponse{
+			Version:      version.Version,
+			PublicKey:    string(version.PublicKey),
+			FirstCounter: version.FirstCounter,
+			LastCounter:  version.LastCounter,
+			RetiredAt:    version.RetiredAt,
+		})
+	}
+	stateHistory := []StateTransitionResponse{}
+	for _, transition := range device.StateHistory {
+		stateHistory = append(stateHistory, StateTransitionResponse{
+			From:   transition.From,
+			To:     transition.To,
+			Reason: transition.Reason,
+			At:     transition.At,
+		})
+	}
+	tags := map[string]string{}
+	for key, value := range device.Tags {
+		tags[key] = value
+	}
 	return SignatureDeviceResponse{
 		Id:               device.Id,
 		Algorithm:        device.Algorithm,
 		Label:            device.Label,
 		PublicKey:        string(device.PublicKey),
+		Exportable:       device.Exportable,
 		SignatureCounter: device.SignatureCounter,
 		LastSignature:    device.LastSignature,
+		KeySize:          device.KeySize,
+		Padding:          device.Padding,
+		Curve:            device.Curve,
+		Hash:             device.Hash,
+		KeyVersion:       device.KeyVersion,
+		KeyHistory:       keyHistory,
+		CreatedAt:        device.CreatedAt,
+		State:            device.State,
+		StateHistory:     stateHistory,
+		Tags:             tags,
+		Version:          device.Version,
 	}
 }
 
 func ConvertSignatureToResponse(signature domain.Signature) SignatureFullResponse {
 	return SignatureFullResponse{
-		Id:         signature.Id,
-		Signature:  signature.Signature,
-		SignedData: signature.Data,
-		SignedBy:   signature.SignedBy,
+		Id:                signature.Id,
+		Signature:         signature.Signature,
+		SignedData:        signature.Data,
+		SignedBy:          signature.SignedBy,
+		Counter:           signature.Counter,
+		PreviousSignature: signature.PreviousSignature,
+		CreatedAt:         signature.CreatedAt,
+		Algorithm:         signature.Algorithm,
 	}
 }
 
@@ -40,3 +88,25 @@ func ConvertVerificationToResponse(verification bool) VerificationResponse {
 		Status: verification,
 	}
 }
+
+func ConvertExportedKeyToResponse(exportId string, exported crypto.ExportedKey) ExportKeyResponse {
+	return ExportKeyResponse{
+		ExportId:           exportId,
+		Scheme:             exported.Scheme,
+		EncryptedKey:       base64.StdEncoding.EncodeToString(exported.EncryptedKey),
+		EphemeralPublicKey: string(exported.EphemeralPublicKey),
+		Nonce:              base64.StdEncoding.EncodeToString(exported.Nonce),
+		Ciphertext:         base64.StdEncoding.EncodeToString(exported.Ciphertext),
+	}
+}
+
+func ConvertKeyExportToResponse(export domain.KeyExport) KeyExportResponse {
+	return KeyExportResponse{
+		Id:                   export.Id,
+		DeviceId:             export.DeviceId,
+		Scheme:               export.Scheme,
+		RecipientFingerprint: export.RecipientFingerprint,
+		ExportedBy:           export.ExportedBy,
+		ExportedAt:           export.ExportedAt,
+	}
+}
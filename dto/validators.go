@@ -1,6 +1,12 @@
 package dto
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"signing-service-challenge/domain"
+	"unicode/utf8"
+)
 
 func ValidateCreateSignatureDeviceRequest(request CreateSignatureDeviceRequest) (bool, error) {
 	if request.Algorithm == "" {
@@ -9,6 +15,19 @@ func ValidateCreateSignatureDeviceRequest(request CreateSignatureDeviceRequest)
 	if request.Label == "" {
 		return false, errors.New("label field is required")
 	}
+	if request.KeySize < 0 {
+		return false, errors.New("key_size field must be positive")
+	}
+	return true, nil
+}
+
+func ValidateImportSignatureDeviceRequest(request ImportSignatureDeviceRequest) (bool, error) {
+	if request.Label == "" {
+		return false, errors.New("label field is required")
+	}
+	if request.PrivateKey == "" {
+		return false, errors.New("private_key field is required")
+	}
 	return true, nil
 }
 
@@ -19,6 +38,27 @@ func ValidateSignRequest(request SignatureRequest) (bool, error) {
 	if request.Data == "" {
 		return false, errors.New("data field is required")
 	}
+	if err := domain.CheckPayload(request.Data); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// MaxBatchSize is the largest number of payloads signed in one batch.
+const MaxBatchSize = 100
+
+func ValidateBatchSignatureRequest(request BatchSignatureRequest) (bool, error) {
+	if len(request.Data) == 0 || len(request.Data) > MaxBatchSize {
+		return false, fmt.Errorf("data field must hold 1 to %d payloads", MaxBatchSize)
+	}
+	for i, data := range request.Data {
+		if data == "" {
+			return false, fmt.Errorf("payload %d of the data field is empty", i)
+		}
+		if err := domain.CheckPayload(data); err != nil {
+			return false, fmt.Errorf("payload %d: %w", i, err)
+		}
+	}
 	return true, nil
 }
 
@@ -34,3 +74,111 @@ func ValidateVerifyRequest(request VerificationRequest) (bool, error) {
 	}
 	return true, nil
 }
+
+func ValidateTransitionDeviceRequest(request TransitionDeviceRequest) (bool, error) {
+	if request.Reason == "" {
+		return false, errors.New("reason field is required")
+	}
+	return true, nil
+}
+
+// tag keys are restricted, so they can be used in tag queries and as JSON keys in SQL
+var tagKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+const MaxTagValueLength = 256
+
+func validateTagKey(key string) error {
+	if !tagKeyPattern.MatchString(key) {
+		return fmt.Errorf("tag key %q must be 1 to 64 letters, digits, '_', '.' or '-'", key)
+	}
+	return nil
+}
+
+func ValidateTag(key, value string) error {
+	if err := validateTagKey(key); err != nil {
+		return err
+	}
+	if value == "" || utf8.RuneCountInString(value) > MaxTagValueLength {
+		return fmt.Errorf("value of tag %q must be 1 to %d characters", key, MaxTagValueLength)
+	}
+	return nil
+}
+
+func ValidateUpdateDeviceRequest(request UpdateDeviceRequest) (bool, error) {
+	if request.Label == nil && len(request.Tags) == 0 {
+		return false, errors.New("label or tags field is required")
+	}
+	if request.Label != nil && *request.Label == "" {
+		return false, errors.New("label field must not be empty")
+	}
+	for key, value := range request.Tags {
+		// only the key of a tag which is removed is checked
+		err := validateTagKey(key)
+		if value != nil {
+			err = ValidateTag(key, *value)
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func ValidateExportKeyRequest(request ExportKeyRequest) (bool, error) {
+	if request.PublicKey == "" {
+		return false, errors.New("public_key field is required")
+	}
+	return true, nil
+}
+
+// page size limits for listings
+const (
+	DefaultPageSize = 100
+	MaxPageSize     = 1000
+)
+
+// list orders
+const (
+	OrderAscending  = "asc"
+	OrderDescending = "desc"
+)
+
+// device list sort keys
+const (
+	SortByCreatedAt = "created_at"
+	SortByLabel     = "label"
+)
+
+func ValidateListSignaturesRequest(request ListSignaturesRequest) (bool, error) {
+	if request.Limit < 0 || request.Limit > MaxPageSize {
+		return false, fmt.Errorf("limit must be between 1 and %d", MaxPageSize)
+	}
+	if request.Order != "" && request.Order != OrderAscending && request.Order != OrderDescending {
+		return false, errors.New("order must be asc or desc")
+	}
+	if request.FromCounter != nil && request.ToCounter != nil && *request.FromCounter > *request.ToCounter {
+		return false, errors.New("from_counter must not be greater than to_counter")
+	}
+	if !request.From.IsZero() && !request.To.IsZero() && !request.From.Before(request.To) {
+		return false, errors.New("from must be before to")
+	}
+	return true, nil
+}
+
+func ValidateListDevicesRequest(request ListDevicesRequest) (bool, error) {
+	if request.Limit < 0 || request.Limit > MaxPageSize {
+		return false, fmt.Errorf("limit must be between 1 and %d", MaxPageSize)
+	}
+	if request.Order != "" && request.Order != OrderAscending && request.Order != OrderDescending {
+		return false, errors.New("order must be asc or desc")
+	}
+	if request.Sort != "" && request.Sort != SortByCreatedAt && request.Sort != SortByLabel {
+		return false, errors.New("sort must be created_at or label")
+	}
+	for key, value := range request.Tags {
+		if err := ValidateTag(key, value); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
@@ -4,4 +4,8 @@ go 1.20
 
 require github.com/google/uuid v1.3.0
 
-require github.com/gorilla/mux v1.8.1
+require (
+	github.com/gorilla/mux v1.8.1
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.33
+)
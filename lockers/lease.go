@@ -0,0 +1,210 @@
+package lockers
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrLeaseLost = errors.New("device lease lost")
+
+// Lease is the time limited right of an owner to write a device.
+type Lease struct {
+	Id    string
+	Owner string
+	// Token grows with every grant of the lease on the same id
+	Token     int64
+	ExpiresAt time.Time
+}
+
+// LeaseStore grants leases on device ids shared by all instances of the service.
+type LeaseStore interface {
+	// Acquire grants the lease on the id to the owner if it is free or has expired.
+	// The second result is false if the lease is held by someone else.
+	Acquire(id, owner string, ttl time.Duration) (Lease, bool, error)
+	// Renew extends a lease, it fails with ErrLeaseLost if the lease has expired meanwhile.
+	Renew(lease Lease, ttl time.Duration) (Lease, error)
+	// Release frees a lease early. A lease which was lost is left alone.
+	Release(lease Lease) error
+}
+
+// LeaseLocker locks devices across instances with leases of a shared LeaseStore.
+// The lease is renewed in the background while it is held; if the holder crashes
+// the lease expires after the TTL and another instance can take over. Since a
+// stalled holder may still write after that, the lease token is returned as the
+// fencing token of the lock.
+type LeaseLocker struct {
+	store LeaseStore
+	// owner identifies this instance in the lease store
+	owner        string
+	ttl          time.Duration
+	pollInterval time.Duration
+	// goroutines of this instance wait locally instead of polling the store
+	local  *ShardedDeviceLocker
+	mutex  sync.Mutex
+	leases map[string]*heldLease
+}
+
+type heldLease struct {
+	lease Lease
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func NewLeaseLocker(store LeaseStore, ttl time.Duration) *LeaseLocker {
+	return &LeaseLocker{
+		store:        store,
+		owner:        uuid.NewString(),
+		ttl:          ttl,
+		pollInterval: ttl / 10,
+		local:        NewShardedDeviceLocker(DefaultShards),
+		leases:       make(map[string]*heldLease),
+	}
+}
+
+func (l *LeaseLocker) Lock(id string) (int64, error) {
+	return l.LockContext(context.Background(), id)
+}
+
+func (l *LeaseLocker) LockContext(ctx context.Context, id string) (int64, error) {
+	if _, err := l.local.LockContext(ctx, id); err != nil {
+		return NoFencingToken, err
+	}
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			l.local.Unlock(id)
+			return NoFencingToken, ctx.Err()
+		case <-timer.C:
+		}
+		token, acquired, err := l.acquire(id)
+		if err != nil {
+			l.local.Unlock(id)
+			return NoFencingToken, err
+		}
+		if acquired {
+			return token, nil
+		}
+		// held by another instance
+		timer.Reset(l.pollInterval)
+	}
+}
+
+func (l *LeaseLocker) TryLock(id string) (int64, bool, error) {
+	if _, ok, _ := l.local.TryLock(id); !ok {
+		return NoFencingToken, false, nil
+	}
+	token, acquired, err := l.acquire(id)
+	if err != nil || !acquired {
+		l.local.Unlock(id)
+		return NoFencingToken, false, err
+	}
+	return token, true, nil
+}
+
+// acquire tries to take the lease once and keeps renewing it if it was granted.
+// The caller must hold the local lock of the device.
+func (l *LeaseLocker) acquire(id string) (int64, bool, error) {
+	lease, acquired, err := l.store.Acquire(id, l.owner, l.ttl)
+	if err != nil || !acquired {
+		return NoFencingToken, false, err
+	}
+	held := &heldLease{lease: lease, stop: make(chan struct{}), done: make(chan struct{})}
+	l.mutex.Lock()
+	l.leases[id] = held
+	l.mutex.Unlock()
+	go l.renew(held)
+	return lease.Token, true, nil
+}
+
+// renew extends the lease until it is released. If a renewal fails the lease
+// will expire, writes of the holder are then refused by their stale fencing token.
+func (l *LeaseLocker) renew(held *heldLease) {
+	defer close(held.done)
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-held.stop:
+			return
+		case <-ticker.C:
+			lease, err := l.store.Renew(held.lease, l.ttl)
+			if errors.Is(err, ErrLeaseLost) {
+				return
+			}
+			if err == nil {
+				held.lease = lease
+			}
+		}
+	}
+}
+
+func (l *LeaseLocker) Unlock(id string) error {
+	l.mutex.Lock()
+	held, ok := l.leases[id]
+	delete(l.leases, id)
+	l.mutex.Unlock()
+	if !ok {
+		return ErrNotLocked
+	}
+	close(held.stop)
+	<-held.done
+	err := l.store.Release(held.lease)
+	l.local.Unlock(id)
+	return err
+}
+
+// InMemoryLeaseStore is a LeaseStore for a single process, mainly for testing.
+type InMemoryLeaseStore struct {
+	mutex sync.Mutex
+	// released leases are kept, so the next token continues the sequence
+	leases map[string]Lease
+}
+
+func NewInMemoryLeaseStore() *InMemoryLeaseStore {
+	return &InMemoryLeaseStore{
+		leases: make(map[string]Lease),
+	}
+}
+
+func (s *InMemoryLeaseStore) Acquire(id, owner string, ttl time.Duration) (Lease, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	current, ok := s.leases[id]
+	if ok && current.ExpiresAt.After(now) {
+		return Lease{}, false, nil
+	}
+	lease := Lease{Id: id, Owner: owner, Token: current.Token + 1, ExpiresAt: now.Add(ttl)}
+	s.leases[id] = lease
+	return lease, true, nil
+}
+
+func (s *InMemoryLeaseStore) Renew(lease Lease, ttl time.Duration) (Lease, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	current, ok := s.leases[lease.Id]
+	if !ok || current.Token != lease.Token || !current.ExpiresAt.After(now) {
+		return lease, ErrLeaseLost
+	}
+	current.ExpiresAt = now.Add(ttl)
+	s.leases[lease.Id] = current
+	return current, nil
+}
+
+func (s *InMemoryLeaseStore) Release(lease Lease) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current, ok := s.leases[lease.Id]
+	if ok && current.Token == lease.Token {
+		current.ExpiresAt = time.Time{}
+		s.leases[lease.Id] = current
+	}
+	return nil
+}
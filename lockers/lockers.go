@@ -1,14 +1,30 @@
 package lockers
 
 import (
+	"context"
+	"errors"
 	"sync"
 )
 
+var ErrNotLocked = errors.New("device is not locked")
+
 type DeviceLocker interface {
-	Lock(id string)
+	// Lock blocks until the device is locked and returns the fencing token of the lock.
+	// Writes under the lock carry the token, so a holder whose lock was taken over
+	// cannot overwrite the writes of the next holder. NoFencingToken disables the check.
+	Lock(id string) (int64, error)
+	// LockContext is Lock, but gives up waiting with the error of the context once it is done.
+	LockContext(ctx context.Context, id string) (int64, error)
+	// TryLock locks the device only if nobody else holds it and reports whether it did.
+	// An error means the lock could not be checked at all, e.g. the lease store is down.
+	TryLock(id string) (int64, bool, error)
+	// Unlock fails with ErrNotLocked if the device is not locked.
 	Unlock(id string) error
 }
 
+// NoFencingToken is returned by lockers which only serialize a single process.
+const NoFencingToken int64 = 0
+
 // ID locking is required based on the assumption that multiple clients
 // can simultaneously access the same device. If we use global lock in this
 // case it will block all devices.
@@ -40,20 +56,54 @@ func (p *DeviceLockerWithGlobalMapProtection) isLocked(id string) bool {
 	return ok
 }
 
-func (p *DeviceLockerWithGlobalMapProtection) Lock(id string) {
+func (p *DeviceLockerWithGlobalMapProtection) Lock(id string) (int64, error) {
+	return p.LockContext(context.Background(), id)
+}
+
+func (p *DeviceLockerWithGlobalMapProtection) LockContext(ctx context.Context, id string) (int64, error) {
 	p.locker.Lock()
 	defer p.locker.Unlock()
+	if p.isLocked(id) && ctx.Done() != nil {
+		// sync.Cond cannot wait for the context, so the waiters are woken up when it is done
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				p.locker.Lock()
+				p.cond.Broadcast()
+				p.locker.Unlock()
+			case <-stop:
+			}
+		}()
+	}
 	for p.isLocked(id) {
+		if err := ctx.Err(); err != nil {
+			return NoFencingToken, err
+		}
 		// wait for unlock
 		p.cond.Wait()
 	}
 	p.ids[id] = struct{}{}
-	return
+	return NoFencingToken, nil
+}
+
+func (p *DeviceLockerWithGlobalMapProtection) TryLock(id string) (int64, bool, error) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	if p.isLocked(id) {
+		return NoFencingToken, false, nil
+	}
+	p.ids[id] = struct{}{}
+	return NoFencingToken, true, nil
 }
 
 func (p *DeviceLockerWithGlobalMapProtection) Unlock(id string) error {
 	p.locker.Lock()
 	defer p.locker.Unlock()
+	if !p.isLocked(id) {
+		return ErrNotLocked
+	}
 	delete(p.ids, id)
 	// wake other clients waiting on this device
 	p.cond.Broadcast()
@@ -0,0 +1,156 @@
+package lockers
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func newLockers() map[string]func() DeviceLocker {
+	return map[string]func() DeviceLocker{
+		"GlobalMap": func() DeviceLocker { return NewDeviceLockerWithGlobalMapProtection(&sync.Mutex{}) },
+		"Sharded":   func() DeviceLocker { return NewShardedDeviceLocker(DefaultShards) },
+	}
+}
+
+func TestLockIsExclusivePerDevice(t *testing.T) {
+	for name, newLocker := range newLockers() {
+		t.Run(name, func(t *testing.T) {
+			locker := newLocker()
+			counters := make([]int, 10)
+			var wg sync.WaitGroup
+			for i := 0; i < 1000; i++ {
+				wg.Add(1)
+				go func(device int) {
+					defer wg.Done()
+					id := strconv.Itoa(device)
+					locker.Lock(id)
+					// unprotected read-modify-write, only correct under the lock
+					counter := counters[device]
+					time.Sleep(time.Microsecond)
+					counters[device] = counter + 1
+					if err := locker.Unlock(id); err != nil {
+						t.Error(err)
+					}
+				}(i % len(counters))
+			}
+			wg.Wait()
+			for device, counter := range counters {
+				if counter != 100 {
+					t.Errorf("got counter %d for device %d, expected %d", counter, device, 100)
+				}
+			}
+		})
+	}
+}
+
+func TestUnlockOfUnlockedDeviceShouldFail(t *testing.T) {
+	for name, newLocker := range newLockers() {
+		t.Run(name, func(t *testing.T) {
+			locker := newLocker()
+			if err := locker.Unlock("DEVICE"); !errors.Is(err, ErrNotLocked) {
+				t.Errorf("got error %v, expected %v", err, ErrNotLocked)
+			}
+			locker.Lock("DEVICE")
+			locker.Unlock("DEVICE")
+			if err := locker.Unlock("DEVICE"); !errors.Is(err, ErrNotLocked) {
+				t.Errorf("got error %v, expected %v", err, ErrNotLocked)
+			}
+		})
+	}
+}
+
+func TestLockContextAndTryLock(t *testing.T) {
+	for name, newLocker := range newLockers() {
+		t.Run(name, func(t *testing.T) {
+			locker := newLocker()
+			locker.Lock("DEVICE")
+			if _, ok, _ := locker.TryLock("DEVICE"); ok {
+				t.Error("locked device should not be locked again")
+			}
+			if _, ok, _ := locker.TryLock("OTHER"); !ok {
+				t.Error("other devices should not be blocked")
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			if _, err := locker.LockContext(ctx, "DEVICE"); !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("got error %v, expected %v", err, context.DeadlineExceeded)
+			}
+			// the timed out waiter has left nothing behind
+			locker.Unlock("DEVICE")
+			if _, ok, _ := locker.TryLock("DEVICE"); !ok {
+				t.Error("unlocked device should be lockable")
+			}
+		})
+	}
+}
+
+func TestLockShardsFillACacheLine(t *testing.T) {
+	if size := unsafe.Sizeof(lockShard{}); size != cacheLineSize {
+		t.Errorf("got shard size %d, expected %d", size, cacheLineSize)
+	}
+}
+
+func TestShardedLockerForgetsUnlockedDevices(t *testing.T) {
+	locker := NewShardedDeviceLocker(4)
+	for i := 0; i < 100; i++ {
+		locker.Lock(strconv.Itoa(i))
+		locker.Unlock(strconv.Itoa(i))
+	}
+	for i := range locker.shards {
+		if len(locker.shards[i].locks) != 0 {
+			t.Errorf("shard %d still holds %d locks", i, len(locker.shards[i].locks))
+		}
+	}
+}
+
+// benchmarkLocker locks and unlocks devices from parallel goroutines, each picking
+// the devices round robin. Few devices measure contention on the same device,
+// many devices the overhead the devices impose on each other. Waiters run many
+// goroutines per CPU which yield while holding the lock, so each device has a
+// queue of waiters like a hot device under load.
+func benchmarkLocker(b *testing.B, locker DeviceLocker, devices int, waiters bool) {
+	ids := make([]string, devices)
+	for i := range ids {
+		ids[i] = "device-" + strconv.Itoa(i)
+	}
+	if waiters {
+		b.SetParallelism(64)
+	}
+	var next int64
+	var mutex sync.Mutex
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		mutex.Lock()
+		i := int(next)
+		next++
+		mutex.Unlock()
+		for pb.Next() {
+			id := ids[i%devices]
+			locker.Lock(id)
+			if waiters {
+				runtime.Gosched()
+			}
+			locker.Unlock(id)
+			i++
+		}
+	})
+}
+
+func BenchmarkLockers(b *testing.B) {
+	for _, devices := range []int{1, 16, 1024, 8192} {
+		for _, waiters := range []bool{false, true} {
+			for _, name := range []string{"GlobalMap", "Sharded"} {
+				newLocker := newLockers()[name]
+				b.Run(name+"/devices="+strconv.Itoa(devices)+"/waiters="+strconv.FormatBool(waiters), func(b *testing.B) {
+					benchmarkLocker(b, newLocker(), devices, waiters)
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package lockers
+
+import (
+	"context"
+	"sync"
+	"unsafe"
+)
+
+const DefaultShards = 64
+
+// ShardedDeviceLocker spreads the locked devices over shards, each with its own
+// mutex, so devices of different shards never contend. Waiters queue up per device
+// and an unlock hands the lock directly to the first waiter of the same device,
+// instead of waking every waiter as the broadcast of DeviceLockerWithGlobalMapProtection.
+type ShardedDeviceLocker struct {
+	shards []lockShard
+	// unused device locks are recycled, locking an uncontended device does not allocate
+	pool sync.Pool
+}
+
+// cacheLineSize is the cache line size of common amd64 and arm64 CPUs.
+const cacheLineSize = 64
+
+type lockShard struct {
+	mutex sync.Mutex
+	locks map[string]*deviceLock
+	// pads the shard to a full cache line, so the mutexes of neighbouring shards
+	// never share one
+	_ [cacheLineSize - unsafe.Sizeof(sync.Mutex{}) - unsafe.Sizeof(map[string]*deviceLock(nil))]byte
+}
+
+// deviceLock exists while the device is locked. Closing the channel of a waiter
+// hands the lock over to it.
+type deviceLock struct {
+	waiters []chan struct{}
+}
+
+func NewShardedDeviceLocker(shards int) *ShardedDeviceLocker {
+	if shards <= 0 {
+		shards = DefaultShards
+	}
+	locker := &ShardedDeviceLocker{shards: make([]lockShard, shards)}
+	for i := range locker.shards {
+		locker.shards[i].locks = make(map[string]*deviceLock)
+	}
+	locker.pool.New = func() interface{} { return &deviceLock{} }
+	return locker
+}
+
+// shard returns the shard of the id by its FNV-1a hash.
+func (l *ShardedDeviceLocker) shard(id string) *lockShard {
+	hash := uint32(2166136261)
+	for i := 0; i < len(id); i++ {
+		hash ^= uint32(id[i])
+		hash *= 16777619
+	}
+	return &l.shards[hash%uint32(len(l.shards))]
+}
+
+func (l *ShardedDeviceLocker) Lock(id string) (int64, error) {
+	return l.LockContext(context.Background(), id)
+}
+
+func (l *ShardedDeviceLocker) LockContext(ctx context.Context, id string) (int64, error) {
+	shard := l.shard(id)
+	shard.mutex.Lock()
+	lock, ok := shard.locks[id]
+	if !ok {
+		shard.locks[id] = l.pool.Get().(*deviceLock)
+		shard.mutex.Unlock()
+		return NoFencingToken, nil
+	}
+	if err := ctx.Err(); err != nil {
+		shard.mutex.Unlock()
+		return NoFencingToken, err
+	}
+	handover := make(chan struct{})
+	lock.waiters = append(lock.waiters, handover)
+	shard.mutex.Unlock()
+	select {
+	case <-handover:
+		return NoFencingToken, nil
+	case <-ctx.Done():
+	}
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	for i, waiter := range lock.waiters {
+		if waiter == handover {
+			lock.waiters = append(lock.waiters[:i], lock.waiters[i+1:]...)
+			return NoFencingToken, ctx.Err()
+		}
+	}
+	// the lock was handed over just as the context was done
+	return NoFencingToken, nil
+}
+
+func (l *ShardedDeviceLocker) TryLock(id string) (int64, bool, error) {
+	shard := l.shard(id)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	if _, ok := shard.locks[id]; ok {
+		return NoFencingToken, false, nil
+	}
+	shard.locks[id] = l.pool.Get().(*deviceLock)
+	return NoFencingToken, true, nil
+}
+
+func (l *ShardedDeviceLocker) Unlock(id string) error {
+	shard := l.shard(id)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	lock, ok := shard.locks[id]
+	if !ok {
+		return ErrNotLocked
+	}
+	if len(lock.waiters) > 0 {
+		// first come, first served
+		next := lock.waiters[0]
+		lock.waiters[0] = nil
+		lock.waiters = lock.waiters[1:]
+		close(next)
+		return nil
+	}
+	delete(shard.locks, id)
+	lock.waiters = lock.waiters[:0]
+	l.pool.Put(lock)
+	return nil
+}
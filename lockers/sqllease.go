@@ -0,0 +1,71 @@
+package lockers
+
+import (
+	"database/sql"
+	"errors"
+	"signing-service-challenge/persistence"
+	"time"
+)
+
+// SQLLeaseStore keeps the leases in the device_leases table, so all instances
+// sharing the database lock each other out. Expiry is decided by the clock of
+// the instance, the clocks of the instances must not drift apart by more than a
+// fraction of the TTL.
+type SQLLeaseStore struct {
+	db *persistence.SQLDB
+}
+
+func NewSQLLeaseStore(db *persistence.SQLDB) *SQLLeaseStore {
+	return &SQLLeaseStore{
+		db: db,
+	}
+}
+
+func (s SQLLeaseStore) Acquire(id, owner string, ttl time.Duration) (Lease, bool, error) {
+	now := time.Now()
+	lease := Lease{Id: id, Owner: owner, ExpiresAt: now.Add(ttl)}
+	// the update only applies to an expired lease, otherwise no row is returned
+	err := s.db.DB.QueryRow(s.db.Dialect.Rebind(`INSERT INTO device_leases (device_id, owner, token, expires_at)
+		VALUES (?, ?, 1, ?)
+		ON CONFLICT (device_id) DO UPDATE SET
+			owner = excluded.owner,
+			token = device_leases.token + 1,
+			expires_at = excluded.expires_at
+		WHERE device_leases.expires_at <= ?
+		RETURNING token`),
+		id, owner, lease.ExpiresAt.UnixNano(), now.UnixNano()).Scan(&lease.Token)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Lease{}, false, nil
+	}
+	if err != nil {
+		return Lease{}, false, err
+	}
+	return lease, true, nil
+}
+
+func (s SQLLeaseStore) Renew(lease Lease, ttl time.Duration) (Lease, error) {
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+	result, err := s.db.DB.Exec(s.db.Dialect.Rebind(`UPDATE device_leases SET expires_at = ?
+		WHERE device_id = ? AND owner = ? AND token = ? AND expires_at > ?`),
+		expiresAt.UnixNano(), lease.Id, lease.Owner, lease.Token, now.UnixNano())
+	if err != nil {
+		return lease, err
+	}
+	renewed, err := result.RowsAffected()
+	if err != nil {
+		return lease, err
+	}
+	if renewed == 0 {
+		return lease, ErrLeaseLost
+	}
+	lease.ExpiresAt = expiresAt
+	return lease, nil
+}
+
+func (s SQLLeaseStore) Release(lease Lease) error {
+	_, err := s.db.DB.Exec(s.db.Dialect.Rebind(`UPDATE device_leases SET expires_at = 0
+		WHERE device_id = ? AND owner = ? AND token = ?`),
+		lease.Id, lease.Owner, lease.Token)
+	return err
+}
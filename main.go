@@ -1,35 +1,320 @@
 package main
 
 import (
+	"fmt"
 	"log"
-	"sync"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"signing-service-challenge/api"
+	"signing-service-challenge/crypto"
 	"signing-service-challenge/lockers"
 	"signing-service-challenge/persistence"
 	"signing-service-challenge/repositories"
 	"signing-service-challenge/services"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 )
 
 const (
 	ListenAddress = ":8080"
+	// base64 encoded key-encryption key used to wrap device private keys
+	KeyEncryptionKeyEnv = "SIGNING_SERVICE_KEK"
+	// alternatively a file holding the base64 encoded key-encryption key
+	KeyEncryptionKeyFileEnv = "SIGNING_SERVICE_KEK_FILE"
+	// comma separated base64 encoded key-encryption keys which were replaced by the
+	// current one, they only unwrap the keys of devices not rewrapped yet
+	RetiredKeyEncryptionKeysEnv = "SIGNING_SERVICE_RETIRED_KEKS"
+	// bearer token of the admin routes, they are disabled without one
+	AdminTokenEnv = "SIGNING_SERVICE_ADMIN_TOKEN"
+	// comma separated caller:token pairs of further admin tokens, key exports record the caller
+	AdminTokensEnv = "SIGNING_SERVICE_ADMIN_TOKENS"
+	// storage backend, "memory" (default), "file", "sqlite" or "postgres"
+	StorageEnv = "SIGNING_SERVICE_STORAGE"
+	// directory of the write-ahead log and the snapshots of the file storage
+	DataDirEnv = "SIGNING_SERVICE_DATA_DIR"
+	// number of log records after which the file storage takes a snapshot
+	SnapshotEveryEnv = "SIGNING_SERVICE_SNAPSHOT_EVERY"
+	// data source name of the sqlite and postgres storage
+	DatabaseURLEnv = "SIGNING_SERVICE_DATABASE_URL"
+	// lifetime of the device leases of the sqlite and postgres storage, e.g. "10s"
+	LeaseTTLEnv = "SIGNING_SERVICE_LEASE_TTL"
+	// number of parsed device signers kept in memory, 0 disables the cache
+	SignerCacheSizeEnv = "SIGNING_SERVICE_SIGNER_CACHE_SIZE"
+	// number of pre-generated key pairs per key set, 0 disables the key pool
+	KeyPoolSizeEnv = "SIGNING_SERVICE_KEY_POOL_SIZE"
+	// number of goroutines generating the pooled key pairs
+	KeyPoolWorkersEnv = "SIGNING_SERVICE_KEY_POOL_WORKERS"
+	// number of goroutines signing the asynchronous signing jobs
+	SigningJobWorkersEnv = "SIGNING_SERVICE_JOB_WORKERS"
+	// number of signing jobs queued per device before new ones are rejected
+	SigningJobQueueSizeEnv = "SIGNING_SERVICE_JOB_QUEUE_SIZE"
+	// id of this instance, signing jobs can only be polled on the instance which
+	// accepted them. Defaults to the host name.
+	InstanceIdEnv         = "SIGNING_SERVICE_INSTANCE_ID"
+	DefaultKeyPoolSize    = 4
+	DefaultKeyPoolWorkers = 1
+	DefaultDataDir        = "data"
+	DefaultSnapshotEvery  = 10000
+	DefaultLeaseTTL       = 10 * time.Second
 	// TODO: add further configuration parameters here ...
 )
 
+// loadKeyWrapper builds the key wrapper from the configured key-encryption key.
+// Without configuration an ephemeral key is generated, which is only suitable
+// as long as the device data is not persisted.
+func loadKeyWrapper(persistent bool) (*crypto.KeyWrapper, error) {
+	var kek []byte
+	var err error
+	if encoded := os.Getenv(KeyEncryptionKeyEnv); encoded != "" {
+		kek, err = crypto.DecodeKeyEncryptionKey(encoded)
+	} else if path := os.Getenv(KeyEncryptionKeyFileEnv); path != "" {
+		kek, err = crypto.LoadKeyEncryptionKeyFile(path)
+	} else if persistent {
+		return nil, fmt.Errorf("%s or %s is required for persisted data", KeyEncryptionKeyEnv, KeyEncryptionKeyFileEnv)
+	} else {
+		log.Printf("no key-encryption key configured, generating an ephemeral one")
+		kek, err = crypto.GenerateKeyEncryptionKey()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return crypto.NewKeyWrapper(kek)
+}
+
+// loadRetiredKeyWrappers builds the key wrappers of the retired key-encryption keys.
+// Rotating the key-encryption key takes three steps: configure the new key on every
+// instance with the old one retired, rewrap the keys through the admin API, then
+// drop the retired key from the configuration.
+func loadRetiredKeyWrappers() ([]*crypto.KeyWrapper, error) {
+	wrappers := []*crypto.KeyWrapper{}
+	for _, encoded := range strings.Split(os.Getenv(RetiredKeyEncryptionKeysEnv), ",") {
+		if strings.TrimSpace(encoded) == "" {
+			continue
+		}
+		kek, err := crypto.DecodeKeyEncryptionKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", RetiredKeyEncryptionKeysEnv, err)
+		}
+		wrapper, err := crypto.NewKeyWrapper(kek)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", RetiredKeyEncryptionKeysEnv, err)
+		}
+		wrappers = append(wrappers, wrapper)
+	}
+	return wrappers, nil
+}
+
+// addAdminTokens adds the admin tokens of named callers to the server.
+func addAdminTokens(server *api.Server) error {
+	for _, pair := range strings.Split(os.Getenv(AdminTokensEnv), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		caller, token, found := strings.Cut(strings.TrimSpace(pair), ":")
+		if !found || caller == "" || token == "" {
+			return fmt.Errorf("%s must hold caller:token pairs", AdminTokensEnv)
+		}
+		server.AddAdminToken(caller, token)
+	}
+	return nil
+}
+
+// newLocker locks the devices across instances if the storage is shared,
+// otherwise within this process.
+func newLocker(storage *storage) (lockers.DeviceLocker, error) {
+	if storage.leases == nil {
+		return lockers.NewShardedDeviceLocker(lockers.DefaultShards), nil
+	}
+	ttl := DefaultLeaseTTL
+	if value := os.Getenv(LeaseTTLEnv); value != "" {
+		var err error
+		ttl, err = time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("%s must be a positive duration", LeaseTTLEnv)
+		}
+	}
+	return lockers.NewLeaseLocker(storage.leases, ttl), nil
+}
+
+// newKeyPool starts the configured key pool, warmed up with the default parameters
+// of every algorithm. It returns nil if the pool is disabled.
+func newKeyPool() (*services.KeyPool, error) {
+	size, workers := DefaultKeyPoolSize, DefaultKeyPoolWorkers
+	var err error
+	if value := os.Getenv(KeyPoolSizeEnv); value != "" {
+		if size, err = strconv.Atoi(value); err != nil || size < 0 {
+			return nil, fmt.Errorf("%s must be a non-negative number", KeyPoolSizeEnv)
+		}
+	}
+	if value := os.Getenv(KeyPoolWorkersEnv); value != "" {
+		if workers, err = strconv.Atoi(value); err != nil || workers < 1 {
+			return nil, fmt.Errorf("%s must be a positive number", KeyPoolWorkersEnv)
+		}
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	pool := services.NewKeyPool(size, workers)
+	for _, algorithm := range []string{crypto.RSA, crypto.ECC, crypto.ED25519} {
+		options, err := crypto.NormalizeOptions(algorithm, crypto.Options{})
+		if err != nil {
+			return nil, err
+		}
+		pool.Warm(algorithm, options)
+	}
+	return pool, nil
+}
+
+// newSigningJobs starts the workers of the asynchronous signing jobs.
+func newSigningJobs(service *services.SignatureDeviceService) (*services.SigningJobs, error) {
+	options := services.DefaultSigningJobsOptions
+	options.InstanceId = os.Getenv(InstanceIdEnv)
+	if options.InstanceId == "" {
+		// falls back to a random id without a host name
+		options.InstanceId, _ = os.Hostname()
+	}
+	var err error
+	if value := os.Getenv(SigningJobWorkersEnv); value != "" {
+		if options.Workers, err = strconv.Atoi(value); err != nil || options.Workers < 1 {
+			return nil, fmt.Errorf("%s must be a positive number", SigningJobWorkersEnv)
+		}
+	}
+	if value := os.Getenv(SigningJobQueueSizeEnv); value != "" {
+		if options.DeviceQueueSize, err = strconv.Atoi(value); err != nil || options.DeviceQueueSize < 1 {
+			return nil, fmt.Errorf("%s must be a positive number", SigningJobQueueSizeEnv)
+		}
+	}
+	return services.NewSigningJobs(service, options), nil
+}
+
+// storage holds the repositories of the configured backend.
+type storage struct {
+	devices    repositories.SignatureDeviceRepository
+	signatures repositories.SignatureRepository
+	exports    repositories.KeyExportRepository
+	unitOfWork repositories.UnitOfWorkFactory
+	persistent bool
+	// leases of a storage shared by several instances, nil otherwise
+	leases lockers.LeaseStore
+}
+
+func inMemoryStorage(db *persistence.InMemoryDB) *storage {
+	return &storage{
+		devices:    repositories.NewSignatureDeviceInMemoryRepository(db),
+		signatures: repositories.NewSignatureInMemoryRepository(db),
+		exports:    repositories.NewKeyExportInMemoryRepository(db),
+		unitOfWork: repositories.NewInMemoryUnitOfWorkFactory(db),
+		persistent: db.Journal != nil,
+	}
+}
+
+// openStorage opens the configured storage backend.
+func openStorage() (*storage, error) {
+	switch backend := os.Getenv(StorageEnv); backend {
+	case "", "memory":
+		return inMemoryStorage(persistence.NewInMemoryDB()), nil
+	case "file":
+		dir := os.Getenv(DataDirEnv)
+		if dir == "" {
+			dir = DefaultDataDir
+		}
+		options := persistence.FileStoreOptions{SnapshotEvery: DefaultSnapshotEvery}
+		if value := os.Getenv(SnapshotEveryEnv); value != "" {
+			snapshotEvery, err := strconv.Atoi(value)
+			if err != nil || snapshotEvery < 0 {
+				return nil, fmt.Errorf("%s must be a non-negative number", SnapshotEveryEnv)
+			}
+			options.SnapshotEvery = snapshotEvery
+		}
+		db, store, err := repositories.OpenFileDB(dir, options)
+		if err != nil {
+			return nil, err
+		}
+		recovery := store.Recovery
+		log.Printf("restored %d snapshot entries and %d log records from %s",
+			recovery.SnapshotMutations, recovery.LogRecords, dir)
+		if recovery.TailError != nil {
+			log.Printf("write-ahead log: %v, dropped %d bytes", recovery.TailError, recovery.TruncatedBytes)
+		}
+		return inMemoryStorage(db), nil
+	case "sqlite", "postgres":
+		driver := persistence.SQLite.Name
+		if backend == "postgres" {
+			driver = persistence.PostgreSQL.Name
+		}
+		dataSource := os.Getenv(DatabaseURLEnv)
+		if dataSource == "" {
+			return nil, fmt.Errorf("%s is required for the %s storage", DatabaseURLEnv, backend)
+		}
+		db, err := persistence.OpenSQLDB(driver, dataSource)
+		if err != nil {
+			return nil, err
+		}
+		return &storage{
+			devices:    repositories.NewSignatureDeviceSQLRepository(db),
+			signatures: repositories.NewSignatureSQLRepository(db),
+			exports:    repositories.NewKeyExportSQLRepository(db),
+			unitOfWork: repositories.NewSQLUnitOfWorkFactory(db),
+			persistent: true,
+			leases:     lockers.NewSQLLeaseStore(db),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown storage %q", backend)
+	}
+}
+
 func main() {
-	var db = persistence.NewInMemoryDB()
+	storage, err := openStorage()
+	if err != nil {
+		log.Fatal("Could not open storage: ", err)
+	}
 
-	// repositories
-	deviceRepo := repositories.NewSignatureDeviceInMemoryRepository(db)
-	signatureRepo := repositories.NewSignatureInMemoryRepository(db)
+	keyWrapper, err := loadKeyWrapper(storage.persistent)
+	if err != nil {
+		log.Fatal("Could not load key-encryption key: ", err)
+	}
+	retiredKeyWrappers, err := loadRetiredKeyWrappers()
+	if err != nil {
+		log.Fatal("Could not load retired key-encryption keys: ", err)
+	}
 
 	// services
-	var mutex sync.Mutex
-	locker := lockers.NewDeviceLockerWithGlobalMapProtection(&mutex)
-	deviceSvc := services.NewSignatureDeviceService(deviceRepo, locker)
-	signatureSvc := services.NewSignatureService(signatureRepo)
+	locker, err := newLocker(storage)
+	if err != nil {
+		log.Fatal("Could not create device locker: ", err)
+	}
+	deviceSvc := services.NewSignatureDeviceService(storage.devices, storage.exports, storage.unitOfWork, locker, keyWrapper)
+	deviceSvc.AddRetiredKeyEncryptionKeys(retiredKeyWrappers...)
+	if value := os.Getenv(SignerCacheSizeEnv); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 {
+			log.Fatalf("%s must be a non-negative number", SignerCacheSizeEnv)
+		}
+		deviceSvc.SetSignerCache(services.NewSignerCache(size))
+	}
+	keyPool, err := newKeyPool()
+	if err != nil {
+		log.Fatal("Could not start key pool: ", err)
+	}
+	if keyPool != nil {
+		deviceSvc.SetKeyPool(keyPool)
+	}
+	signatureSvc := services.NewSignatureService(storage.signatures, storage.devices)
 
-	server := api.NewServer(ListenAddress, *deviceSvc, *signatureSvc)
+	signingJobs, err := newSigningJobs(deviceSvc)
+	if err != nil {
+		log.Fatal("Could not start signing jobs: ", err)
+	}
+
+	server := api.NewServer(ListenAddress, *deviceSvc, *signatureSvc, signingJobs)
+	server.SetAdminToken(os.Getenv(AdminTokenEnv))
+	if err := addAdminTokens(server); err != nil {
+		log.Fatal("Could not configure the admin tokens: ", err)
+	}
 
 	if err := server.Run(); err != nil {
 		log.Fatal("Could not start server on ", ListenAddress)
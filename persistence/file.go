@@ -0,0 +1,466 @@
+package persistence
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"signing-service-challenge/domain"
+	"sync"
+)
+
+// File based persistence. The state is kept in an InMemoryDB, every mutation
+// is appended to a write-ahead log and synced to disk before it is applied.
+// Snapshots of the whole state are taken periodically, after which the log is
+// truncated. On startup the latest snapshot and the log are replayed.
+//
+// Snapshots and the log share the record format:
+//
+//	| length uint32 | crc32c(payload) uint32 | payload (JSON encoded []Mutation) |
+//
+// One record holds all mutations which have to be applied together, e.g. the
+// writes of a unit of work.
+
+var (
+	ErrCorruptLog      = errors.New("write-ahead log record is corrupt")
+	ErrTruncatedLog    = errors.New("write-ahead log ends with a truncated record")
+	ErrCorruptSnapshot = errors.New("snapshot is corrupt")
+	ErrFileStoreClosed = errors.New("file store is closed")
+	ErrRecordTooLarge  = errors.New("write-ahead log record is too large")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// MaxRecordLength is the largest payload of a record. Larger records are refused
+// with ErrRecordTooLarge before anything is written, on replay they are corrupt.
+const MaxRecordLength = 64 << 20
+
+const (
+	recordHeaderLength  = 8
+	logFileName         = "wal.log"
+	snapshotFileName    = "snapshot.db"
+	snapshotTmpFileName = "snapshot.db.tmp"
+)
+
+// mutation kinds
+const (
+	SaveDevice          = "save_device"
+	DeleteDevice        = "delete_device"
+	DeleteAllDevices    = "delete_all_devices"
+	SaveSignature       = "save_signature"
+	DeleteSignature     = "delete_signature"
+	DeleteAllSignatures = "delete_all_signatures"
+	SaveKeyExport       = "save_key_export"
+)
+
+// Mutation is a single write to the database. Only the field matching the kind is set.
+type Mutation struct {
+	Kind      string
+	Id        string                  `json:",omitempty"`
+	Device    *domain.SignatureDevice `json:",omitempty"`
+	Signature *domain.Signature       `json:",omitempty"`
+	KeyExport *domain.KeyExport       `json:",omitempty"`
+}
+
+// Journal records mutations before they are applied to the database.
+// Callers hold the locks of the tables they mutate.
+type Journal interface {
+	Append(mutations ...Mutation) error
+}
+
+// Compactor is implemented by journals which keep superseded mutations, e.g. the
+// write-ahead log until the next snapshot. Compact drops all of them.
+type Compactor interface {
+	Compact() error
+}
+
+// Recovery describes what was found while replaying the write-ahead log.
+type Recovery struct {
+	SnapshotMutations int
+	LogRecords        int
+	// TailError is ErrTruncatedLog or ErrCorruptLog if the last record of the log
+	// was torn or damaged. The damaged tail is cut off. A damaged record followed by
+	// others is never cut off, opening the store fails with ErrCorruptLog instead.
+	TailError      error
+	TruncatedBytes int64
+}
+
+type FileStoreOptions struct {
+	// SnapshotEvery is the number of log records after which a snapshot is
+	// taken in the background, zero disables automatic snapshots.
+	SnapshotEvery int
+}
+
+// FileStore is the Journal of a file backed InMemoryDB.
+type FileStore struct {
+	dir      string
+	db       *InMemoryDB
+	options  FileStoreOptions
+	mutex    sync.Mutex
+	log      *os.File
+	size     int64
+	records  int
+	failed   error
+	closed   bool
+	snapshot chan struct{}
+	done     chan struct{}
+	Recovery Recovery
+	// callers of Compact waiting for the next snapshot of the background loop
+	compactions sync.Mutex
+	waiters     []chan error
+}
+
+// OpenFileStore replays the snapshot and the write-ahead log found in dir.
+// Every replayed mutation is passed to apply, which has to apply it to db.
+// Afterwards the store is set as the journal of db.
+func OpenFileStore(dir string, db *InMemoryDB, apply func(Mutation), options FileStoreOptions) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	store := &FileStore{
+		dir:      dir,
+		db:       db,
+		options:  options,
+		snapshot: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	if err := store.replaySnapshot(apply); err != nil {
+		return nil, err
+	}
+	if err := store.replayLog(apply); err != nil {
+		return nil, err
+	}
+	db.Journal = store
+	go store.snapshotLoop()
+	return store, nil
+}
+
+func (s *FileStore) replaySnapshot(apply func(Mutation)) error {
+	file, err := os.Open(filepath.Join(s.dir, snapshotFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	for {
+		mutations, _, err := readRecord(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			// snapshots are renamed into place once complete, they are never torn
+			return fmt.Errorf("%w: %v", ErrCorruptSnapshot, err)
+		}
+		for _, mutation := range mutations {
+			apply(mutation)
+		}
+		s.Recovery.SnapshotMutations += len(mutations)
+	}
+}
+
+func (s *FileStore) replayLog(apply func(Mutation)) error {
+	file, err := os.OpenFile(filepath.Join(s.dir, logFileName), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		mutations, length, err := readRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// only the last record can have been torn by a crash, it was never
+			// acknowledged as the write failed before or during the sync. Records
+			// behind a damaged one were acknowledged and must not be dropped.
+			if err == ErrCorruptLog && offset+int64(length) < info.Size() {
+				file.Close()
+				return fmt.Errorf("%w at offset %d, %d bytes follow", err, offset, info.Size()-offset-int64(length))
+			}
+			s.Recovery.TailError = err
+			break
+		}
+		for _, mutation := range mutations {
+			apply(mutation)
+		}
+		s.Recovery.LogRecords++
+		offset += int64(length)
+	}
+	if info.Size() > offset {
+		s.Recovery.TruncatedBytes = info.Size() - offset
+		if err := file.Truncate(offset); err != nil {
+			file.Close()
+			return err
+		}
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+	s.log = file
+	s.size = offset
+	s.records = s.Recovery.LogRecords
+	return nil
+}
+
+// readRecord reads the next record and returns its mutations and its length on disk.
+// The length is also returned with ErrCorruptLog, as far as the header tells it.
+// io.EOF is only returned if there are no bytes left at all.
+func readRecord(reader io.Reader) ([]Mutation, int, error) {
+	header := make([]byte, recordHeaderLength)
+	_, err := io.ReadFull(reader, header)
+	if err == io.EOF {
+		return nil, 0, io.EOF
+	}
+	if err != nil {
+		return nil, 0, ErrTruncatedLog
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	if length > MaxRecordLength {
+		return nil, recordHeaderLength + int(length), ErrCorruptLog
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, 0, ErrTruncatedLog
+	}
+	if crc32.Checksum(payload, crcTable) != checksum {
+		return nil, recordHeaderLength + int(length), ErrCorruptLog
+	}
+	var mutations []Mutation
+	if err := json.Unmarshal(payload, &mutations); err != nil {
+		return nil, recordHeaderLength + int(length), ErrCorruptLog
+	}
+	return mutations, recordHeaderLength + int(length), nil
+}
+
+func encodeRecord(mutations []Mutation) ([]byte, error) {
+	payload, err := json.Marshal(mutations)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) > MaxRecordLength {
+		return nil, fmt.Errorf("%w: %d bytes, at most %d", ErrRecordTooLarge, len(payload), MaxRecordLength)
+	}
+	record := make([]byte, recordHeaderLength, recordHeaderLength+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+	return append(record, payload...), nil
+}
+
+// Append writes the mutations as one record and syncs the log to disk.
+func (s *FileStore) Append(mutations ...Mutation) error {
+	record, err := encodeRecord(mutations)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return ErrFileStoreClosed
+	}
+	if s.failed != nil {
+		return s.failed
+	}
+	_, err = s.log.Write(record)
+	if err == nil {
+		err = s.log.Sync()
+	}
+	if err != nil {
+		// cut off the partial record, later records would be lost behind it on replay
+		if truncateErr := s.truncate(s.size); truncateErr != nil {
+			s.failed = fmt.Errorf("write-ahead log unusable: %w", truncateErr)
+		}
+		return err
+	}
+	s.size += int64(len(record))
+	s.records++
+	if s.options.SnapshotEvery > 0 && s.records >= s.options.SnapshotEvery {
+		select {
+		case s.snapshot <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (s *FileStore) snapshotLoop() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.snapshot:
+			// the snapshot starts after the waiters have called Compact
+			s.compactions.Lock()
+			waiters := s.waiters
+			s.waiters = nil
+			s.compactions.Unlock()
+			// a failed snapshot is retried after the next records, the log still holds everything
+			err := s.Snapshot()
+			for _, waiter := range waiters {
+				waiter <- err
+			}
+		}
+	}
+}
+
+// Snapshot writes the whole state to a new snapshot and truncates the log.
+// Writers are blocked while the snapshot is written.
+func (s *FileStore) Snapshot() error {
+	// the table locks are taken before the store mutex, like the writers do,
+	// so the log holds exactly the mutations contained in the snapshot
+	s.db.DevicesLock.RLock()
+	defer s.db.DevicesLock.RUnlock()
+	s.db.SignaturesLock.RLock()
+	defer s.db.SignaturesLock.RUnlock()
+	s.db.KeyExportsLock.RLock()
+	defer s.db.KeyExportsLock.RUnlock()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return ErrFileStoreClosed
+	}
+	if err := s.writeSnapshot(); err != nil {
+		return err
+	}
+	// a crash before the truncation replays the log on top of the snapshot,
+	// which ends in the same state as the log only holds older mutations
+	if err := s.truncate(0); err != nil {
+		return err
+	}
+	s.records = 0
+	return nil
+}
+
+// Compact waits for a snapshot, after which the log no longer holds the replaced versions
+// of the stored entries, e.g. the wrapped private key of a decommissioned device. The
+// snapshot is taken by the background loop and starts after the call, concurrent calls
+// share it instead of each rewriting the whole state while the writers are blocked.
+func (s *FileStore) Compact() error {
+	waiter := make(chan error, 1)
+	s.compactions.Lock()
+	s.waiters = append(s.waiters, waiter)
+	s.compactions.Unlock()
+	select {
+	case s.snapshot <- struct{}{}:
+	default:
+		// a snapshot is due already, the loop takes the waiter along when it starts it
+	}
+	select {
+	case err := <-waiter:
+		return err
+	case <-s.done:
+		return ErrFileStoreClosed
+	}
+}
+
+func (s *FileStore) truncate(size int64) error {
+	if err := s.log.Truncate(size); err != nil {
+		return err
+	}
+	if _, err := s.log.Seek(size, io.SeekStart); err != nil {
+		return err
+	}
+	if err := s.log.Sync(); err != nil {
+		return err
+	}
+	s.size = size
+	return nil
+}
+
+func (s *FileStore) writeSnapshot() error {
+	path := filepath.Join(s.dir, snapshotTmpFileName)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	write := func(mutation Mutation) error {
+		record, err := encodeRecord([]Mutation{mutation})
+		if err != nil {
+			return err
+		}
+		_, err = writer.Write(record)
+		return err
+	}
+	err = s.forEachMutation(write)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	if err := os.Rename(path, filepath.Join(s.dir, snapshotFileName)); err != nil {
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+// forEachMutation emits the mutations which rebuild the current state.
+func (s *FileStore) forEachMutation(write func(Mutation) error) error {
+	for _, device := range s.db.Devices {
+		device := device
+		if err := write(Mutation{Kind: SaveDevice, Device: &device}); err != nil {
+			return err
+		}
+	}
+	for _, signature := range s.db.Signatures {
+		signature := signature
+		if err := write(Mutation{Kind: SaveSignature, Signature: &signature}); err != nil {
+			return err
+		}
+	}
+	for _, export := range s.db.KeyExports {
+		export := export
+		if err := write(Mutation{Kind: SaveKeyExport, KeyExport: &export}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// Close stops the background snapshots and closes the log.
+func (s *FileStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	return s.log.Close()
+}
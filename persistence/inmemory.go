@@ -2,6 +2,7 @@ package persistence
 
 import (
 	"signing-service-challenge/domain"
+	"sort"
 	"sync"
 )
 
@@ -14,17 +15,74 @@ import (
 // For the sake of simplicity locking logic is done in repositories.
 
 type InMemoryDB struct {
-	Devices        map[string]domain.SignatureDevice
-	Signatures     map[string]domain.Signature
-	DevicesLock    *sync.RWMutex
-	SignaturesLock *sync.RWMutex
+	Devices map[string]domain.SignatureDevice
+	// device ids in listing order
+	DevicesSorted *DeviceIndex
+	Signatures    map[string]domain.Signature
+	// secondary index of the signatures by device id
+	SignaturesByDevice map[string]*SignatureIndex
+	KeyExports         map[string]domain.KeyExport
+	DevicesLock        *sync.RWMutex
+	SignaturesLock     *sync.RWMutex
+	KeyExportsLock     *sync.RWMutex
+	// Journal records every mutation before it is applied, nil if the
+	// data is kept in memory only
+	Journal Journal
 }
 
 func NewInMemoryDB() *InMemoryDB {
 	return &InMemoryDB{
-		Devices:        make(map[string]domain.SignatureDevice),
-		Signatures:     make(map[string]domain.Signature),
-		DevicesLock:    &sync.RWMutex{},
-		SignaturesLock: &sync.RWMutex{},
+		Devices:            make(map[string]domain.SignatureDevice),
+		DevicesSorted:      &DeviceIndex{},
+		Signatures:         make(map[string]domain.Signature),
+		SignaturesByDevice: make(map[string]*SignatureIndex),
+		KeyExports:         make(map[string]domain.KeyExport),
+		DevicesLock:        &sync.RWMutex{},
+		SignaturesLock:     &sync.RWMutex{},
+		KeyExportsLock:     &sync.RWMutex{},
 	}
 }
+
+// SignatureIndex holds the signatures of one device by their counter.
+// Counters are kept sorted, so the signatures can be paged in chain order
+// without looking at the signatures of other devices.
+type SignatureIndex struct {
+	Ids      map[int]string
+	Counters []int
+}
+
+func NewSignatureIndex() *SignatureIndex {
+	return &SignatureIndex{
+		Ids:      make(map[int]string),
+		Counters: []int{},
+	}
+}
+
+// Add indexes the signature id under the counter.
+func (i *SignatureIndex) Add(counter int, id string) {
+	if _, ok := i.Ids[counter]; !ok {
+		// counters usually arrive in order, so this is an append
+		position := sort.SearchInts(i.Counters, counter)
+		i.Counters = append(i.Counters, 0)
+		copy(i.Counters[position+1:], i.Counters[position:])
+		i.Counters[position] = counter
+	}
+	i.Ids[counter] = id
+}
+
+// Remove drops the counter from the index.
+func (i *SignatureIndex) Remove(counter int) {
+	if _, ok := i.Ids[counter]; !ok {
+		return
+	}
+	delete(i.Ids, counter)
+	position := sort.SearchInts(i.Counters, counter)
+	i.Counters = append(i.Counters[:position], i.Counters[position+1:]...)
+}
+
+// DeviceIndex holds the device ids sorted by creation time and by label,
+// ties are broken by the device id. The repositories keep it up to date.
+type DeviceIndex struct {
+	ByCreatedAt []string
+	ByLabel     []string
+}
@@ -0,0 +1,224 @@
+package persistence
+
+import (
+	"fmt"
+	"time"
+)
+
+// Migration is a versioned change of the SQL schema. Applied migrations must
+// never be edited, changes are added as a new migration with the next version.
+type Migration struct {
+	Version     int
+	Description string
+	// Statements returns the DDL statements for the dialect.
+	Statements func(Dialect) []string
+}
+
+var Migrations = []Migration{
+	{
+		Version:     1,
+		Description: "create devices, signatures and key exports",
+		Statements: func(d Dialect) []string {
+			return []string{
+				`CREATE TABLE devices (
+					id TEXT PRIMARY KEY,
+					algorithm TEXT NOT NULL,
+					private_key TEXT NOT NULL,
+					key_encryption_key_id TEXT NOT NULL,
+					public_key TEXT NOT NULL,
+					label TEXT NOT NULL,
+					signature_counter BIGINT NOT NULL,
+					last_signature TEXT NOT NULL,
+					exportable BOOLEAN NOT NULL,
+					key_size INTEGER NOT NULL,
+					padding TEXT NOT NULL,
+					curve TEXT NOT NULL,
+					hash TEXT NOT NULL,
+					key_version INTEGER NOT NULL,
+					key_history TEXT NOT NULL,
+					created_at BIGINT NOT NULL
+				)`,
+				`CREATE INDEX devices_created_at ON devices (created_at, id)`,
+				`CREATE INDEX devices_label ON devices (` + d.Binary("label") + `, id)`,
+				`CREATE TABLE signatures (
+					id TEXT PRIMARY KEY,
+					device_id TEXT NOT NULL,
+					counter BIGINT NOT NULL,
+					signature TEXT NOT NULL,
+					data TEXT NOT NULL,
+					previous_signature TEXT NOT NULL,
+					algorithm TEXT NOT NULL,
+					created_at BIGINT NOT NULL
+				)`,
+				// secondary index of the signatures by device, one signature per counter
+				`CREATE UNIQUE INDEX signatures_device_counter ON signatures (device_id, counter)`,
+				`CREATE TABLE key_exports (
+					id TEXT PRIMARY KEY,
+					device_id TEXT NOT NULL,
+					scheme TEXT NOT NULL,
+					recipient_fingerprint TEXT NOT NULL,
+					exported_at BIGINT NOT NULL
+				)`,
+				`CREATE INDEX key_exports_device ON key_exports (device_id, exported_at)`,
+			}
+		},
+	},
+	{
+		Version:     2,
+		Description: "add optimistic concurrency version to devices",
+		Statements: func(d Dialect) []string {
+			return []string{
+				`ALTER TABLE devices ADD COLUMN version BIGINT NOT NULL DEFAULT 1`,
+			}
+		},
+	},
+	{
+		Version:     3,
+		Description: "add device leases and fencing tokens",
+		Statements: func(d Dialect) []string {
+			return []string{
+				`ALTER TABLE devices ADD COLUMN fencing_token BIGINT NOT NULL DEFAULT 0`,
+				// a released lease keeps its row, so the next token continues the sequence
+				`CREATE TABLE device_leases (
+					device_id TEXT PRIMARY KEY,
+					owner TEXT NOT NULL,
+					token BIGINT NOT NULL,
+					expires_at BIGINT NOT NULL
+				)`,
+			}
+		},
+	},
+	{
+		Version:     4,
+		Description: "add device lifecycle states",
+		Statements: func(d Dialect) []string {
+			return []string{
+				// existing devices were able to sign, so they are active
+				`ALTER TABLE devices ADD COLUMN state TEXT NOT NULL DEFAULT 'ACTIVE'`,
+				`ALTER TABLE devices ADD COLUMN state_history TEXT NOT NULL DEFAULT '[]'`,
+			}
+		},
+	},
+	{
+		Version:     5,
+		Description: "add device tags",
+		Statements: func(d Dialect) []string {
+			return []string{
+				`ALTER TABLE devices ADD COLUMN tags TEXT NOT NULL DEFAULT '{}'`,
+			}
+		},
+	},
+	{
+		Version:     6,
+		Description: "record the caller of key exports",
+		Statements: func(d Dialect) []string {
+			return []string{
+				// the caller of earlier exports is unknown
+				`ALTER TABLE key_exports ADD COLUMN exported_by TEXT NOT NULL DEFAULT ''`,
+			}
+		},
+	},
+}
+
+// Migrate applies the migrations which are missing in the database, each in its
+// own transaction. It returns the number of applied migrations. Instances starting
+// at the same time may migrate concurrently, a migration applied by another
+// instance meanwhile is skipped.
+func Migrate(db *SQLDB) (int, error) {
+	if err := createMigrationsTable(db); err != nil {
+		return 0, err
+	}
+	versions, err := appliedVersions(db)
+	if err != nil {
+		return 0, err
+	}
+	applied := 0
+	for _, migration := range Migrations {
+		if versions[migration.Version] {
+			continue
+		}
+		ok, err := applyMigration(db, migration)
+		if err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %w", migration.Version, migration.Description, err)
+		}
+		if !ok {
+			// another instance is migrating, it may have applied the next ones as well
+			if versions, err = appliedVersions(db); err != nil {
+				return applied, err
+			}
+			continue
+		}
+		applied++
+	}
+	return applied, nil
+}
+
+func createMigrationsTable(db *SQLDB) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// creating a table concurrently can fail even if it does not exist yet
+	if err := db.Dialect.LockMigrations(tx); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at BIGINT NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func appliedVersions(db *SQLDB) (map[int]bool, error) {
+	rows, err := db.DB.Query(`SELECT version FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	versions := map[int]bool{}
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		versions[version] = true
+	}
+	return versions, rows.Err()
+}
+
+// applyMigration applies the migration and records its version. It returns false
+// if another instance has recorded the version first.
+func applyMigration(db *SQLDB, migration Migration) (bool, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	if err := db.Dialect.LockMigrations(tx); err != nil {
+		return false, err
+	}
+	// recording the version first makes a concurrent migration of another
+	// instance fail on the primary key instead of applying the statements twice
+	_, err = tx.Exec(db.Dialect.Rebind(`INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, ?, ?)`),
+		migration.Version, migration.Description, time.Now().UnixNano())
+	if db.Dialect.IsUniqueViolation(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, statement := range migration.Statements(db.Dialect) {
+		if _, err := tx.Exec(statement); err != nil {
+			return false, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,153 @@
+package persistence
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Dialect covers the differences between the supported SQL databases.
+type Dialect struct {
+	Name string
+	// numbered placeholders ($1, $2, ...) instead of question marks
+	numberedPlaceholders bool
+	// collation comparing strings byte by byte, like Go does
+	binaryCollation string
+	// expression of a string value in a JSON object column, the key is a parameter
+	jsonField string
+	// statement taking a lock until the end of the transaction which serializes the
+	// migrations of all instances, empty if the database has none
+	migrationLock string
+}
+
+// migrationLockKey is the advisory lock of schema migrations on PostgreSQL.
+const migrationLockKey = 0x5349474e // "SIGN"
+
+var (
+	SQLite     = Dialect{Name: "sqlite3", jsonField: `json_extract(%s, '$."' || ? || '"')`}
+	PostgreSQL = Dialect{Name: "postgres", numberedPlaceholders: true, binaryCollation: ` COLLATE "C"`, jsonField: `(%s::jsonb ->> ?)`,
+		migrationLock: fmt.Sprintf(`SELECT pg_advisory_xact_lock(%d)`, migrationLockKey)}
+)
+
+// DialectForDriver returns the dialect of a database/sql driver name.
+func DialectForDriver(driver string) (Dialect, error) {
+	switch driver {
+	case SQLite.Name:
+		return SQLite, nil
+	case PostgreSQL.Name:
+		return PostgreSQL, nil
+	}
+	return Dialect{}, fmt.Errorf("unsupported SQL driver %q", driver)
+}
+
+// Rebind replaces the question mark placeholders of a query with the ones of the dialect.
+// Queries must not contain question marks in string literals.
+func (d Dialect) Rebind(query string) string {
+	if !d.numberedPlaceholders {
+		return query
+	}
+	var builder strings.Builder
+	parameter := 0
+	for _, char := range query {
+		if char == '?' {
+			parameter++
+			builder.WriteString("$" + strconv.Itoa(parameter))
+			continue
+		}
+		builder.WriteRune(char)
+	}
+	return builder.String()
+}
+
+// Binary orders the column byte by byte, so results match the in-memory order.
+func (d Dialect) Binary(column string) string {
+	return column + d.binaryCollation
+}
+
+// JSONField returns the string value of a key of the JSON object stored in the column.
+// The key is bound to the placeholder of the expression, it must not contain double quotes.
+func (d Dialect) JSONField(column string) string {
+	return fmt.Sprintf(d.jsonField, column)
+}
+
+// LockMigrations serializes the migrations of concurrently starting instances until the
+// transaction ends. Databases without such a lock rely on the primary key of the
+// applied versions instead.
+func (d Dialect) LockMigrations(tx Querier) error {
+	if d.migrationLock == "" {
+		return nil
+	}
+	_, err := tx.Exec(d.migrationLock)
+	return err
+}
+
+// IsUniqueViolation tells whether the error is the violation of a primary key or a unique index.
+func (d Dialect) IsUniqueViolation(err error) bool {
+	if err == nil {
+		return false
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505"
+	}
+	// the error type of the SQLite driver only exists in cgo builds, its message is
+	// the same for unique indexes and primary keys
+	return d.Name == SQLite.Name && strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
+// SQLDB is a database/sql connection pool together with its dialect.
+type SQLDB struct {
+	DB      *sql.DB
+	Dialect Dialect
+}
+
+// OpenSQLDB connects to the database and migrates its schema to the latest version.
+func OpenSQLDB(driver, dataSource string) (*SQLDB, error) {
+	dialect, err := DialectForDriver(driver)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(driver, dataSource)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	sqlDB := &SQLDB{DB: db, Dialect: dialect}
+	if _, err := Migrate(sqlDB); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return sqlDB, nil
+}
+
+// Querier is implemented by *sql.DB and *sql.Tx.
+type Querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Timestamps are stored as nanoseconds since the epoch, which sort and compare
+// the same on every database. The zero time is stored as 0.
+
+func TimeToNanos(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func NanosToTime(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos).UTC()
+}
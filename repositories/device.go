@@ -3,18 +3,81 @@ package repositories
 import (
 	"signing-service-challenge/domain"
 	"signing-service-challenge/persistence"
+	"sort"
+	"strings"
+	"time"
 )
 
 type SignatureDeviceRepository interface {
+	// Save stores the device if the stored version still equals device.Version,
+	// otherwise it fails with domain.ErrConcurrentModification. New devices have version 0.
+	// A device with a lower fencing token than the stored one fails with domain.ErrStaleFencingToken.
 	Save(domain.SignatureDevice) error
 	GetById(string) (*domain.SignatureDevice, error)
 	GetAll() ([]domain.SignatureDevice, error)
+	List(DeviceQuery) (DevicePage, error)
 	// not in the requirements, but for testing purposes
 	DeleteById(string) error
 	DeleteAll() error
 	Count() int
 }
 
+// device listing orders
+const (
+	SortByCreatedAt = "created_at"
+	SortByLabel     = "label"
+)
+
+// DeviceQuery selects a page of devices. Empty filters match every device.
+type DeviceQuery struct {
+	Algorithm   string
+	LabelPrefix string
+	// Tags match devices carrying all of the tags with the given values
+	Tags       map[string]string
+	SortBy     string
+	Descending bool
+	// After is the cursor, the sort key of the last device of the previous page
+	After *DeviceCursor
+	Limit int
+}
+
+// DeviceCursor is the position of a device in the listing order.
+// Only the field of the sort order and the id are compared.
+type DeviceCursor struct {
+	CreatedAt time.Time
+	Label     string
+	Id        string
+}
+
+// DevicePage is one page of devices, Total counts all devices matching the filters.
+type DevicePage struct {
+	Devices []domain.SignatureDevice
+	Total   int
+	HasMore bool
+}
+
+func NewDeviceCursor(device domain.SignatureDevice) DeviceCursor {
+	return DeviceCursor{
+		CreatedAt: device.CreatedAt,
+		Label:     device.Label,
+		Id:        device.Id,
+	}
+}
+
+func compareDevices(sortBy string, a, b DeviceCursor) int {
+	if sortBy == SortByLabel {
+		if c := strings.Compare(a.Label, b.Label); c != 0 {
+			return c
+		}
+	} else if !a.CreatedAt.Equal(b.CreatedAt) {
+		if a.CreatedAt.Before(b.CreatedAt) {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a.Id, b.Id)
+}
+
 type SignatureDeviceInMemoryRepository struct {
 	db persistence.InMemoryDB
 }
@@ -26,12 +89,95 @@ func NewSignatureDeviceInMemoryRepository(db *persistence.InMemoryDB) *Signature
 }
 
 func (r SignatureDeviceInMemoryRepository) Save(device domain.SignatureDevice) error {
+	destroysKey, err := r.save(device)
+	if err != nil {
+		return err
+	}
+	if destroysKey {
+		// the journal must not keep the destroyed key either, the
+		// compaction takes the table locks itself
+		return compact(&r.db)
+	}
+	return nil
+}
+
+// save stores the device and tells whether its private key was removed.
+func (r SignatureDeviceInMemoryRepository) save(device domain.SignatureDevice) (bool, error) {
 	r.db.DevicesLock.Lock()
 	defer r.db.DevicesLock.Unlock()
-	r.db.Devices[device.Id] = device
+	if err := checkDeviceVersion(&r.db, device); err != nil {
+		return false, err
+	}
+	device.Version++
+	if err := journal(&r.db, persistence.Mutation{Kind: persistence.SaveDevice, Device: &device}); err != nil {
+		return false, err
+	}
+	stored, ok := r.db.Devices[device.Id]
+	saveDevice(&r.db, device)
+	return ok && len(stored.PrivateKey) > 0 && len(device.PrivateKey) == 0, nil
+}
+
+// checkDeviceVersion compares the version and the fencing token of the device
+// with the stored one, the caller must hold the devices lock.
+func checkDeviceVersion(db *persistence.InMemoryDB, device domain.SignatureDevice) error {
+	stored, ok := db.Devices[device.Id]
+	if !ok {
+		if device.Version != 0 {
+			return domain.ErrDeviceNotFound
+		}
+		return nil
+	}
+	if device.FencingToken < stored.FencingToken {
+		return domain.ErrStaleFencingToken
+	}
+	if stored.Version != device.Version {
+		return domain.ErrConcurrentModification
+	}
 	return nil
 }
 
+// saveDevice stores the device and keeps the listing index up to date,
+// the caller must hold the devices lock.
+func saveDevice(db *persistence.InMemoryDB, device domain.SignatureDevice) {
+	previous, ok := db.Devices[device.Id]
+	// signing only changes the counter, the index is left alone then
+	if !ok || previous.Label != device.Label || !previous.CreatedAt.Equal(device.CreatedAt) {
+		if ok {
+			unindexDevice(db, previous)
+		}
+		key := NewDeviceCursor(device)
+		db.DevicesSorted.ByCreatedAt = insertDeviceId(db, db.DevicesSorted.ByCreatedAt, SortByCreatedAt, key)
+		db.DevicesSorted.ByLabel = insertDeviceId(db, db.DevicesSorted.ByLabel, SortByLabel, key)
+	}
+	db.Devices[device.Id] = device
+}
+
+func unindexDevice(db *persistence.InMemoryDB, device domain.SignatureDevice) {
+	key := NewDeviceCursor(device)
+	db.DevicesSorted.ByCreatedAt = removeDeviceId(db, db.DevicesSorted.ByCreatedAt, SortByCreatedAt, key)
+	db.DevicesSorted.ByLabel = removeDeviceId(db, db.DevicesSorted.ByLabel, SortByLabel, key)
+}
+
+func insertDeviceId(db *persistence.InMemoryDB, ids []string, sortBy string, key DeviceCursor) []string {
+	position := sort.Search(len(ids), func(i int) bool {
+		return compareDevices(sortBy, NewDeviceCursor(db.Devices[ids[i]]), key) > 0
+	})
+	ids = append(ids, "")
+	copy(ids[position+1:], ids[position:])
+	ids[position] = key.Id
+	return ids
+}
+
+func removeDeviceId(db *persistence.InMemoryDB, ids []string, sortBy string, key DeviceCursor) []string {
+	position := sort.Search(len(ids), func(i int) bool {
+		return compareDevices(sortBy, NewDeviceCursor(db.Devices[ids[i]]), key) >= 0
+	})
+	if position == len(ids) || ids[position] != key.Id {
+		return ids
+	}
+	return append(ids[:position], ids[position+1:]...)
+}
+
 func (r SignatureDeviceInMemoryRepository) GetById(id string) (*domain.SignatureDevice, error) {
 	// although it should not be its responsibility,
 	// for the sake of simplicity, part of the locking logic is implemented here.
@@ -54,20 +200,133 @@ func (r SignatureDeviceInMemoryRepository) GetAll() ([]domain.SignatureDevice, e
 	return devices, nil
 }
 
+// List returns one page of devices in the order of the query.
+func (r SignatureDeviceInMemoryRepository) List(query DeviceQuery) (DevicePage, error) {
+	r.db.DevicesLock.RLock()
+	defer r.db.DevicesLock.RUnlock()
+	ids := r.db.DevicesSorted.ByCreatedAt
+	if query.SortBy == SortByLabel {
+		ids = r.db.DevicesSorted.ByLabel
+	}
+	key := func(i int) DeviceCursor {
+		return NewDeviceCursor(r.db.Devices[ids[i]])
+	}
+	// the devices matching the filters are within [lower, upper)
+	lower, upper := 0, len(ids)
+	if query.LabelPrefix != "" && query.SortBy == SortByLabel {
+		// labels with a common prefix are adjacent in the label order
+		lower = sort.Search(len(ids), func(i int) bool {
+			return key(i).Label >= query.LabelPrefix
+		})
+		upper = lower + sort.Search(len(ids)-lower, func(i int) bool {
+			return !strings.HasPrefix(key(lower+i).Label, query.LabelPrefix)
+		})
+	}
+	matches := func(device domain.SignatureDevice) bool {
+		return (query.Algorithm == "" || device.Algorithm == query.Algorithm) &&
+			strings.HasPrefix(device.Label, query.LabelPrefix) &&
+			hasTags(device, query.Tags)
+	}
+	page := DevicePage{Devices: []domain.SignatureDevice{}, Total: upper - lower}
+	if query.Algorithm != "" || len(query.Tags) > 0 || (query.LabelPrefix != "" && query.SortBy != SortByLabel) {
+		page.Total = 0
+		for i := lower; i < upper; i++ {
+			if matches(r.db.Devices[ids[i]]) {
+				page.Total++
+			}
+		}
+	}
+	// skip everything up to and including the cursor
+	if query.After != nil {
+		if query.Descending {
+			cursor := sort.Search(len(ids), func(i int) bool {
+				return compareDevices(query.SortBy, key(i), *query.After) >= 0
+			})
+			if cursor < upper {
+				upper = cursor
+			}
+		} else {
+			cursor := sort.Search(len(ids), func(i int) bool {
+				return compareDevices(query.SortBy, key(i), *query.After) > 0
+			})
+			if cursor > lower {
+				lower = cursor
+			}
+		}
+	}
+	position, step := lower, 1
+	if query.Descending {
+		position, step = upper-1, -1
+	}
+	for ; position >= lower && position < upper; position += step {
+		device := r.db.Devices[ids[position]]
+		if !matches(device) {
+			continue
+		}
+		if len(page.Devices) == query.Limit {
+			page.HasMore = true
+			break
+		}
+		page.Devices = append(page.Devices, device)
+	}
+	return page, nil
+}
+
+func hasTags(device domain.SignatureDevice, tags map[string]string) bool {
+	for key, value := range tags {
+		if stored, ok := device.Tags[key]; !ok || stored != value {
+			return false
+		}
+	}
+	return true
+}
+
+// sortedKeys returns the keys of the tags in order, so queries built from them are stable.
+func sortedKeys(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func (r SignatureDeviceInMemoryRepository) DeleteById(id string) error {
 	r.db.DevicesLock.Lock()
 	defer r.db.DevicesLock.Unlock()
-	delete(r.db.Devices, id)
+	if err := journal(&r.db, persistence.Mutation{Kind: persistence.DeleteDevice, Id: id}); err != nil {
+		return err
+	}
+	deleteDevice(&r.db, id)
 	return nil
 }
 
+func deleteDevice(db *persistence.InMemoryDB, id string) {
+	if device, ok := db.Devices[id]; ok {
+		unindexDevice(db, device)
+	}
+	delete(db.Devices, id)
+}
+
 func (r *SignatureDeviceInMemoryRepository) DeleteAll() error {
 	r.db.DevicesLock.Lock()
 	defer r.db.DevicesLock.Unlock()
-	r.db.Devices = make(map[string]domain.SignatureDevice)
+	if err := journal(&r.db, persistence.Mutation{Kind: persistence.DeleteAllDevices}); err != nil {
+		return err
+	}
+	deleteAllDevices(&r.db)
 	return nil
 }
 
+func deleteAllDevices(db *persistence.InMemoryDB) {
+	// the map is cleared in place, it is shared with other repositories and units of work
+	for id := range db.Devices {
+		delete(db.Devices, id)
+	}
+	db.DevicesSorted.ByCreatedAt = nil
+	db.DevicesSorted.ByLabel = nil
+}
+
 func (r SignatureDeviceInMemoryRepository) Count() int {
 	r.db.DevicesLock.RLock()
 	defer r.db.DevicesLock.RUnlock()
@@ -4,7 +4,9 @@ import (
 	"signing-service-challenge/crypto"
 	"signing-service-challenge/domain"
 	"signing-service-challenge/persistence"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -93,6 +95,127 @@ func TestDeleteAllDevices(t *testing.T) {
 	}
 }
 
+func TestListDevicesInPages(t *testing.T) {
+	var repository = createDeviceRepository()
+	labels := []string{"till 3", "store 1", "till 1", "store 2", "till 2"}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, label := range labels {
+		device := domain.NewSignatureDeviceWithoutKeys(uuid.NewString(), crypto.RSA, label)
+		device.CreatedAt = start.Add(time.Duration(i) * time.Minute)
+		repository.Save(*device)
+	}
+	tests := []struct {
+		query    DeviceQuery
+		expected []string
+	}{
+		{DeviceQuery{SortBy: SortByCreatedAt, Limit: 2}, labels},
+		{DeviceQuery{SortBy: SortByLabel, Limit: 2}, []string{"store 1", "store 2", "till 1", "till 2", "till 3"}},
+		{DeviceQuery{SortBy: SortByLabel, Descending: true, Limit: 2}, []string{"till 3", "till 2", "till 1", "store 2", "store 1"}},
+		{DeviceQuery{SortBy: SortByLabel, LabelPrefix: "till", Limit: 2}, []string{"till 1", "till 2", "till 3"}},
+		{DeviceQuery{SortBy: SortByCreatedAt, LabelPrefix: "store", Descending: true, Limit: 1}, []string{"store 2", "store 1"}},
+	}
+	for _, test := range tests {
+		query := test.query
+		found := []string{}
+		for pages := 0; ; pages++ {
+			if pages > len(labels) {
+				t.Fatal("paging did not stop")
+			}
+			page, err := repository.List(query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if page.Total != len(test.expected) {
+				t.Errorf("got total %d, expected %d", page.Total, len(test.expected))
+			}
+			for _, device := range page.Devices {
+				found = append(found, device.Label)
+			}
+			if !page.HasMore {
+				break
+			}
+			after := NewDeviceCursor(page.Devices[len(page.Devices)-1])
+			query.After = &after
+		}
+		if strings.Join(found, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("got devices %v, expected %v", found, test.expected)
+		}
+	}
+}
+
+func TestListDevicesByAlgorithm(t *testing.T) {
+	var repository = createDeviceRepository()
+	createDevices(3, repository)
+	device := domain.NewSignatureDeviceWithoutKeys(uuid.NewString(), crypto.ECC, "Test Device")
+	repository.Save(*device)
+	page, _ := repository.List(DeviceQuery{Algorithm: crypto.ECC, Limit: 10})
+	if page.Total != 1 || len(page.Devices) != 1 || page.Devices[0].Id != device.Id {
+		t.Errorf("got %d devices, expected only device %s", page.Total, device.Id)
+	}
+}
+
+func TestListDevicesByTags(t *testing.T) {
+	testListDevicesByTags(t, createDeviceRepository())
+}
+
+// testListDevicesByTags is shared by the in-memory and the SQL repository.
+func testListDevicesByTags(t *testing.T, repository SignatureDeviceRepository) {
+	tags := []map[string]string{
+		{"store": "berlin", "register": "1"},
+		{"store": "berlin", "register": "2"},
+		{"store": "munich", "register": "1"},
+		nil,
+	}
+	ids := []string{}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, tagged := range tags {
+		device := domain.NewSignatureDeviceWithoutKeys(uuid.NewString(), crypto.RSA, "Test Device")
+		device.CreatedAt = start.Add(time.Duration(i) * time.Minute)
+		device.Tags = tagged
+		repository.Save(*device)
+		ids = append(ids, device.Id)
+	}
+	tests := []struct {
+		tags     map[string]string
+		expected []string
+	}{
+		{map[string]string{"store": "berlin"}, ids[:2]},
+		{map[string]string{"store": "berlin", "register": "1"}, ids[:1]},
+		{map[string]string{"register": "1"}, []string{ids[0], ids[2]}},
+		{map[string]string{"store": "hamburg"}, []string{}},
+		{map[string]string{"cost.center": "1"}, []string{}},
+	}
+	for _, test := range tests {
+		page, err := repository.List(DeviceQuery{Tags: test.tags, Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := []string{}
+		for _, device := range page.Devices {
+			found = append(found, device.Id)
+		}
+		if page.Total != len(test.expected) || strings.Join(found, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("tags %v: got %d devices %v, expected %v", test.tags, page.Total, found, test.expected)
+		}
+	}
+}
+
+func TestListDevicesAfterRelabelAndDelete(t *testing.T) {
+	var repository = createDeviceRepository()
+	ids := createDevices(3, repository)
+	device, _ := repository.GetById(ids[0])
+	device.Label = "A Device"
+	repository.Save(*device)
+	repository.DeleteById(ids[1])
+	page, _ := repository.List(DeviceQuery{SortBy: SortByLabel, Limit: 10})
+	if page.Total != 2 || len(page.Devices) != 2 {
+		t.Fatalf("got %d devices, expected %d", len(page.Devices), 2)
+	}
+	if page.Devices[0].Id != ids[0] {
+		t.Errorf("got device %s first, expected the relabeled device %s", page.Devices[0].Id, ids[0])
+	}
+}
+
 func createDeviceRepository() *SignatureDeviceInMemoryRepository {
 	var db = persistence.NewInMemoryDB()
 	return NewSignatureDeviceInMemoryRepository(db)
@@ -108,3 +231,48 @@ func createDevices(numOfDevices int, repository *SignatureDeviceInMemoryReposito
 	}
 	return ids
 }
+
+func TestSaveDeviceWithStaleVersionShouldFail(t *testing.T) {
+	repository := createDeviceRepository()
+	device := domain.NewSignatureDeviceWithoutKeys(uuid.NewString(), crypto.RSA, "Test Device")
+	if err := repository.Save(*device); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := repository.GetById(device.Id)
+	second, _ := repository.GetById(device.Id)
+	first.Label = "First"
+	if err := repository.Save(*first); err != nil {
+		t.Fatal(err)
+	}
+	second.Label = "Second"
+	if err := repository.Save(*second); err != domain.ErrConcurrentModification {
+		t.Errorf("got error %v, expected %v", err, domain.ErrConcurrentModification)
+	}
+	// a device with a version which was never stored was deleted meanwhile
+	if err := repository.Save(domain.SignatureDevice{Id: uuid.NewString(), Version: 1}); err != domain.ErrDeviceNotFound {
+		t.Errorf("got error %v, expected %v", err, domain.ErrDeviceNotFound)
+	}
+	stored, _ := repository.GetById(device.Id)
+	if stored.Label != "First" || stored.Version != 2 {
+		t.Errorf("got label %s at version %d, expected %s at version %d", stored.Label, stored.Version, "First", 2)
+	}
+}
+
+func TestSaveDeviceWithStaleFencingTokenShouldFail(t *testing.T) {
+	repository := createDeviceRepository()
+	device := domain.NewSignatureDeviceWithoutKeys(uuid.NewString(), crypto.RSA, "Test Device")
+	device.FencingToken = 2
+	if err := repository.Save(*device); err != nil {
+		t.Fatal(err)
+	}
+	stale, _ := repository.GetById(device.Id)
+	stale.FencingToken = 1
+	if err := repository.Save(*stale); err != domain.ErrStaleFencingToken {
+		t.Errorf("got error %v, expected %v", err, domain.ErrStaleFencingToken)
+	}
+	// writes without a lock keep the token they were read with
+	current, _ := repository.GetById(device.Id)
+	if err := repository.Save(*current); err != nil {
+		t.Error(err)
+	}
+}
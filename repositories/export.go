@@ -0,0 +1,57 @@
+package repositories
+
+import (
+	"signing-service-challenge/domain"
+	"signing-service-challenge/persistence"
+	"sort"
+)
+
+// KeyExportRepository stores the audit trail of private key exports.
+// Records are append only.
+type KeyExportRepository interface {
+	Save(domain.KeyExport) error
+	GetByDeviceId(string) ([]domain.KeyExport, error)
+	Count() int
+}
+
+type KeyExportInMemoryRepository struct {
+	db persistence.InMemoryDB
+}
+
+func NewKeyExportInMemoryRepository(db *persistence.InMemoryDB) *KeyExportInMemoryRepository {
+	return &KeyExportInMemoryRepository{
+		db: *db,
+	}
+}
+
+func (r KeyExportInMemoryRepository) Save(export domain.KeyExport) error {
+	r.db.KeyExportsLock.Lock()
+	defer r.db.KeyExportsLock.Unlock()
+	if err := journal(&r.db, persistence.Mutation{Kind: persistence.SaveKeyExport, KeyExport: &export}); err != nil {
+		return err
+	}
+	r.db.KeyExports[export.Id] = export
+	return nil
+}
+
+// GetByDeviceId returns the exports of a device, oldest first.
+func (r KeyExportInMemoryRepository) GetByDeviceId(deviceId string) ([]domain.KeyExport, error) {
+	r.db.KeyExportsLock.RLock()
+	defer r.db.KeyExportsLock.RUnlock()
+	exports := []domain.KeyExport{}
+	for _, value := range r.db.KeyExports {
+		if value.DeviceId == deviceId {
+			exports = append(exports, value)
+		}
+	}
+	sort.Slice(exports, func(i, j int) bool {
+		return exports[i].ExportedAt.Before(exports[j].ExportedAt)
+	})
+	return exports, nil
+}
+
+func (r KeyExportInMemoryRepository) Count() int {
+	r.db.KeyExportsLock.RLock()
+	defer r.db.KeyExportsLock.RUnlock()
+	return len(r.db.KeyExports)
+}
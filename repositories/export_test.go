@@ -0,0 +1,35 @@
+package repositories
+
+import (
+	"signing-service-challenge/domain"
+	"signing-service-challenge/persistence"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestGetKeyExportsByDeviceId(t *testing.T) {
+	var repository = NewKeyExportInMemoryRepository(persistence.NewInMemoryDB())
+	deviceId := uuid.NewString()
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		export := domain.NewKeyExport(uuid.NewString(), deviceId, "scheme", "fingerprint", "admin", now.Add(time.Duration(-i)*time.Minute))
+		repository.Save(*export)
+	}
+	other := domain.NewKeyExport(uuid.NewString(), uuid.NewString(), "scheme", "fingerprint", "admin", now)
+	repository.Save(*other)
+
+	exports, _ := repository.GetByDeviceId(deviceId)
+	if len(exports) != 5 {
+		t.Fatalf("got %d exports, %d expected", len(exports), 5)
+	}
+	for i := 1; i < len(exports); i++ {
+		if exports[i].ExportedAt.Before(exports[i-1].ExportedAt) {
+			t.Error("exports should be ordered oldest first")
+		}
+	}
+	if repository.Count() != 6 {
+		t.Errorf("got %d exports in total, %d expected", repository.Count(), 6)
+	}
+}
@@ -0,0 +1,66 @@
+package repositories
+
+import (
+	"signing-service-challenge/domain"
+	"signing-service-challenge/persistence"
+)
+
+// OpenFileDB restores the database from the snapshot and the write-ahead log in dir.
+// The returned database is used with the in-memory repositories and units of work,
+// which write every mutation to the log before applying it.
+func OpenFileDB(dir string, options persistence.FileStoreOptions) (*persistence.InMemoryDB, *persistence.FileStore, error) {
+	db := persistence.NewInMemoryDB()
+	apply := func(mutation persistence.Mutation) {
+		applyMutation(db, mutation)
+	}
+	store, err := persistence.OpenFileStore(dir, db, apply, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	return db, store, nil
+}
+
+// applyMutation replays a mutation of the journal, it runs before the
+// database is shared and therefore takes no locks.
+func applyMutation(db *persistence.InMemoryDB, mutation persistence.Mutation) {
+	switch mutation.Kind {
+	case persistence.SaveDevice:
+		device := *mutation.Device
+		if device.State == "" {
+			// logged before devices had lifecycle states, all of them could sign
+			device.State = domain.StateActive
+		}
+		saveDevice(db, device)
+	case persistence.DeleteDevice:
+		deleteDevice(db, mutation.Id)
+	case persistence.DeleteAllDevices:
+		deleteAllDevices(db)
+	case persistence.SaveSignature:
+		saveSignature(db, *mutation.Signature)
+	case persistence.DeleteSignature:
+		deleteSignature(db, mutation.Id)
+	case persistence.DeleteAllSignatures:
+		deleteAllSignatures(db)
+	case persistence.SaveKeyExport:
+		db.KeyExports[mutation.KeyExport.Id] = *mutation.KeyExport
+	}
+}
+
+// journal records the mutations if the database is persisted, the caller holds
+// the locks of the mutated tables.
+func journal(db *persistence.InMemoryDB, mutations ...persistence.Mutation) error {
+	if db.Journal == nil || len(mutations) == 0 {
+		return nil
+	}
+	return db.Journal.Append(mutations...)
+}
+
+// compact drops the superseded mutations of the journal, if it keeps any. The
+// caller must not hold any table lock.
+func compact(db *persistence.InMemoryDB) error {
+	compactor, ok := db.Journal.(persistence.Compactor)
+	if !ok {
+		return nil
+	}
+	return compactor.Compact()
+}
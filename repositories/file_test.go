@@ -0,0 +1,279 @@
+package repositories
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"signing-service-challenge/crypto"
+	"signing-service-challenge/domain"
+	"signing-service-challenge/persistence"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// recordHeaderLength is the length of the length and checksum header of a log record.
+const recordHeaderLength = 8
+
+func openFileDB(t *testing.T, dir string, options persistence.FileStoreOptions) (*persistence.InMemoryDB, *persistence.FileStore) {
+	db, store, err := OpenFileDB(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return db, store
+}
+
+// fillFileDB saves a device with two signatures through a unit of work and deletes a third signature.
+func fillFileDB(t *testing.T, db *persistence.InMemoryDB) domain.SignatureDevice {
+	device := domain.NewSignatureDeviceWithoutKeys(uuid.NewString(), crypto.RSA, "Test Device")
+	devices := NewSignatureDeviceInMemoryRepository(db)
+	if err := devices.Save(*device); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		signature := domain.NewSignature(uuid.NewString(), generateRandomString(20), generateRandomString(20), device.Id)
+		signature.Counter = i
+		device, _ = devices.GetById(device.Id)
+		device.SignatureCounter = i + 1
+		unitOfWork, _ := NewInMemoryUnitOfWorkFactory(db).Begin()
+		unitOfWork.RegisterDevice(*device, i)
+		unitOfWork.RegisterSignature(*signature)
+		if err := unitOfWork.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	signatures := NewSignatureInMemoryRepository(db)
+	deleted := domain.NewSignature(uuid.NewString(), "", "", "another device")
+	signatures.Save(*deleted)
+	signatures.DeleteById(deleted.Id)
+	device, _ = devices.GetById(device.Id)
+	return *device
+}
+
+func checkRestoredFileDB(t *testing.T, db *persistence.InMemoryDB, device domain.SignatureDevice) {
+	restored, err := NewSignatureDeviceInMemoryRepository(db).GetById(device.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.SignatureCounter != device.SignatureCounter {
+		t.Errorf("got counter %d, expected %d", restored.SignatureCounter, device.SignatureCounter)
+	}
+	signatures := NewSignatureInMemoryRepository(db)
+	if signatures.Count() != 2 {
+		t.Errorf("got %d signatures, expected %d", signatures.Count(), 2)
+	}
+	if _, err := signatures.GetByDeviceIdAndCounter(device.Id, 1); err != nil {
+		t.Errorf("signature index not restored: %v", err)
+	}
+	page, _ := NewSignatureDeviceInMemoryRepository(db).List(DeviceQuery{Limit: 10})
+	if page.Total != 1 {
+		t.Errorf("device index not restored, got %d devices", page.Total)
+	}
+}
+
+func TestFileDBReplaysWriteAheadLog(t *testing.T) {
+	dir := t.TempDir()
+	db, store := openFileDB(t, dir, persistence.FileStoreOptions{})
+	device := fillFileDB(t, db)
+	store.Close()
+
+	restoredDB, restoredStore := openFileDB(t, dir, persistence.FileStoreOptions{})
+	if restoredStore.Recovery.LogRecords != 5 || restoredStore.Recovery.TailError != nil {
+		t.Errorf("unexpected recovery %+v", restoredStore.Recovery)
+	}
+	checkRestoredFileDB(t, restoredDB, device)
+}
+
+func TestFileDBRestoresSnapshotAndTruncatesLog(t *testing.T) {
+	dir := t.TempDir()
+	db, store := openFileDB(t, dir, persistence.FileStoreOptions{})
+	device := fillFileDB(t, db)
+	if err := store.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := os.Stat(filepath.Join(dir, "wal.log"))
+	if info.Size() != 0 {
+		t.Errorf("log should be empty after a snapshot, but has %d bytes", info.Size())
+	}
+	// mutations after the snapshot are replayed on top of it
+	device.Label = "Renamed"
+	NewSignatureDeviceInMemoryRepository(db).Save(device)
+	store.Close()
+
+	restoredDB, restoredStore := openFileDB(t, dir, persistence.FileStoreOptions{})
+	if restoredStore.Recovery.SnapshotMutations != 3 || restoredStore.Recovery.LogRecords != 1 {
+		t.Errorf("unexpected recovery %+v", restoredStore.Recovery)
+	}
+	checkRestoredFileDB(t, restoredDB, device)
+	restored, _ := NewSignatureDeviceInMemoryRepository(restoredDB).GetById(device.Id)
+	if restored.Label != "Renamed" {
+		t.Errorf("got label %s, expected %s", restored.Label, "Renamed")
+	}
+}
+
+func TestFileDBDropsTruncatedTail(t *testing.T) {
+	dir := t.TempDir()
+	db, store := openFileDB(t, dir, persistence.FileStoreOptions{})
+	device := fillFileDB(t, db)
+	store.Close()
+	// a record torn by a crash during the write
+	log, _ := os.OpenFile(filepath.Join(dir, "wal.log"), os.O_WRONLY|os.O_APPEND, 0o600)
+	log.Write([]byte{0, 0, 1, 0, 1, 2, 3})
+	log.Close()
+
+	restoredDB, restoredStore := openFileDB(t, dir, persistence.FileStoreOptions{})
+	if !errors.Is(restoredStore.Recovery.TailError, persistence.ErrTruncatedLog) || restoredStore.Recovery.TruncatedBytes != 7 {
+		t.Errorf("unexpected recovery %+v", restoredStore.Recovery)
+	}
+	checkRestoredFileDB(t, restoredDB, device)
+	// new records are appended behind the last complete one
+	NewKeyExportInMemoryRepository(restoredDB).Save(*domain.NewKeyExport(uuid.NewString(), device.Id, "scheme", "fingerprint", "admin", device.CreatedAt))
+	restoredStore.Close()
+	_, reopened := openFileDB(t, dir, persistence.FileStoreOptions{})
+	if reopened.Recovery.LogRecords != 6 || reopened.Recovery.TailError != nil {
+		t.Errorf("unexpected recovery %+v", reopened.Recovery)
+	}
+}
+
+func TestFileDBDetectsCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	db, store := openFileDB(t, dir, persistence.FileStoreOptions{})
+	fillFileDB(t, db)
+	store.Close()
+	path := filepath.Join(dir, "wal.log")
+	content, _ := os.ReadFile(path)
+	// flip a bit in the payload of the last record
+	content[len(content)-2] ^= 1
+	os.WriteFile(path, content, 0o600)
+
+	_, restoredStore := openFileDB(t, dir, persistence.FileStoreOptions{})
+	if !errors.Is(restoredStore.Recovery.TailError, persistence.ErrCorruptLog) || restoredStore.Recovery.LogRecords != 4 {
+		t.Errorf("unexpected recovery %+v", restoredStore.Recovery)
+	}
+}
+
+func TestFileDBRefusesToDropRecordsBehindACorruptOne(t *testing.T) {
+	dir := t.TempDir()
+	db, store := openFileDB(t, dir, persistence.FileStoreOptions{})
+	fillFileDB(t, db)
+	store.Close()
+	path := filepath.Join(dir, "wal.log")
+	content, _ := os.ReadFile(path)
+	// flip a bit in the payload of the first record, four acknowledged records follow
+	content[recordHeaderLength+2] ^= 1
+	os.WriteFile(path, content, 0o600)
+
+	if _, _, err := OpenFileDB(dir, persistence.FileStoreOptions{}); !errors.Is(err, persistence.ErrCorruptLog) {
+		t.Errorf("got error %v, expected %v", err, persistence.ErrCorruptLog)
+	}
+	if kept, _ := os.ReadFile(path); len(kept) != len(content) {
+		t.Errorf("log should be left untouched, got %d of %d bytes", len(kept), len(content))
+	}
+}
+
+func TestFileDBCompactsLogWhenPrivateKeyIsDestroyed(t *testing.T) {
+	dir := t.TempDir()
+	db, store := openFileDB(t, dir, persistence.FileStoreOptions{SnapshotEvery: 10000})
+	devices := NewSignatureDeviceInMemoryRepository(db)
+	device := domain.NewSignatureDeviceWithoutKeys(uuid.NewString(), crypto.ED25519, "Test Device")
+	device.PrivateKey = []byte("wrapped private key")
+	device.Transition(domain.StateActive, "created", device.CreatedAt)
+	devices.Save(*device)
+	stored, _ := devices.GetById(device.Id)
+	stored.Transition(domain.StateDecommissioned, "end of life", device.CreatedAt)
+	if err := devices.Save(*stored); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"wal.log", "snapshot.db"} {
+		content, _ := os.ReadFile(filepath.Join(dir, name))
+		if bytes.Contains(content, []byte(base64.StdEncoding.EncodeToString(device.PrivateKey))) {
+			t.Errorf("%s should not hold the destroyed key", name)
+		}
+	}
+	store.Close()
+
+	restoredDB, _ := openFileDB(t, dir, persistence.FileStoreOptions{})
+	restored, err := NewSignatureDeviceInMemoryRepository(restoredDB).GetById(device.Id)
+	if err != nil || restored.State != domain.StateDecommissioned {
+		t.Errorf("decommissioned device should be restored, got %+v (%v)", restored, err)
+	}
+}
+
+func TestFileDBRefusesRecordsAboveTheLimit(t *testing.T) {
+	dir := t.TempDir()
+	db, store := openFileDB(t, dir, persistence.FileStoreOptions{})
+	signatures := NewSignatureInMemoryRepository(db)
+	// the JSON encoding of the mutation adds less than a kilobyte to the data
+	large := domain.NewSignature(uuid.NewString(), "signature", strings.Repeat("a", persistence.MaxRecordLength-1024), "device")
+	if err := signatures.Save(*large); err != nil {
+		t.Fatal(err)
+	}
+	tooLarge := domain.NewSignature(uuid.NewString(), "signature", strings.Repeat("a", persistence.MaxRecordLength), "device")
+	tooLarge.Counter = 1
+	if err := signatures.Save(*tooLarge); !errors.Is(err, persistence.ErrRecordTooLarge) {
+		t.Errorf("got error %v, expected %v", err, persistence.ErrRecordTooLarge)
+	}
+	if _, err := signatures.GetById(tooLarge.Id); err == nil {
+		t.Error("refused signature should not be applied")
+	}
+	store.Close()
+
+	restoredDB, restoredStore := openFileDB(t, dir, persistence.FileStoreOptions{})
+	if restoredStore.Recovery.TailError != nil || restoredStore.Recovery.TruncatedBytes != 0 {
+		t.Errorf("log should be replayed completely, got %+v", restoredStore.Recovery)
+	}
+	restored, err := NewSignatureInMemoryRepository(restoredDB).GetById(large.Id)
+	if err != nil || restored.Data != large.Data {
+		t.Errorf("signature near the limit should be restored (%v)", err)
+	}
+}
+
+func TestFileDBCompactsLogOnceForConcurrentlyDestroyedKeys(t *testing.T) {
+	dir := t.TempDir()
+	db, store := openFileDB(t, dir, persistence.FileStoreOptions{SnapshotEvery: 10000})
+	devices := NewSignatureDeviceInMemoryRepository(db)
+	stored := []domain.SignatureDevice{}
+	for i := 0; i < 20; i++ {
+		device := domain.NewSignatureDeviceWithoutKeys(uuid.NewString(), crypto.ED25519, "Test Device")
+		device.PrivateKey = []byte(generateRandomString(32))
+		device.Transition(domain.StateActive, "created", device.CreatedAt)
+		devices.Save(*device)
+		saved, _ := devices.GetById(device.Id)
+		stored = append(stored, *saved)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, len(stored))
+	for _, device := range stored {
+		wg.Add(1)
+		go func(device domain.SignatureDevice) {
+			defer wg.Done()
+			device.Transition(domain.StateDecommissioned, "end of life", device.CreatedAt)
+			errs <- devices.Save(device)
+		}(device)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// every save has returned, so none of the keys may be left on disk
+	for _, name := range []string{"wal.log", "snapshot.db"} {
+		content, _ := os.ReadFile(filepath.Join(dir, name))
+		for _, device := range stored {
+			if bytes.Contains(content, []byte(base64.StdEncoding.EncodeToString(device.PrivateKey))) {
+				t.Errorf("%s should not hold the destroyed key of device %s", name, device.Id)
+			}
+		}
+	}
+	store.Close()
+	if err := store.Compact(); err != persistence.ErrFileStoreClosed {
+		t.Errorf("got error %v, expected %v", err, persistence.ErrFileStoreClosed)
+	}
+}
@@ -1,20 +1,70 @@
 package repositories
 
 import (
+	"math"
 	"signing-service-challenge/domain"
 	"signing-service-challenge/persistence"
+	"sort"
+	"time"
 )
 
 type SignatureRepository interface {
 	Save(domain.Signature) error
 	GetById(string) (*domain.Signature, error)
 	GetAll() ([]domain.Signature, error)
+	GetByDeviceId(string) ([]domain.Signature, error)
+	GetByDeviceIdAndCounter(string, int) (*domain.Signature, error)
+	ListByDeviceId(SignatureQuery) ([]domain.Signature, bool, error)
 	// not in the requirements, but for test cleanups
 	DeleteById(string) error
 	DeleteAll() error
 	Count() int
 }
 
+// SignatureQuery selects a page of the signatures of one device.
+// Nil bounds and zero times are unbounded.
+type SignatureQuery struct {
+	DeviceId    string
+	FromCounter *int
+	ToCounter   *int
+	From        time.Time
+	To          time.Time
+	Descending  bool
+	// AfterCounter is the cursor, the counter of the last signature of the previous page
+	AfterCounter *int
+	Limit        int
+}
+
+// counterBounds combines the counter range and the cursor into inclusive bounds.
+func (q SignatureQuery) counterBounds() (int, int) {
+	lower, upper := math.MinInt, math.MaxInt-1
+	if q.FromCounter != nil {
+		lower = *q.FromCounter
+	}
+	if q.ToCounter != nil && *q.ToCounter < upper {
+		upper = *q.ToCounter
+	}
+	if q.AfterCounter != nil {
+		if q.Descending && *q.AfterCounter-1 < upper {
+			upper = *q.AfterCounter - 1
+		}
+		if !q.Descending && *q.AfterCounter+1 > lower {
+			lower = *q.AfterCounter + 1
+		}
+	}
+	return lower, upper
+}
+
+func (q SignatureQuery) matchesTime(signature domain.Signature) bool {
+	if !q.From.IsZero() && signature.CreatedAt.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !signature.CreatedAt.Before(q.To) {
+		return false
+	}
+	return true
+}
+
 type SignatureInMemoryRepository struct {
 	db persistence.InMemoryDB
 }
@@ -25,13 +75,63 @@ func NewSignatureInMemoryRepository(db *persistence.InMemoryDB) *SignatureInMemo
 	}
 }
 
+// Save stores the signature and indexes it by (device id, counter).
+// A second signature for the same position in the chain and any change of a
+// stored signature are rejected.
 func (r SignatureInMemoryRepository) Save(signature domain.Signature) error {
 	r.db.SignaturesLock.Lock()
 	defer r.db.SignaturesLock.Unlock()
-	r.db.Signatures[signature.Id] = signature
+	if err := checkSignature(&r.db, signature); err != nil {
+		return err
+	}
+	if err := journal(&r.db, persistence.Mutation{Kind: persistence.SaveSignature, Signature: &signature}); err != nil {
+		return err
+	}
+	saveSignature(&r.db, signature)
+	return nil
+}
+
+// checkSignature and saveSignature expect the signature lock to be held.
+// They are shared with the unit of work.
+func checkSignature(db *persistence.InMemoryDB, signature domain.Signature) error {
+	// the chain is append-only, a stored signature is never changed
+	if _, ok := db.Signatures[signature.Id]; ok {
+		return domain.ErrDuplicateSignature
+	}
+	index, ok := db.SignaturesByDevice[signature.SignedBy]
+	if !ok {
+		return nil
+	}
+	if id, ok := index.Ids[signature.Counter]; ok && id != signature.Id {
+		return domain.ErrDuplicateSignature
+	}
 	return nil
 }
 
+func saveSignature(db *persistence.InMemoryDB, signature domain.Signature) {
+	if previous, ok := db.Signatures[signature.Id]; ok {
+		unindexSignature(db, previous)
+	}
+	index, ok := db.SignaturesByDevice[signature.SignedBy]
+	if !ok {
+		index = persistence.NewSignatureIndex()
+		db.SignaturesByDevice[signature.SignedBy] = index
+	}
+	index.Add(signature.Counter, signature.Id)
+	db.Signatures[signature.Id] = signature
+}
+
+func unindexSignature(db *persistence.InMemoryDB, signature domain.Signature) {
+	index, ok := db.SignaturesByDevice[signature.SignedBy]
+	if !ok {
+		return
+	}
+	index.Remove(signature.Counter)
+	if len(index.Counters) == 0 {
+		delete(db.SignaturesByDevice, signature.SignedBy)
+	}
+}
+
 func (r SignatureInMemoryRepository) GetById(id string) (*domain.Signature, error) {
 	r.db.SignaturesLock.Lock()
 	defer r.db.SignaturesLock.Unlock()
@@ -52,20 +152,104 @@ func (r SignatureInMemoryRepository) GetAll() ([]domain.Signature, error) {
 	return signatures, nil
 }
 
+// GetByDeviceId returns all signatures created by the given device in counter order.
+func (r SignatureInMemoryRepository) GetByDeviceId(deviceId string) ([]domain.Signature, error) {
+	r.db.SignaturesLock.RLock()
+	defer r.db.SignaturesLock.RUnlock()
+	signatures := []domain.Signature{}
+	index, ok := r.db.SignaturesByDevice[deviceId]
+	if !ok {
+		return signatures, nil
+	}
+	for _, counter := range index.Counters {
+		signatures = append(signatures, r.db.Signatures[index.Ids[counter]])
+	}
+	return signatures, nil
+}
+
+// ListByDeviceId returns one page of the signatures of a device in counter order.
+// The second result reports whether more signatures match the query.
+func (r SignatureInMemoryRepository) ListByDeviceId(query SignatureQuery) ([]domain.Signature, bool, error) {
+	r.db.SignaturesLock.RLock()
+	defer r.db.SignaturesLock.RUnlock()
+	signatures := []domain.Signature{}
+	index, ok := r.db.SignaturesByDevice[query.DeviceId]
+	if !ok {
+		return signatures, false, nil
+	}
+	lower, upper := query.counterBounds()
+	// positions of the first and the last counter within the bounds
+	first := sort.SearchInts(index.Counters, lower)
+	last := sort.SearchInts(index.Counters, upper+1) - 1
+	position, step := first, 1
+	if query.Descending {
+		position, step = last, -1
+	}
+	for ; position >= first && position <= last; position += step {
+		signature := r.db.Signatures[index.Ids[index.Counters[position]]]
+		if !query.matchesTime(signature) {
+			continue
+		}
+		if len(signatures) == query.Limit {
+			return signatures, true, nil
+		}
+		signatures = append(signatures, signature)
+	}
+	return signatures, false, nil
+}
+
+func (r SignatureInMemoryRepository) GetByDeviceIdAndCounter(deviceId string, counter int) (*domain.Signature, error) {
+	r.db.SignaturesLock.RLock()
+	defer r.db.SignaturesLock.RUnlock()
+	index, ok := r.db.SignaturesByDevice[deviceId]
+	if !ok {
+		return nil, domain.ErrSignatureNotFound
+	}
+	id, ok := index.Ids[counter]
+	if !ok {
+		return nil, domain.ErrSignatureNotFound
+	}
+	signature := r.db.Signatures[id]
+	return &signature, nil
+}
+
 func (r SignatureInMemoryRepository) DeleteById(id string) error {
 	r.db.SignaturesLock.Lock()
 	defer r.db.SignaturesLock.Unlock()
-	delete(r.db.Signatures, id)
+	if err := journal(&r.db, persistence.Mutation{Kind: persistence.DeleteSignature, Id: id}); err != nil {
+		return err
+	}
+	deleteSignature(&r.db, id)
 	return nil
 }
 
+func deleteSignature(db *persistence.InMemoryDB, id string) {
+	if signature, ok := db.Signatures[id]; ok {
+		unindexSignature(db, signature)
+	}
+	delete(db.Signatures, id)
+}
+
 func (r *SignatureInMemoryRepository) DeleteAll() error {
 	r.db.SignaturesLock.Lock()
 	defer r.db.SignaturesLock.Unlock()
-	r.db.Signatures = make(map[string]domain.Signature)
+	if err := journal(&r.db, persistence.Mutation{Kind: persistence.DeleteAllSignatures}); err != nil {
+		return err
+	}
+	deleteAllSignatures(&r.db)
 	return nil
 }
 
+func deleteAllSignatures(db *persistence.InMemoryDB) {
+	// maps are cleared in place, they are shared with other repositories and units of work
+	for id := range db.Signatures {
+		delete(db.Signatures, id)
+	}
+	for deviceId := range db.SignaturesByDevice {
+		delete(db.SignaturesByDevice, deviceId)
+	}
+}
+
 func (r SignatureInMemoryRepository) Count() int {
 	r.db.SignaturesLock.RLock()
 	defer r.db.SignaturesLock.RUnlock()
@@ -6,6 +6,7 @@ import (
 	"signing-service-challenge/domain"
 	"signing-service-challenge/persistence"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -62,6 +63,69 @@ func TestGetAllSignatures(t *testing.T) {
 	}
 }
 
+func TestGetSignaturesByDeviceId(t *testing.T) {
+	var repository = createSignatureRepository()
+	createSignatures(10, repository)
+	deviceId := uuid.NewString()
+	for i := 0; i < 5; i++ {
+		signature := domain.NewSignature(uuid.NewString(), generateRandomString(20), generateRandomString(20), deviceId)
+		signature.Counter = i
+		repository.Save(*signature)
+	}
+	signatures, _ := repository.GetByDeviceId(deviceId)
+	if len(signatures) != 5 {
+		t.Errorf("got %d signatures, %d expected", len(signatures), 5)
+	}
+	for _, signature := range signatures {
+		if signature.SignedBy != deviceId {
+			t.Errorf("got signature of device %s, expected %s", signature.SignedBy, deviceId)
+		}
+	}
+}
+
+func TestGetSignatureByDeviceIdAndCounter(t *testing.T) {
+	var repository = createSignatureRepository()
+	ids := createSignatures(10, repository)
+	for counter, id := range ids {
+		result, err := repository.GetByDeviceIdAndCounter("ID12345", counter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Id != id {
+			t.Errorf("got id %s for counter %d, expected %s", result.Id, counter, id)
+		}
+	}
+	if _, err := repository.GetByDeviceIdAndCounter("ID12345", 10); err != domain.ErrSignatureNotFound {
+		t.Errorf("got error %v, expected %v", err, domain.ErrSignatureNotFound)
+	}
+}
+
+func TestSaveSignatureWithDuplicateCounterShouldFail(t *testing.T) {
+	var repository = createSignatureRepository()
+	createSignatures(1, repository)
+	duplicate := domain.NewSignature(uuid.NewString(), generateRandomString(20), generateRandomString(20), "ID12345")
+	if err := repository.Save(*duplicate); err != domain.ErrDuplicateSignature {
+		t.Errorf("got error %v, expected %v", err, domain.ErrDuplicateSignature)
+	}
+	if repository.Count() != 1 {
+		t.Errorf("%d signatures saved, but %d expected", repository.Count(), 1)
+	}
+}
+
+func TestChangeOfStoredSignatureShouldFail(t *testing.T) {
+	var repository = createSignatureRepository()
+	createSignatures(1, repository)
+	stored, _ := repository.GetByDeviceIdAndCounter("ID12345", 0)
+	changed := *stored
+	changed.Data = "changed"
+	if err := repository.Save(changed); err != domain.ErrDuplicateSignature {
+		t.Errorf("got error %v, expected %v", err, domain.ErrDuplicateSignature)
+	}
+	if kept, _ := repository.GetById(stored.Id); kept.Data != stored.Data {
+		t.Error("stored signature should be left unchanged")
+	}
+}
+
 func TestDeleteSignatureById(t *testing.T) {
 	var repository = createSignatureRepository()
 	numOfSignatures := 50
@@ -93,6 +157,85 @@ func TestDeleteAllSignatures(t *testing.T) {
 	}
 }
 
+func TestListSignaturesByDeviceIdInPages(t *testing.T) {
+	var repository = createSignatureRepository()
+	createSignatures(25, repository)
+	for _, descending := range []bool{false, true} {
+		counters := []int{}
+		query := SignatureQuery{DeviceId: "ID12345", Descending: descending, Limit: 10}
+		for pages := 0; ; pages++ {
+			if pages > 3 {
+				t.Fatal("paging did not stop")
+			}
+			signatures, more, err := repository.ListByDeviceId(query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, signature := range signatures {
+				counters = append(counters, signature.Counter)
+			}
+			if !more {
+				break
+			}
+			last := signatures[len(signatures)-1].Counter
+			query.AfterCounter = &last
+		}
+		if len(counters) != 25 {
+			t.Fatalf("got %d signatures, %d expected", len(counters), 25)
+		}
+		for i, counter := range counters {
+			expected := i
+			if descending {
+				expected = 24 - i
+			}
+			if counter != expected {
+				t.Errorf("got counter %d at position %d, expected %d", counter, i, expected)
+			}
+		}
+	}
+}
+
+func TestListSignaturesByDeviceIdWithCounterAndTimeRange(t *testing.T) {
+	var repository = createSignatureRepository()
+	createSignatures(5, repository)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		signature := domain.NewSignature(uuid.NewString(), generateRandomString(20), generateRandomString(20), "DEVICE")
+		signature.Counter = i
+		signature.CreatedAt = start.Add(time.Duration(i) * time.Hour)
+		repository.Save(*signature)
+	}
+	from, to := 2, 8
+	signatures, more, _ := repository.ListByDeviceId(SignatureQuery{
+		DeviceId:    "DEVICE",
+		FromCounter: &from,
+		ToCounter:   &to,
+		From:        start.Add(4 * time.Hour),
+		To:          start.Add(7 * time.Hour),
+		Limit:       10,
+	})
+	if more {
+		t.Error("no more signatures expected")
+	}
+	if len(signatures) != 3 {
+		t.Fatalf("got %d signatures, %d expected", len(signatures), 3)
+	}
+	for i, signature := range signatures {
+		if signature.Counter != 4+i {
+			t.Errorf("got counter %d, expected %d", signature.Counter, 4+i)
+		}
+	}
+}
+
+func TestListSignaturesOfUnknownDeviceShouldBeEmpty(t *testing.T) {
+	var repository = createSignatureRepository()
+	createSignatures(5, repository)
+	signatures, more, err := repository.ListByDeviceId(SignatureQuery{DeviceId: "unknown", Limit: 10})
+	if err != nil || more || len(signatures) != 0 {
+		t.Errorf("got %d signatures and error %v, expected none", len(signatures), err)
+	}
+}
+
 func createSignatureRepository() *SignatureInMemoryRepository {
 	var db = persistence.NewInMemoryDB()
 	return NewSignatureInMemoryRepository(db)
@@ -107,6 +250,7 @@ func createSignatures(numOfSignatures int, repository *SignatureInMemoryReposito
 		data := generateRandomString(20)
 		deviceId := "ID12345"
 		signature := domain.NewSignature(id, sig, data, deviceId)
+		signature.Counter = i
 		repository.Save(*signature)
 	}
 	return ids
@@ -0,0 +1,324 @@
+package repositories
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"signing-service-challenge/domain"
+	"signing-service-challenge/persistence"
+	"strings"
+	"unicode/utf8"
+)
+
+const deviceColumns = `id, algorithm, private_key, key_encryption_key_id, public_key, label,
+	signature_counter, last_signature, exportable, key_size, padding, curve, hash,
+	key_version, key_history, created_at, version, fencing_token, state, state_history, tags`
+
+// SignatureDeviceSQLRepository stores devices in a database/sql database.
+type SignatureDeviceSQLRepository struct {
+	db *persistence.SQLDB
+}
+
+func NewSignatureDeviceSQLRepository(db *persistence.SQLDB) *SignatureDeviceSQLRepository {
+	return &SignatureDeviceSQLRepository{
+		db: db,
+	}
+}
+
+func (r SignatureDeviceSQLRepository) Save(device domain.SignatureDevice) error {
+	if device.Version == 0 {
+		return insertSQLDevice(r.db.DB, r.db.Dialect, device)
+	}
+	return updateSQLDevice(r.db.DB, r.db.Dialect, device, nil)
+}
+
+func insertSQLDevice(q persistence.Querier, dialect persistence.Dialect, device domain.SignatureDevice) error {
+	device.Version = 1
+	values, err := deviceValues(device)
+	if err != nil {
+		return err
+	}
+	result, err := q.Exec(dialect.Rebind(`INSERT INTO devices (`+deviceColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO NOTHING`), values...)
+	if err != nil {
+		return err
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if inserted == 0 {
+		// another writer has created a device with the same id
+		return domain.ErrConcurrentModification
+	}
+	return nil
+}
+
+// updateSQLDevice updates the device only if the stored version is still device.Version
+// and, if given, the stored signature counter is still expectedCounter.
+func updateSQLDevice(q persistence.Querier, dialect persistence.Dialect, device domain.SignatureDevice, expectedCounter *int) error {
+	version := device.Version
+	device.Version++
+	values, err := deviceValues(device)
+	if err != nil {
+		return err
+	}
+	query := `UPDATE devices SET
+			algorithm = ?, private_key = ?, key_encryption_key_id = ?, public_key = ?, label = ?,
+			signature_counter = ?, last_signature = ?, exportable = ?, key_size = ?, padding = ?,
+			curve = ?, hash = ?, key_version = ?, key_history = ?, created_at = ?, version = ?, fencing_token = ?,
+				state = ?, state_history = ?, tags = ?
+		WHERE id = ? AND version = ? AND fencing_token <= ?`
+	args := append(values[1:], device.Id, version, device.FencingToken)
+	if expectedCounter != nil {
+		query += ` AND signature_counter = ?`
+		args = append(args, *expectedCounter)
+	}
+	result, err := q.Exec(dialect.Rebind(query), args...)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 1 {
+		return nil
+	}
+	var storedCounter int
+	var storedToken int64
+	err = q.QueryRow(dialect.Rebind(`SELECT signature_counter, fencing_token FROM devices WHERE id = ?`), device.Id).
+		Scan(&storedCounter, &storedToken)
+	if errors.Is(err, sql.ErrNoRows) {
+		return domain.ErrDeviceNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if device.FencingToken < storedToken {
+		return domain.ErrStaleFencingToken
+	}
+	// a changed counter is the more specific conflict
+	if expectedCounter != nil && storedCounter != *expectedCounter {
+		return domain.ErrSignatureCounterConflict
+	}
+	return domain.ErrConcurrentModification
+}
+
+// deviceValues returns the column values of the device in the order of deviceColumns.
+func deviceValues(device domain.SignatureDevice) ([]interface{}, error) {
+	history := device.KeyHistory
+	if history == nil {
+		history = []domain.KeyVersion{}
+	}
+	keyHistory, err := json.Marshal(history)
+	if err != nil {
+		return nil, err
+	}
+	transitions := device.StateHistory
+	if transitions == nil {
+		transitions = []domain.StateTransition{}
+	}
+	stateHistory, err := json.Marshal(transitions)
+	if err != nil {
+		return nil, err
+	}
+	tags := device.Tags
+	if tags == nil {
+		tags = map[string]string{}
+	}
+	encodedTags, err := json.Marshal(tags)
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{
+		device.Id,
+		device.Algorithm,
+		base64.StdEncoding.EncodeToString(device.PrivateKey),
+		device.KeyEncryptionKeyId,
+		string(device.PublicKey),
+		device.Label,
+		device.SignatureCounter,
+		device.LastSignature,
+		device.Exportable,
+		device.KeySize,
+		device.Padding,
+		device.Curve,
+		device.Hash,
+		device.KeyVersion,
+		string(keyHistory),
+		persistence.TimeToNanos(device.CreatedAt),
+		device.Version,
+		device.FencingToken,
+		device.State,
+		string(stateHistory),
+		string(encodedTags),
+	}, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanDevice(row rowScanner) (domain.SignatureDevice, error) {
+	var device domain.SignatureDevice
+	var privateKey, publicKey, keyHistory, stateHistory, tags string
+	var createdAt int64
+	err := row.Scan(
+		&device.Id,
+		&device.Algorithm,
+		&privateKey,
+		&device.KeyEncryptionKeyId,
+		&publicKey,
+		&device.Label,
+		&device.SignatureCounter,
+		&device.LastSignature,
+		&device.Exportable,
+		&device.KeySize,
+		&device.Padding,
+		&device.Curve,
+		&device.Hash,
+		&device.KeyVersion,
+		&keyHistory,
+		&createdAt,
+		&device.Version,
+		&device.FencingToken,
+		&device.State,
+		&stateHistory,
+		&tags,
+	)
+	if err != nil {
+		return device, err
+	}
+	if device.PrivateKey, err = base64.StdEncoding.DecodeString(privateKey); err != nil {
+		return device, err
+	}
+	if publicKey != "" {
+		device.PublicKey = []byte(publicKey)
+	}
+	if err := json.Unmarshal([]byte(keyHistory), &device.KeyHistory); err != nil {
+		return device, err
+	}
+	if len(device.KeyHistory) == 0 {
+		device.KeyHistory = nil
+	}
+	if err := json.Unmarshal([]byte(stateHistory), &device.StateHistory); err != nil {
+		return device, err
+	}
+	if len(device.StateHistory) == 0 {
+		device.StateHistory = nil
+	}
+	if err := json.Unmarshal([]byte(tags), &device.Tags); err != nil {
+		return device, err
+	}
+	if len(device.Tags) == 0 {
+		device.Tags = nil
+	}
+	device.CreatedAt = persistence.NanosToTime(createdAt)
+	return device, nil
+}
+
+func (r SignatureDeviceSQLRepository) GetById(id string) (*domain.SignatureDevice, error) {
+	row := r.db.DB.QueryRow(r.db.Dialect.Rebind(`SELECT `+deviceColumns+` FROM devices WHERE id = ?`), id)
+	device, err := scanDevice(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, domain.ErrDeviceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+func (r SignatureDeviceSQLRepository) GetAll() ([]domain.SignatureDevice, error) {
+	return r.queryDevices(`SELECT ` + deviceColumns + ` FROM devices`)
+}
+
+func (r SignatureDeviceSQLRepository) queryDevices(query string, args ...interface{}) ([]domain.SignatureDevice, error) {
+	rows, err := r.db.DB.Query(r.db.Dialect.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	devices := []domain.SignatureDevice{}
+	for rows.Next() {
+		device, err := scanDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	return devices, rows.Err()
+}
+
+// List returns one page of devices, paged by the (sort key, id) of the cursor.
+func (r SignatureDeviceSQLRepository) List(query DeviceQuery) (DevicePage, error) {
+	conditions := []string{"1 = 1"}
+	args := []interface{}{}
+	if query.Algorithm != "" {
+		conditions = append(conditions, "algorithm = ?")
+		args = append(args, query.Algorithm)
+	}
+	if query.LabelPrefix != "" {
+		// LIKE is case insensitive on SQLite, the in-memory prefix match is not
+		conditions = append(conditions, "substr(label, 1, ?) = ?")
+		args = append(args, utf8.RuneCountInString(query.LabelPrefix), query.LabelPrefix)
+	}
+	for _, key := range sortedKeys(query.Tags) {
+		conditions = append(conditions, r.db.Dialect.JSONField("tags")+" = ?")
+		args = append(args, key, query.Tags[key])
+	}
+	page := DevicePage{Devices: []domain.SignatureDevice{}}
+	err := r.db.DB.QueryRow(r.db.Dialect.Rebind(`SELECT COUNT(*) FROM devices WHERE `+strings.Join(conditions, " AND ")), args...).
+		Scan(&page.Total)
+	if err != nil {
+		return page, err
+	}
+	id, column, direction, comparison := r.db.Dialect.Binary("id"), "created_at", "ASC", ">"
+	if query.SortBy == SortByLabel {
+		column = r.db.Dialect.Binary("label")
+	}
+	if query.Descending {
+		direction, comparison = "DESC", "<"
+	}
+	if query.After != nil {
+		var key interface{} = persistence.TimeToNanos(query.After.CreatedAt)
+		if query.SortBy == SortByLabel {
+			key = query.After.Label
+		}
+		conditions = append(conditions, "("+column+" "+comparison+" ? OR ("+column+" = ? AND "+id+" "+comparison+" ?))")
+		args = append(args, key, key, query.After.Id)
+	}
+	// one more row than requested tells whether there is another page
+	devices, err := r.queryDevices(`SELECT `+deviceColumns+` FROM devices WHERE `+strings.Join(conditions, " AND ")+
+		` ORDER BY `+column+` `+direction+`, `+id+` `+direction+` LIMIT ?`, append(args, query.Limit+1)...)
+	if err != nil {
+		return page, err
+	}
+	if len(devices) > query.Limit {
+		devices = devices[:query.Limit]
+		page.HasMore = true
+	}
+	page.Devices = devices
+	return page, nil
+}
+
+func (r SignatureDeviceSQLRepository) DeleteById(id string) error {
+	_, err := r.db.DB.Exec(r.db.Dialect.Rebind(`DELETE FROM devices WHERE id = ?`), id)
+	return err
+}
+
+func (r SignatureDeviceSQLRepository) DeleteAll() error {
+	_, err := r.db.DB.Exec(`DELETE FROM devices`)
+	return err
+}
+
+func (r SignatureDeviceSQLRepository) Count() int {
+	var count int
+	if err := r.db.DB.QueryRow(`SELECT COUNT(*) FROM devices`).Scan(&count); err != nil {
+		return 0
+	}
+	return count
+}
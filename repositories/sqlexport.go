@@ -0,0 +1,53 @@
+package repositories
+
+import (
+	"signing-service-challenge/domain"
+	"signing-service-challenge/persistence"
+)
+
+// KeyExportSQLRepository stores the key export audit trail in a database/sql database.
+type KeyExportSQLRepository struct {
+	db *persistence.SQLDB
+}
+
+func NewKeyExportSQLRepository(db *persistence.SQLDB) *KeyExportSQLRepository {
+	return &KeyExportSQLRepository{
+		db: db,
+	}
+}
+
+func (r KeyExportSQLRepository) Save(export domain.KeyExport) error {
+	_, err := r.db.DB.Exec(r.db.Dialect.Rebind(`INSERT INTO key_exports
+		(id, device_id, scheme, recipient_fingerprint, exported_by, exported_at) VALUES (?, ?, ?, ?, ?, ?)`),
+		export.Id, export.DeviceId, export.Scheme, export.RecipientFingerprint, export.ExportedBy, persistence.TimeToNanos(export.ExportedAt))
+	return err
+}
+
+// GetByDeviceId returns the exports of a device, oldest first.
+func (r KeyExportSQLRepository) GetByDeviceId(deviceId string) ([]domain.KeyExport, error) {
+	rows, err := r.db.DB.Query(r.db.Dialect.Rebind(`SELECT id, device_id, scheme, recipient_fingerprint, exported_by, exported_at
+		FROM key_exports WHERE device_id = ? ORDER BY exported_at`), deviceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	exports := []domain.KeyExport{}
+	for rows.Next() {
+		var export domain.KeyExport
+		var exportedAt int64
+		if err := rows.Scan(&export.Id, &export.DeviceId, &export.Scheme, &export.RecipientFingerprint, &export.ExportedBy, &exportedAt); err != nil {
+			return nil, err
+		}
+		export.ExportedAt = persistence.NanosToTime(exportedAt)
+		exports = append(exports, export)
+	}
+	return exports, rows.Err()
+}
+
+func (r KeyExportSQLRepository) Count() int {
+	var count int
+	if err := r.db.DB.QueryRow(`SELECT COUNT(*) FROM key_exports`).Scan(&count); err != nil {
+		return 0
+	}
+	return count
+}
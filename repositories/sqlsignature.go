@@ -0,0 +1,169 @@
+package repositories
+
+import (
+	"database/sql"
+	"errors"
+	"signing-service-challenge/domain"
+	"signing-service-challenge/persistence"
+	"strings"
+)
+
+const signatureColumns = `id, device_id, counter, signature, data, previous_signature, algorithm, created_at`
+
+// SignatureSQLRepository stores signatures in a database/sql database.
+// The unique (device_id, counter) index is the secondary index by device.
+type SignatureSQLRepository struct {
+	db *persistence.SQLDB
+}
+
+func NewSignatureSQLRepository(db *persistence.SQLDB) *SignatureSQLRepository {
+	return &SignatureSQLRepository{
+		db: db,
+	}
+}
+
+// Save stores the signature, like the in-memory repository it refuses a
+// second signature of the device with the same counter and any change of a
+// stored signature.
+func (r SignatureSQLRepository) Save(signature domain.Signature) error {
+	tx, err := r.db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := saveSQLSignature(tx, r.db.Dialect, signature); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// saveSQLSignature inserts the signature. Stored signatures are never changed, a second
+// signature with the id or with the counter of the device fails on the primary key or
+// the unique (device_id, counter) index.
+func saveSQLSignature(q persistence.Querier, dialect persistence.Dialect, signature domain.Signature) error {
+	_, err := q.Exec(dialect.Rebind(`INSERT INTO signatures (`+signatureColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+		signature.Id,
+		signature.SignedBy,
+		signature.Counter,
+		signature.Signature,
+		signature.Data,
+		signature.PreviousSignature,
+		signature.Algorithm,
+		persistence.TimeToNanos(signature.CreatedAt),
+	)
+	if dialect.IsUniqueViolation(err) {
+		return domain.ErrDuplicateSignature
+	}
+	return err
+}
+
+func scanSignature(row rowScanner) (domain.Signature, error) {
+	var signature domain.Signature
+	var createdAt int64
+	err := row.Scan(
+		&signature.Id,
+		&signature.SignedBy,
+		&signature.Counter,
+		&signature.Signature,
+		&signature.Data,
+		&signature.PreviousSignature,
+		&signature.Algorithm,
+		&createdAt,
+	)
+	signature.CreatedAt = persistence.NanosToTime(createdAt)
+	return signature, err
+}
+
+func (r SignatureSQLRepository) querySignatures(query string, args ...interface{}) ([]domain.Signature, error) {
+	rows, err := r.db.DB.Query(r.db.Dialect.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	signatures := []domain.Signature{}
+	for rows.Next() {
+		signature, err := scanSignature(rows)
+		if err != nil {
+			return nil, err
+		}
+		signatures = append(signatures, signature)
+	}
+	return signatures, rows.Err()
+}
+
+func (r SignatureSQLRepository) querySignature(query string, args ...interface{}) (*domain.Signature, error) {
+	signature, err := scanSignature(r.db.DB.QueryRow(r.db.Dialect.Rebind(query), args...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, domain.ErrSignatureNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &signature, nil
+}
+
+func (r SignatureSQLRepository) GetById(id string) (*domain.Signature, error) {
+	return r.querySignature(`SELECT `+signatureColumns+` FROM signatures WHERE id = ?`, id)
+}
+
+func (r SignatureSQLRepository) GetAll() ([]domain.Signature, error) {
+	return r.querySignatures(`SELECT ` + signatureColumns + ` FROM signatures`)
+}
+
+// GetByDeviceId returns all signatures created by the given device in counter order.
+func (r SignatureSQLRepository) GetByDeviceId(deviceId string) ([]domain.Signature, error) {
+	return r.querySignatures(`SELECT `+signatureColumns+` FROM signatures WHERE device_id = ? ORDER BY counter`, deviceId)
+}
+
+func (r SignatureSQLRepository) GetByDeviceIdAndCounter(deviceId string, counter int) (*domain.Signature, error) {
+	return r.querySignature(`SELECT `+signatureColumns+` FROM signatures WHERE device_id = ? AND counter = ?`, deviceId, counter)
+}
+
+// ListByDeviceId returns one page of the signatures of a device in counter order.
+// The second result reports whether more signatures match the query.
+func (r SignatureSQLRepository) ListByDeviceId(query SignatureQuery) ([]domain.Signature, bool, error) {
+	lower, upper := query.counterBounds()
+	conditions := []string{"device_id = ?", "counter >= ?", "counter <= ?"}
+	args := []interface{}{query.DeviceId, lower, upper}
+	if !query.From.IsZero() {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, persistence.TimeToNanos(query.From))
+	}
+	if !query.To.IsZero() {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, persistence.TimeToNanos(query.To))
+	}
+	direction := "ASC"
+	if query.Descending {
+		direction = "DESC"
+	}
+	// one more row than requested tells whether there is another page
+	signatures, err := r.querySignatures(`SELECT `+signatureColumns+` FROM signatures WHERE `+strings.Join(conditions, " AND ")+
+		` ORDER BY counter `+direction+` LIMIT ?`, append(args, query.Limit+1)...)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(signatures) > query.Limit {
+		return signatures[:query.Limit], true, nil
+	}
+	return signatures, false, nil
+}
+
+func (r SignatureSQLRepository) DeleteById(id string) error {
+	_, err := r.db.DB.Exec(r.db.Dialect.Rebind(`DELETE FROM signatures WHERE id = ?`), id)
+	return err
+}
+
+func (r SignatureSQLRepository) DeleteAll() error {
+	_, err := r.db.DB.Exec(`DELETE FROM signatures`)
+	return err
+}
+
+func (r SignatureSQLRepository) Count() int {
+	var count int
+	if err := r.db.DB.QueryRow(`SELECT COUNT(*) FROM signatures`).Scan(&count); err != nil {
+		return 0
+	}
+	return count
+}
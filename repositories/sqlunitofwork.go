@@ -0,0 +1,71 @@
+package repositories
+
+import (
+	"signing-service-challenge/domain"
+	"signing-service-challenge/persistence"
+)
+
+type SQLUnitOfWorkFactory struct {
+	db *persistence.SQLDB
+}
+
+func NewSQLUnitOfWorkFactory(db *persistence.SQLDB) *SQLUnitOfWorkFactory {
+	return &SQLUnitOfWorkFactory{
+		db: db,
+	}
+}
+
+func (f SQLUnitOfWorkFactory) Begin() (UnitOfWork, error) {
+	return &SQLUnitOfWork{db: f.db}, nil
+}
+
+// SQLUnitOfWork buffers the writes and applies them in one database transaction.
+// Devices are updated conditionally on their version and signature counter, so the
+// database keeps two instances from handing out the same counter even without a shared lock.
+type SQLUnitOfWork struct {
+	db               *persistence.SQLDB
+	devices          []domain.SignatureDevice
+	expectedCounters []int
+	signatures       []domain.Signature
+	finished         bool
+}
+
+func (u *SQLUnitOfWork) RegisterDevice(device domain.SignatureDevice, expectedCounter int) {
+	u.devices = append(u.devices, device)
+	u.expectedCounters = append(u.expectedCounters, expectedCounter)
+}
+
+func (u *SQLUnitOfWork) RegisterSignature(signature domain.Signature) {
+	u.signatures = append(u.signatures, signature)
+}
+
+func (u *SQLUnitOfWork) Commit() error {
+	if u.finished {
+		return ErrUnitOfWorkFinished
+	}
+	u.finished = true
+	tx, err := u.db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for i, device := range u.devices {
+		if err := updateSQLDevice(tx, u.db.Dialect, device, &u.expectedCounters[i]); err != nil {
+			return err
+		}
+	}
+	for _, signature := range u.signatures {
+		if err := saveSQLSignature(tx, u.db.Dialect, signature); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (u *SQLUnitOfWork) Rollback() error {
+	u.finished = true
+	u.devices = nil
+	u.expectedCounters = nil
+	u.signatures = nil
+	return nil
+}
@@ -0,0 +1,123 @@
+package repositories
+
+import (
+	"errors"
+	"signing-service-challenge/domain"
+	"signing-service-challenge/persistence"
+)
+
+var ErrUnitOfWorkFinished = errors.New("unit of work already committed or rolled back")
+
+// UnitOfWork collects device and signature writes which have to be
+// committed together, e.g. a counter increment and the signature created with it.
+// Either all registered writes are committed or none is.
+type UnitOfWork interface {
+	// RegisterDevice registers the update of a stored device whose signature counter was
+	// advanced from expectedCounter. The commit fails with domain.ErrConcurrentModification
+	// if the stored version differs and with domain.ErrSignatureCounterConflict if the stored
+	// counter differs, so a counter is never handed out twice.
+	RegisterDevice(device domain.SignatureDevice, expectedCounter int)
+	RegisterSignature(domain.Signature)
+	Commit() error
+	// Rollback discards the registered writes. It is a no-op after Commit.
+	Rollback() error
+}
+
+// UnitOfWorkFactory starts a new UnitOfWork on the underlying storage.
+type UnitOfWorkFactory interface {
+	Begin() (UnitOfWork, error)
+}
+
+type InMemoryUnitOfWorkFactory struct {
+	db *persistence.InMemoryDB
+}
+
+func NewInMemoryUnitOfWorkFactory(db *persistence.InMemoryDB) *InMemoryUnitOfWorkFactory {
+	return &InMemoryUnitOfWorkFactory{
+		db: db,
+	}
+}
+
+func (f InMemoryUnitOfWorkFactory) Begin() (UnitOfWork, error) {
+	return &InMemoryUnitOfWork{db: f.db}, nil
+}
+
+// InMemoryUnitOfWork buffers the writes and applies them while holding the
+// device and the signature lock, so readers never observe half of a unit.
+type InMemoryUnitOfWork struct {
+	db               *persistence.InMemoryDB
+	devices          []domain.SignatureDevice
+	expectedCounters []int
+	signatures       []domain.Signature
+	finished         bool
+}
+
+func (u *InMemoryUnitOfWork) RegisterDevice(device domain.SignatureDevice, expectedCounter int) {
+	u.devices = append(u.devices, device)
+	u.expectedCounters = append(u.expectedCounters, expectedCounter)
+}
+
+func (u *InMemoryUnitOfWork) RegisterSignature(signature domain.Signature) {
+	u.signatures = append(u.signatures, signature)
+}
+
+func (u *InMemoryUnitOfWork) Commit() error {
+	if u.finished {
+		return ErrUnitOfWorkFinished
+	}
+	u.finished = true
+	// locks are always taken in this order
+	u.db.DevicesLock.Lock()
+	defer u.db.DevicesLock.Unlock()
+	u.db.SignaturesLock.Lock()
+	defer u.db.SignaturesLock.Unlock()
+	// validate everything before the first write
+	for i, device := range u.devices {
+		stored, ok := u.db.Devices[device.Id]
+		if !ok {
+			return domain.ErrDeviceNotFound
+		}
+		if device.FencingToken < stored.FencingToken {
+			return domain.ErrStaleFencingToken
+		}
+		// a changed counter is the more specific conflict
+		if stored.SignatureCounter != u.expectedCounters[i] {
+			return domain.ErrSignatureCounterConflict
+		}
+		if stored.Version != device.Version {
+			return domain.ErrConcurrentModification
+		}
+	}
+	for _, signature := range u.signatures {
+		if err := checkSignature(u.db, signature); err != nil {
+			return err
+		}
+	}
+	// the whole unit is one record of the journal, it is replayed completely or not at all
+	mutations := []persistence.Mutation{}
+	for i := range u.devices {
+		u.devices[i].Version++
+		mutations = append(mutations, persistence.Mutation{Kind: persistence.SaveDevice, Device: &u.devices[i]})
+	}
+	for i := range u.signatures {
+		mutations = append(mutations, persistence.Mutation{Kind: persistence.SaveSignature, Signature: &u.signatures[i]})
+	}
+	if err := journal(u.db, mutations...); err != nil {
+		return err
+	}
+	for _, device := range u.devices {
+		saveDevice(u.db, device)
+	}
+	for _, signature := range u.signatures {
+		saveSignature(u.db, signature)
+	}
+	return nil
+}
+
+func (u *InMemoryUnitOfWork) Rollback() error {
+	u.finished = true
+	u.devices = nil
+	u.expectedCounters = nil
+	u.signatures = nil
+	return nil
+}
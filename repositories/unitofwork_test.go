@@ -0,0 +1,105 @@
+package repositories
+
+import (
+	"signing-service-challenge/crypto"
+	"signing-service-challenge/domain"
+	"signing-service-challenge/persistence"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestUnitOfWorkCommitsDeviceAndSignatureTogether(t *testing.T) {
+	db := persistence.NewInMemoryDB()
+	devices := NewSignatureDeviceInMemoryRepository(db)
+	signatures := NewSignatureInMemoryRepository(db)
+	uow, _ := NewInMemoryUnitOfWorkFactory(db).Begin()
+
+	device := domain.NewSignatureDeviceWithoutKeys(uuid.NewString(), crypto.RSA, "Test Device")
+	devices.Save(*device)
+	device, _ = devices.GetById(device.Id)
+	device.SignatureCounter = 1
+	signature := domain.NewSignature(uuid.NewString(), "signature", "data", device.Id)
+	uow.RegisterDevice(*device, 0)
+	uow.RegisterSignature(*signature)
+	if stored, _ := devices.GetById(device.Id); stored.SignatureCounter != 0 || signatures.Count() != 0 {
+		t.Error("writes should not be visible before the commit")
+	}
+	if err := uow.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := devices.GetById(device.Id); stored.SignatureCounter != 1 || signatures.Count() != 1 {
+		t.Errorf("got counter %d and %d signatures, expected one each", stored.SignatureCounter, signatures.Count())
+	}
+	if err := uow.Commit(); err != ErrUnitOfWorkFinished {
+		t.Errorf("got error %v, expected %v", err, ErrUnitOfWorkFinished)
+	}
+}
+
+func TestUnitOfWorkFailedCommitWritesNothing(t *testing.T) {
+	db := persistence.NewInMemoryDB()
+	devices := NewSignatureDeviceInMemoryRepository(db)
+	signatures := NewSignatureInMemoryRepository(db)
+	device := domain.NewSignatureDeviceWithoutKeys(uuid.NewString(), crypto.RSA, "Test Device")
+	devices.Save(*device)
+	device, _ = devices.GetById(device.Id)
+	signatures.Save(*domain.NewSignature(uuid.NewString(), "signature", "data", device.Id))
+
+	uow, _ := NewInMemoryUnitOfWorkFactory(db).Begin()
+	advanced := *device
+	advanced.SignatureCounter = 1
+	uow.RegisterDevice(advanced, 0)
+	// counter 0 is already taken
+	uow.RegisterSignature(*domain.NewSignature(uuid.NewString(), "other", "data", device.Id))
+	if err := uow.Commit(); err != domain.ErrDuplicateSignature {
+		t.Fatalf("got error %v, expected %v", err, domain.ErrDuplicateSignature)
+	}
+	stored, _ := devices.GetById(device.Id)
+	if stored.SignatureCounter != 0 {
+		t.Error("device should not be updated if the signature cannot be stored")
+	}
+	if signatures.Count() != 1 {
+		t.Errorf("%d signatures stored, but %d expected", signatures.Count(), 1)
+	}
+}
+
+func TestUnitOfWorkRollbackDiscardsWrites(t *testing.T) {
+	db := persistence.NewInMemoryDB()
+	devices := NewSignatureDeviceInMemoryRepository(db)
+	uow, _ := NewInMemoryUnitOfWorkFactory(db).Begin()
+	device := domain.NewSignatureDeviceWithoutKeys(uuid.NewString(), crypto.RSA, "Test Device")
+	devices.Save(*device)
+	device, _ = devices.GetById(device.Id)
+	device.SignatureCounter = 1
+	uow.RegisterDevice(*device, 0)
+	uow.Rollback()
+	if err := uow.Commit(); err != ErrUnitOfWorkFinished {
+		t.Errorf("got error %v, expected %v", err, ErrUnitOfWorkFinished)
+	}
+	if stored, _ := devices.GetById(device.Id); stored.SignatureCounter != 0 {
+		t.Error("rolled back writes should not be stored")
+	}
+}
+
+func TestUnitOfWorkWithStaleCounterShouldFail(t *testing.T) {
+	db := persistence.NewInMemoryDB()
+	devices := NewSignatureDeviceInMemoryRepository(db)
+	device := domain.NewSignatureDeviceWithoutKeys(uuid.NewString(), crypto.RSA, "Test Device")
+	devices.Save(*device)
+	device, _ = devices.GetById(device.Id)
+
+	first, _ := NewInMemoryUnitOfWorkFactory(db).Begin()
+	second, _ := NewInMemoryUnitOfWorkFactory(db).Begin()
+	advanced := *device
+	advanced.SignatureCounter = 1
+	for _, uow := range []UnitOfWork{first, second} {
+		uow.RegisterDevice(advanced, 0)
+		uow.RegisterSignature(*domain.NewSignature(uuid.NewString(), "signature", "data", device.Id))
+	}
+	if err := first.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Commit(); err != domain.ErrSignatureCounterConflict {
+		t.Errorf("got error %v, expected %v", err, domain.ErrSignatureCounterConflict)
+	}
+}
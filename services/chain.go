@@ -0,0 +1,175 @@
+package services
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"signing-service-challenge/domain"
+	"signing-service-challenge/dto"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// parseSignedData splits data in the <signature_counter>_<data>_<last_signature> format.
+// The data itself may contain underscores, the base64 encoded last signature cannot.
+func parseSignedData(signedData string) (int, string, string, bool) {
+	prefix, rest, found := strings.Cut(signedData, "_")
+	if !found {
+		return 0, "", "", false
+	}
+	counter, err := strconv.Atoi(prefix)
+	if err != nil {
+		return 0, "", "", false
+	}
+	separator := strings.LastIndex(rest, "_")
+	if separator < 0 {
+		return 0, "", "", false
+	}
+	return counter, rest[:separator], rest[separator+1:], true
+}
+
+// parseSignatureCounter extracts the counter from data in the
+// <signature_counter>_<data>_<last_signature> format.
+func parseSignatureCounter(signedData string) (int, bool) {
+	counter, _, _, ok := parseSignedData(signedData)
+	return counter, ok
+}
+
+// parseKeyRolloverRecord returns the key version and the public key named by the
+// data of a key rollover record.
+func parseKeyRolloverRecord(data string) (int, []byte, bool) {
+	fields := strings.SplitN(data, ":", 3)
+	if len(fields) != 3 || fields[0] != domain.KeyRolloverPrefix {
+		return 0, nil, false
+	}
+	keyVersion, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, nil, false
+	}
+	publicKey, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return 0, nil, false
+	}
+	return keyVersion, publicKey, true
+}
+
+// VerifyChain walks all stored signatures of the device in counter order and checks
+// that the counters increase by one, that every record embeds the signature of its
+// predecessor (the base64 encoded device id for the first one) and that every
+// signature is valid for the key the device used at that counter.
+// Key rollover records must be signed exactly where the key history of the device
+// retires a key, and name the version and the public key which sign the records after it.
+// It stops at the first broken link. The chain is verified up to the counter of the
+// device when it was read, signatures created meanwhile are not part of the result.
+func (sd SignatureService) VerifyChain(deviceId string) (*dto.ChainVerificationResponse, error) {
+	device, err := sd.deviceRepository.GetById(deviceId)
+	if err != nil {
+		return nil, err
+	}
+	signatures, err := sd.repository.GetByDeviceId(deviceId)
+	if err != nil {
+		return nil, err
+	}
+	// signatures stored after the device was read are left to the next verification,
+	// the key history of the device read does not cover them yet
+	issued := signatures[:0]
+	for _, signature := range signatures {
+		if signature.Counter < device.SignatureCounter {
+			issued = append(issued, signature)
+		}
+	}
+	signatures = issued
+	sort.SliceStable(signatures, func(i, j int) bool {
+		return signatures[i].Counter < signatures[j].Counter
+	})
+
+	previousSignature := base64.StdEncoding.EncodeToString([]byte(device.Id))
+	for i, signature := range signatures {
+		if signature.Counter != i {
+			return brokenChain(i, signature.Counter, signature.Id,
+				fmt.Sprintf("expected signature counter %d, got %d", i, signature.Counter)), nil
+		}
+		if signature.PreviousSignature != previousSignature {
+			return brokenChain(i, signature.Counter, signature.Id,
+				"previous signature does not match the signature of the previous record"), nil
+		}
+		// the stored chain fields must be the ones covered by the signature
+		counter, data, lastSignature, ok := parseSignedData(signature.Data)
+		if !ok || counter != signature.Counter || lastSignature != signature.PreviousSignature {
+			return brokenChain(i, signature.Counter, signature.Id,
+				"signed data does not match the counter and previous signature of the record"), nil
+		}
+		_, publicKey := device.PublicKeyForCounter(signature.Counter)
+		verifier, err := verifierForPublicKey(*device, publicKey)
+		if err != nil {
+			return nil, err
+		}
+		sgn, err := base64.StdEncoding.DecodeString(signature.Signature)
+		if err != nil {
+			return brokenChain(i, signature.Counter, signature.Id, "signature is not base64 encoded"), nil
+		}
+		verified, err := verifier.Verify([]byte(signature.Data), sgn)
+		if err != nil {
+			return nil, err
+		}
+		if !verified {
+			return brokenChain(i, signature.Counter, signature.Id, "signature is invalid"), nil
+		}
+		if reason, ok := checkKeyRollover(*device, signature.Counter, data); !ok {
+			return brokenChain(i, signature.Counter, signature.Id, reason), nil
+		}
+		previousSignature = signature.Signature
+	}
+	// every counter the device has issued must have a stored signature
+	if len(signatures) != device.SignatureCounter || previousSignature != device.LastSignature {
+		return brokenChain(len(signatures), len(signatures), "",
+			fmt.Sprintf("device has issued %d signatures, but %d are stored", device.SignatureCounter, len(signatures))), nil
+	}
+	return &dto.ChainVerificationResponse{
+		Valid:              true,
+		VerifiedSignatures: len(signatures),
+	}, nil
+}
+
+// checkKeyRollover checks the data signed at the counter against the key history of
+// the device. A key retired at the counter must be followed by a rollover record to
+// the next key, and a rollover record is only valid where a key was retired.
+func checkKeyRollover(device domain.SignatureDevice, counter int, data string) (string, bool) {
+	retired := false
+	for _, version := range device.KeyHistory {
+		if version.LastCounter == counter {
+			retired = true
+		}
+	}
+	nextVersion, nextKey := device.PublicKeyForCounter(counter + 1)
+	if !strings.HasPrefix(data, domain.KeyRolloverPrefix) {
+		if retired {
+			return fmt.Sprintf("expected the key rollover record to key version %d", nextVersion), false
+		}
+		return "", true
+	}
+	if !retired {
+		return "unexpected key rollover record, no key was retired at this counter", false
+	}
+	keyVersion, publicKey, ok := parseKeyRolloverRecord(data)
+	if !ok {
+		return "malformed key rollover record", false
+	}
+	if keyVersion != nextVersion || !bytes.Equal(publicKey, nextKey) {
+		return fmt.Sprintf("key rollover record does not name key version %d which signs the following records", nextVersion), false
+	}
+	return "", true
+}
+
+func brokenChain(verified, counter int, signatureId, reason string) *dto.ChainVerificationResponse {
+	return &dto.ChainVerificationResponse{
+		Valid:              false,
+		VerifiedSignatures: verified,
+		BrokenLink: &dto.BrokenLinkResponse{
+			Counter:     counter,
+			SignatureId: signatureId,
+			Reason:      reason,
+		},
+	}
+}
@@ -0,0 +1,422 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"signing-service-challenge/crypto"
+	"signing-service-challenge/domain"
+	"signing-service-challenge/dto"
+	"signing-service-challenge/persistence"
+	"signing-service-challenge/repositories"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type chainFixture struct {
+	deviceService    *SignatureDeviceService
+	signatureService *SignatureService
+	signatures       repositories.SignatureRepository
+	deviceId         string
+}
+
+func newChainFixture(t *testing.T, algorithm string) chainFixture {
+	db := persistence.NewInMemoryDB()
+	deviceRepository := repositories.NewSignatureDeviceInMemoryRepository(db)
+	signatureRepository := repositories.NewSignatureInMemoryRepository(db)
+	fixture := chainFixture{
+		deviceService: NewSignatureDeviceService(
+			deviceRepository,
+			repositories.NewKeyExportInMemoryRepository(db),
+			repositories.NewInMemoryUnitOfWorkFactory(db),
+			locker,
+			keyWrapper,
+		),
+		signatureService: NewSignatureService(signatureRepository, deviceRepository),
+		signatures:       signatureRepository,
+		deviceId:         uuid.NewString(),
+	}
+	_, err := fixture.deviceService.CreateSignatureDevice(fixture.deviceId, algorithm, "Device", false, crypto.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fixture
+}
+
+// newSQLChainFixture is a chain fixture on an SQLite database.
+func newSQLChainFixture(t *testing.T, algorithm string) chainFixture {
+	db := openSQLiteDB(t)
+	deviceRepository := repositories.NewSignatureDeviceSQLRepository(db)
+	signatureRepository := repositories.NewSignatureSQLRepository(db)
+	fixture := chainFixture{
+		deviceService: NewSignatureDeviceService(
+			deviceRepository,
+			repositories.NewKeyExportSQLRepository(db),
+			repositories.NewSQLUnitOfWorkFactory(db),
+			locker,
+			keyWrapper,
+		),
+		signatureService: NewSignatureService(signatureRepository, deviceRepository),
+		signatures:       signatureRepository,
+		deviceId:         uuid.NewString(),
+	}
+	_, err := fixture.deviceService.CreateSignatureDevice(fixture.deviceId, algorithm, "Device", false, crypto.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fixture
+}
+
+// sign signs some data and returns the stored signature record.
+func (f chainFixture) sign(t *testing.T, data string) domain.Signature {
+	signed, err := f.deviceService.SignTransaction(context.Background(), f.deviceId, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := f.signatures.GetById(signed.SignatureId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *signature
+}
+
+func TestVerifyChainOfValidSignaturesAcrossKeyRotation(t *testing.T) {
+	fixture := newChainFixture(t, crypto.ECC)
+	fixture.sign(t, "first")
+	fixture.sign(t, "data_with_underscores")
+	_, err := fixture.deviceService.RotateKeyPair(fixture.deviceId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixture.sign(t, "after rotation")
+
+	result, err := fixture.signatureService.VerifyChain(fixture.deviceId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Valid || result.VerifiedSignatures != 4 {
+		t.Errorf("chain of 4 signatures should be valid, got %+v (%+v)", result, result.BrokenLink)
+	}
+}
+
+func TestVerifyChainOnSQLStorage(t *testing.T) {
+	fixture := newSQLChainFixture(t, crypto.RSA)
+	fixture.sign(t, "first")
+	_, err := fixture.deviceService.RotateKeyPair(fixture.deviceId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixture.sign(t, "after rotation")
+
+	result, err := fixture.signatureService.VerifyChain(fixture.deviceId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Valid || result.VerifiedSignatures != 3 {
+		t.Errorf("chain of 3 signatures should be valid, got %+v (%+v)", result, result.BrokenLink)
+	}
+}
+
+func TestVerifyChainDetectsTamperedData(t *testing.T) {
+	fixture := newChainFixture(t, crypto.ED25519)
+	fixture.sign(t, "first")
+	tampered := fixture.sign(t, "second")
+	fixture.sign(t, "third")
+	// stored signatures cannot be changed through the repository, the record is replaced
+	fixture.signatures.DeleteById(tampered.Id)
+	tampered.Data = tampered.Data[:2] + "tampered" + tampered.Data[8:]
+	fixture.signatures.Save(tampered)
+
+	result, _ := fixture.signatureService.VerifyChain(fixture.deviceId)
+	if result.Valid {
+		t.Fatal("chain with tampered data should be invalid")
+	}
+	if result.BrokenLink.Counter != 1 || result.BrokenLink.SignatureId != tampered.Id {
+		t.Errorf("expected broken link at counter 1, got %+v", result.BrokenLink)
+	}
+}
+
+func TestVerifyChainDetectsRecordNotMatchingSignedData(t *testing.T) {
+	fixture := newChainFixture(t, crypto.ECC)
+	fixture.sign(t, "first")
+	forged := fixture.sign(t, "second")
+	fixture.signatures.DeleteById(forged.Id)
+	forged.PreviousSignature = "forged"
+	fixture.signatures.Save(forged)
+
+	result, _ := fixture.signatureService.VerifyChain(fixture.deviceId)
+	if result.Valid || result.BrokenLink.Counter != 1 {
+		t.Errorf("expected broken link at counter 1, got %+v", result.BrokenLink)
+	}
+}
+
+func TestVerifyChainDetectsMissingSignature(t *testing.T) {
+	fixture := newChainFixture(t, crypto.ECC)
+	fixture.sign(t, "first")
+	missing := fixture.sign(t, "second")
+	fixture.sign(t, "third")
+	fixture.signatures.DeleteById(missing.Id)
+
+	result, _ := fixture.signatureService.VerifyChain(fixture.deviceId)
+	if result.Valid || result.BrokenLink.Counter != 2 {
+		t.Errorf("expected broken link at counter 2, got %+v", result.BrokenLink)
+	}
+}
+
+func TestVerifyChainDetectsCounterWithoutStoredSignature(t *testing.T) {
+	fixture := newChainFixture(t, crypto.ECC)
+	fixture.sign(t, "first")
+	// counter is advanced, but the signature is lost
+	lost := fixture.sign(t, "lost")
+	fixture.signatures.DeleteById(lost.Id)
+
+	result, _ := fixture.signatureService.VerifyChain(fixture.deviceId)
+	if result.Valid || result.BrokenLink.Counter != 1 {
+		t.Errorf("expected broken link at counter 1, got %+v", result.BrokenLink)
+	}
+}
+
+// readHookRepository runs a hook once after the first device has been read.
+type readHookRepository struct {
+	repositories.SignatureDeviceRepository
+	afterRead func()
+}
+
+func (r *readHookRepository) GetById(id string) (*domain.SignatureDevice, error) {
+	device, err := r.SignatureDeviceRepository.GetById(id)
+	if r.afterRead != nil {
+		afterRead := r.afterRead
+		r.afterRead = nil
+		afterRead()
+	}
+	return device, err
+}
+
+func TestVerifyChainIgnoresSignaturesCreatedWhileVerifying(t *testing.T) {
+	fixture := newChainFixture(t, crypto.ECC)
+	fixture.sign(t, "first")
+	fixture.sign(t, "second")
+	repository := &readHookRepository{SignatureDeviceRepository: fixture.deviceService.repository}
+	repository.afterRead = func() {
+		// a rotation and a signature committed between reading the device and its signatures
+		if _, err := fixture.deviceService.RotateKeyPair(fixture.deviceId); err != nil {
+			t.Fatal(err)
+		}
+		fixture.sign(t, "third")
+	}
+	signatureService := NewSignatureService(fixture.signatures, repository)
+
+	result, err := signatureService.VerifyChain(fixture.deviceId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Valid || result.VerifiedSignatures != 2 {
+		t.Errorf("chain of the 2 signatures issued when the device was read should be valid, got %+v (%+v)", result, result.BrokenLink)
+	}
+}
+
+func TestSignTransactionDoesNotAdvanceCounterIfSignatureCannotBeStored(t *testing.T) {
+	fixture := newChainFixture(t, crypto.ECC)
+	fixture.sign(t, "first")
+	// occupy the next position of the chain
+	fixture.signatures.Save(domain.Signature{Id: uuid.NewString(), SignedBy: fixture.deviceId, Counter: 1})
+
+	_, err := fixture.deviceService.SignTransaction(context.Background(), fixture.deviceId, "second")
+	if err != domain.ErrDuplicateSignature {
+		t.Fatalf("got error %v, expected %v", err, domain.ErrDuplicateSignature)
+	}
+	device, _ := fixture.deviceService.GetById(fixture.deviceId)
+	if device.SignatureCounter != 1 {
+		t.Errorf("counter should stay at 1 when the signature is not stored, got %d", device.SignatureCounter)
+	}
+}
+
+func TestVerifyChainForUnknownDeviceShouldFail(t *testing.T) {
+	fixture := newChainFixture(t, crypto.ECC)
+	if _, err := fixture.signatureService.VerifyChain(uuid.NewString()); err != domain.ErrDeviceNotFound {
+		t.Errorf("got error %v, expected %v", err, domain.ErrDeviceNotFound)
+	}
+}
+
+// racingRepository saves the device behind the back of the service after it
+// was read, like another instance signing with the same device.
+type racingRepository struct {
+	repositories.SignatureDeviceRepository
+	races int
+	reads int
+}
+
+func (r *racingRepository) GetById(id string) (*domain.SignatureDevice, error) {
+	r.reads++
+	device, err := r.SignatureDeviceRepository.GetById(id)
+	if err == nil && r.races > 0 {
+		r.races--
+		r.SignatureDeviceRepository.Save(*device)
+	}
+	return device, err
+}
+
+func TestSignTransactionRetriesAfterConcurrentModification(t *testing.T) {
+	fixture := newChainFixture(t, crypto.ECC)
+	racing := &racingRepository{SignatureDeviceRepository: fixture.deviceService.repository, races: 1}
+	fixture.deviceService.repository = racing
+	fixture.sign(t, "first")
+	fixture.sign(t, "second")
+	if racing.reads != 3 {
+		t.Errorf("device read %d times, expected %d", racing.reads, 3)
+	}
+	if result, err := fixture.signatureService.VerifyChain(fixture.deviceId); err != nil || !result.Valid {
+		t.Errorf("got %+v and error %v, expected a valid chain", result, err)
+	}
+}
+
+func TestSignTransactionGivesUpAfterRetryAttempts(t *testing.T) {
+	fixture := newChainFixture(t, crypto.ECC)
+	racing := &racingRepository{SignatureDeviceRepository: fixture.deviceService.repository, races: 10}
+	fixture.deviceService.repository = racing
+	fixture.deviceService.SetRetryPolicy(RetryPolicy{Attempts: 2})
+	_, err := fixture.deviceService.SignTransaction(context.Background(), fixture.deviceId, "data")
+	if !errors.Is(err, domain.ErrConcurrentModification) {
+		t.Errorf("got error %v, expected %v", err, domain.ErrConcurrentModification)
+	}
+	if racing.reads != 2 {
+		t.Errorf("device read %d times, expected %d", racing.reads, 2)
+	}
+}
+
+func TestSignBatchChainsSignaturesInOrder(t *testing.T) {
+	for _, fixture := range []chainFixture{newChainFixture(t, crypto.ED25519), newSQLChainFixture(t, crypto.ECC)} {
+		first := fixture.sign(t, "single")
+		batch, err := fixture.deviceService.SignBatch(context.Background(), fixture.deviceId, []string{"a", "b", "c"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		previous := first.Signature
+		for i, signed := range batch.Signatures {
+			if signed.Counter != i+1 || signed.PreviousSignature != previous {
+				t.Errorf("signature %d should take counter %d and link the previous signature, got %+v", i, i+1, signed)
+			}
+			if _, err := fixture.signatures.GetById(signed.SignatureId); err != nil {
+				t.Errorf("signature %d should be stored: %v", i, err)
+			}
+			previous = signed.Signature
+		}
+		device, _ := fixture.deviceService.GetById(fixture.deviceId)
+		if device.SignatureCounter != 4 || device.LastSignature != previous {
+			t.Errorf("got counter %d, expected the device to be advanced by the whole batch", device.SignatureCounter)
+		}
+		result, err := fixture.signatureService.VerifyChain(fixture.deviceId)
+		if err != nil || !result.Valid || result.VerifiedSignatures != 4 {
+			t.Errorf("chain of 4 signatures should be valid, got %+v (%v)", result, err)
+		}
+	}
+}
+
+func TestSignBatchStoresNothingIfOneSignatureFails(t *testing.T) {
+	for _, fixture := range []chainFixture{newChainFixture(t, crypto.ED25519), newSQLChainFixture(t, crypto.ED25519)} {
+		// the third signature of the batch collides with a stored one
+		taken := domain.NewSignature(uuid.NewString(), "signature", "data", fixture.deviceId)
+		taken.Counter = 2
+		if err := fixture.signatures.Save(*taken); err != nil {
+			t.Fatal(err)
+		}
+		_, err := fixture.deviceService.SignBatch(context.Background(), fixture.deviceId, []string{"a", "b", "c"})
+		if !errors.Is(err, domain.ErrDuplicateSignature) {
+			t.Errorf("got error %v, expected %v", err, domain.ErrDuplicateSignature)
+		}
+		stored, _ := fixture.signatures.GetByDeviceId(fixture.deviceId)
+		device, _ := fixture.deviceService.GetById(fixture.deviceId)
+		if len(stored) != 1 || device.SignatureCounter != 0 {
+			t.Errorf("failed batch should store nothing, got %d signatures and counter %d", len(stored), device.SignatureCounter)
+		}
+	}
+}
+
+func TestSignTransactionRefusesForgedKeyRollover(t *testing.T) {
+	fixture := newChainFixture(t, crypto.ED25519)
+	fixture.sign(t, "first")
+	forged := KeyRolloverRecord(2, []byte("public key of the client"))
+	if _, err := fixture.deviceService.SignTransaction(context.Background(), fixture.deviceId, forged); !errors.Is(err, domain.ErrReservedData) {
+		t.Errorf("got error %v, expected %v", err, domain.ErrReservedData)
+	}
+	if _, err := fixture.deviceService.SignBatch(context.Background(), fixture.deviceId, []string{"a", forged}); !errors.Is(err, domain.ErrReservedData) {
+		t.Errorf("got error %v, expected %v for a batch", err, domain.ErrReservedData)
+	}
+	jobs := NewSigningJobs(fixture.deviceService, SigningJobsOptions{Workers: 1, DeviceQueueSize: 10, MaxQueued: 10, Retention: time.Minute, MaxRetained: 10})
+	defer jobs.Close()
+	job, err := jobs.Submit(fixture.deviceId, forged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job := waitForJob(t, jobs, job.Id); job.Status != dto.JobFailed || !errors.Is(job.Err, domain.ErrReservedData) {
+		t.Errorf("job should fail with %v, got %s (%v)", domain.ErrReservedData, job.Status, job.Err)
+	}
+	device, _ := fixture.deviceService.GetById(fixture.deviceId)
+	if device.SignatureCounter != 1 || device.KeyVersion != 1 {
+		t.Errorf("forged rollover should not be signed, got counter %d and key version %d", device.SignatureCounter, device.KeyVersion)
+	}
+	// the prefix is only reserved at the start of the data
+	fixture.sign(t, "mentions "+forged)
+}
+
+func TestVerifyChainDetectsForgedKeyRollover(t *testing.T) {
+	fixture := newChainFixture(t, crypto.ED25519)
+	fixture.sign(t, "first")
+	// a rollover record signed like client data, as before such data was refused
+	device, _ := fixture.deviceService.repository.GetById(fixture.deviceId)
+	signer, err := fixture.deviceService.signerForDevice(*device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := signChained(device, signer, KeyRolloverRecord(2, []byte("public key of the client")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fixture.deviceService.commitSignatures(*device, forged); err != nil {
+		t.Fatal(err)
+	}
+	fixture.sign(t, "after the forged rollover")
+
+	result, err := fixture.signatureService.VerifyChain(fixture.deviceId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Valid || result.BrokenLink.Counter != 1 || result.BrokenLink.SignatureId != forged.SignatureId {
+		t.Errorf("expected broken link at the forged rollover at counter 1, got %+v", result.BrokenLink)
+	}
+}
+
+func TestVerifyChainDetectsKeyRolloverNotMatchingKeyHistory(t *testing.T) {
+	fixture := newChainFixture(t, crypto.ED25519)
+	fixture.sign(t, "first")
+	if _, err := fixture.deviceService.RotateKeyPair(fixture.deviceId); err != nil {
+		t.Fatal(err)
+	}
+	fixture.sign(t, "after rotation")
+	// the key history names another key than the one bound by the rollover record
+	device, _ := fixture.deviceService.repository.GetById(fixture.deviceId)
+	other, _ := fixture.deviceService.CreateSignatureDevice(uuid.NewString(), crypto.ED25519, "Device", false, crypto.Options{})
+	device.PublicKey = []byte(other.PublicKey)
+	stale := &chainDeviceRepository{SignatureDeviceRepository: fixture.deviceService.repository, device: device}
+	service := NewSignatureService(fixture.signatures, stale)
+
+	result, err := service.VerifyChain(fixture.deviceId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Valid || result.BrokenLink.Counter != 1 {
+		t.Errorf("expected broken link at the rollover at counter 1, got %+v", result.BrokenLink)
+	}
+}
+
+// chainDeviceRepository returns the device it holds instead of the stored one.
+type chainDeviceRepository struct {
+	repositories.SignatureDeviceRepository
+	device *domain.SignatureDevice
+}
+
+func (r *chainDeviceRepository) GetById(id string) (*domain.SignatureDevice, error) {
+	return r.device, nil
+}
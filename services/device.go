@@ -1,65 +1,375 @@
 package services
 
 import (
+	"context"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"signing-service-challenge/crypto"
 	"signing-service-challenge/domain"
 	"signing-service-challenge/dto"
 	"signing-service-challenge/lockers"
 	"signing-service-challenge/repositories"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
 )
 
 type SignatureDeviceService struct {
-	repository repositories.SignatureDeviceRepository
+	repository       repositories.SignatureDeviceRepository
+	exportRepository repositories.KeyExportRepository
+	// counter updates and the created signatures are committed together
+	unitOfWork repositories.UnitOfWorkFactory
 	locker     lockers.DeviceLocker
+	// private keys are stored wrapped under the key-encryption key
+	// and unwrapped only for signing and verification
+	kek *keyEncryptionKey
+	// signing is retried if the device was modified concurrently
+	retryPolicy RetryPolicy
+	// the longest wait for a device lock before a request is turned away
+	lockTimeout time.Duration
+	// parsed signers of the recently used devices
+	signers *SignerCache
+	// pre-generated key pairs, nil if keys are always generated on demand
+	keys *KeyPool
+	// the number of devices RewrapKeys commits together
+	rewrapBatchSize int
+}
+
+const DefaultLockTimeout = 5 * time.Second
+
+// DefaultRewrapBatchSize keeps the commit of a batch of rewrapped devices well
+// below the record length limit of the write-ahead log.
+const DefaultRewrapBatchSize = 500
+
+// keyEncryptionKey is shared by all copies of the service, so a rewrap
+// is visible everywhere. The lock is held exclusively while a batch of keys is rewrapped.
+type keyEncryptionKey struct {
+	sync.RWMutex
+	// new private keys are wrapped under the current key
+	wrapper *crypto.KeyWrapper
+	// all known keys by id, retired keys only unwrap the keys of devices
+	// which have not been rewrapped yet
+	wrappers map[string]*crypto.KeyWrapper
 }
 
-func NewSignatureDeviceService(repository repositories.SignatureDeviceRepository, locker lockers.DeviceLocker) *SignatureDeviceService {
+// forDevice returns the key the private key of the device is wrapped under.
+func (k *keyEncryptionKey) forDevice(device domain.SignatureDevice) (*crypto.KeyWrapper, error) {
+	wrapper, ok := k.wrappers[device.KeyEncryptionKeyId]
+	if !ok {
+		return nil, domain.ErrUnknownKeyEncryptionKey
+	}
+	return wrapper, nil
+}
+
+func NewSignatureDeviceService(
+	repository repositories.SignatureDeviceRepository,
+	exportRepository repositories.KeyExportRepository,
+	unitOfWork repositories.UnitOfWorkFactory,
+	locker lockers.DeviceLocker,
+	keyWrapper *crypto.KeyWrapper,
+) *SignatureDeviceService {
 	return &SignatureDeviceService{
-		repository: repository,
-		locker:     locker,
+		repository:       repository,
+		exportRepository: exportRepository,
+		unitOfWork:       unitOfWork,
+		locker:           locker,
+		kek: &keyEncryptionKey{
+			wrapper:  keyWrapper,
+			wrappers: map[string]*crypto.KeyWrapper{keyWrapper.Id(): keyWrapper},
+		},
+		retryPolicy:     DefaultRetryPolicy,
+		lockTimeout:     DefaultLockTimeout,
+		signers:         NewSignerCache(DefaultSignerCacheSize),
+		rewrapBatchSize: DefaultRewrapBatchSize,
 	}
 }
 
-func (sd *SignatureDeviceService) CreateSignatureDevice(id, algorithm, label string) (*dto.CreateSignatureDeviceResponse, error) {
-	device := domain.NewSignatureDeviceWithoutKeys(id, algorithm, label)
-	kpHandler, err := crypto.GenerateKeyPairHandler(algorithm)
+// SetRetryPolicy replaces the DefaultRetryPolicy of signing.
+func (sd *SignatureDeviceService) SetRetryPolicy(policy RetryPolicy) {
+	sd.retryPolicy = policy
+}
+
+// AddRetiredKeyEncryptionKeys lets the service unwrap private keys wrapped under
+// earlier key-encryption keys until RewrapKeys has moved them to the current one.
+func (sd *SignatureDeviceService) AddRetiredKeyEncryptionKeys(wrappers ...*crypto.KeyWrapper) {
+	sd.kek.Lock()
+	defer sd.kek.Unlock()
+	for _, wrapper := range wrappers {
+		sd.kek.wrappers[wrapper.Id()] = wrapper
+	}
+}
+
+// SetRewrapBatchSize replaces the DefaultRewrapBatchSize of RewrapKeys.
+func (sd *SignatureDeviceService) SetRewrapBatchSize(size int) {
+	sd.rewrapBatchSize = size
+}
+
+// SetSignerCache replaces the signer cache of DefaultSignerCacheSize.
+func (sd *SignatureDeviceService) SetSignerCache(cache *SignerCache) {
+	sd.signers = cache
+}
+
+// SetKeyPool lets device creation and key rotation take their key pairs from the pool.
+func (sd *SignatureDeviceService) SetKeyPool(pool *KeyPool) {
+	sd.keys = pool
+}
+
+// Metrics returns the counters of the signer cache and the key pool.
+func (sd *SignatureDeviceService) Metrics() dto.MetricsResponse {
+	metrics := dto.MetricsResponse{
+		SignerCache: sd.signers.Metrics(),
+		KeyPool:     []dto.KeyPoolMetrics{},
+	}
+	if sd.keys != nil {
+		metrics.KeyPool = sd.keys.Metrics()
+	}
+	return metrics
+}
+
+// SetLockTimeout replaces the DefaultLockTimeout.
+func (sd *SignatureDeviceService) SetLockTimeout(timeout time.Duration) {
+	sd.lockTimeout = timeout
+}
+
+// lockDevice waits for the device lock until the lock timeout has passed or the
+// context is done, e.g. because the client has gone away.
+func (sd *SignatureDeviceService) lockDevice(ctx context.Context, deviceId string) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, sd.lockTimeout)
+	defer cancel()
+	token, err := sd.locker.LockContext(ctx, deviceId)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return token, domain.ErrLockTimeout
+	}
+	return token, err
+}
+
+func (sd *SignatureDeviceService) CreateSignatureDevice(id, algorithm, label string, exportable bool, options crypto.Options) (*dto.CreateSignatureDeviceResponse, error) {
+	options, err := crypto.NormalizeOptions(algorithm, options)
+	if err != nil {
+		return nil, err
+	}
+	device := newSignatureDevice(id, algorithm, label, exportable, options)
+	kpHandler, err := crypto.GenerateKeyPairHandler(algorithm, options)
 	if err != nil {
 		return nil, err
 	}
-	privateKey, publicKey, err := kpHandler.GenerateKeyPair()
+	privateKey, publicKey, err := sd.generateKeyPair(kpHandler, algorithm, options)
 	if err != nil {
 		return nil, err
 	}
 	kpHandler.AttachKeyPair(device, privateKey, publicKey)
-	sd.repository.Save(*device)
+	return sd.storeNewDevice(device)
+}
+
+// generateKeyPair takes a key pair from the key pool and only generates one
+// if the pool is empty.
+func (sd *SignatureDeviceService) generateKeyPair(kpHandler crypto.KeyPairHandler, algorithm string, options crypto.Options) ([]byte, []byte, error) {
+	if sd.keys != nil {
+		if privateKey, publicKey, ok := sd.keys.Take(algorithm, options); ok {
+			return privateKey, publicKey, nil
+		}
+	}
+	return kpHandler.GenerateKeyPair()
+}
+
+// ImportSignatureDevice creates a device for an existing PEM encoded private key.
+// The algorithm, the RSA key size and the curve are derived from the key, only
+// padding and hash can be chosen freely.
+func (sd *SignatureDeviceService) ImportSignatureDevice(id, label string, exportable bool, privateKey []byte, options crypto.Options) (*dto.CreateSignatureDeviceResponse, error) {
+	imported, err := crypto.ImportKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	if (options.KeySize != 0 && options.KeySize != imported.Options.KeySize) ||
+		(options.Curve != "" && options.Curve != imported.Options.Curve) {
+		return nil, fmt.Errorf("%w: parameters do not match the imported key", crypto.ErrInvalidOptions)
+	}
+	options.KeySize = imported.Options.KeySize
+	options.Curve = imported.Options.Curve
+	options, err = crypto.NormalizeOptions(imported.Algorithm, options)
+	if err != nil {
+		return nil, err
+	}
+	device := newSignatureDevice(id, imported.Algorithm, label, exportable, options)
+	kpHandler, err := crypto.GenerateKeyPairHandler(imported.Algorithm, options)
+	if err != nil {
+		return nil, err
+	}
+	_, err = kpHandler.AttachKeyPair(device, imported.PrivateKey, imported.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return sd.storeNewDevice(device)
+}
+
+func newSignatureDevice(id, algorithm, label string, exportable bool, options crypto.Options) *domain.SignatureDevice {
+	device := domain.NewSignatureDeviceWithoutKeys(id, algorithm, label)
+	device.KeySize = options.KeySize
+	device.Padding = options.Padding
+	device.Curve = options.Curve
+	device.Hash = options.Hash
+	device.Exportable = exportable
+	device.CreatedAt = time.Now().UTC()
+	return device
+}
+
+// ActivationOnCreation is the reason recorded for the activation of a new device.
+const ActivationOnCreation = "key pair attached on creation"
+
+// storeNewDevice wraps the freshly attached private key under the key-encryption key
+// and saves the device.
+func (sd *SignatureDeviceService) storeNewDevice(device *domain.SignatureDevice) (*dto.CreateSignatureDeviceResponse, error) {
+	sd.kek.RLock()
+	defer sd.kek.RUnlock()
+	wrappedKey, err := sd.kek.wrapper.Wrap(device.Id, device.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	device.PrivateKey = wrappedKey
+	device.KeyEncryptionKeyId = sd.kek.wrapper.Id()
+	// the device is ready to sign as soon as its key pair is stored
+	err = device.Transition(domain.StateActive, ActivationOnCreation, device.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	err = sd.repository.Save(*device)
+	if err != nil {
+		return nil, err
+	}
 	response := dto.ConvertSignatureDeviceToCreateResponse(*device)
 	return &response, nil
 }
 
-func (sd *SignatureDeviceService) SignTransaction(deviceId string, data string) (*dto.SignatureResponse, error) {
-	sd.locker.Lock(deviceId)
-	defer sd.locker.Unlock(deviceId)
-	// time.Sleep(1 * time.Millisecond)
-	device, err := sd.repository.GetById(deviceId)
+func (sd *SignatureDeviceService) SignTransaction(ctx context.Context, deviceId string, data string) (*dto.SignatureResponse, error) {
+	signed, err := sd.signChain(ctx, deviceId, []string{data})
 	if err != nil {
-		return nil, domain.ErrDeviceNotFound
+		return nil, err
 	}
-	keyHandler, err := crypto.GenerateKeyPairHandler(device.Algorithm)
+	return signed[0], nil
+}
+
+// SignBatch signs the payloads in order as consecutive links of the signature chain,
+// under one lock of the device and with one signer. The batch is atomic: either all
+// signatures are stored and the counter is advanced by the size of the batch, or,
+// if any payload fails, nothing is stored and the device is left unchanged.
+func (sd *SignatureDeviceService) SignBatch(ctx context.Context, deviceId string, payloads []string) (*dto.BatchSignatureResponse, error) {
+	signed, err := sd.signChain(ctx, deviceId, payloads)
 	if err != nil {
 		return nil, err
 	}
-	primaryKey, err := keyHandler.Unmarshal(device.PrivateKey)
+	response := &dto.BatchSignatureResponse{Signatures: []dto.SignatureResponse{}}
+	for _, signature := range signed {
+		response.Signatures = append(response.Signatures, *signature)
+	}
+	return response, nil
+}
+
+// signChain signs the payloads in order and commits all signatures together.
+func (sd *SignatureDeviceService) signChain(ctx context.Context, deviceId string, payloads []string) ([]*dto.SignatureResponse, error) {
+	// the asynchronous jobs reach this without the validation of the API
+	for _, data := range payloads {
+		if err := domain.CheckPayload(data); err != nil {
+			return nil, err
+		}
+	}
+	// the KEK lock is taken before the device lock, RewrapKeys relies on this order
+	sd.kek.RLock()
+	defer sd.kek.RUnlock()
+	token, err := sd.lockDevice(ctx, deviceId)
 	if err != nil {
 		return nil, err
 	}
-	signer, err := crypto.GenerateSigner(primaryKey)
+	defer sd.locker.Unlock(deviceId)
+	// the locker may only serialize this instance, if another writer has advanced
+	// the device meanwhile the data is signed again with the new counter
+	var signed []*dto.SignatureResponse
+	err = sd.retryPolicy.Do(func() error {
+		device, err := sd.repository.GetById(deviceId)
+		if err != nil {
+			return domain.ErrDeviceNotFound
+		}
+		if err := device.CheckActive(); err != nil {
+			return err
+		}
+		fence(device, token)
+		signer, err := sd.signerForDevice(*device)
+		if err != nil {
+			return err
+		}
+		signed = make([]*dto.SignatureResponse, 0, len(payloads))
+		for _, data := range payloads {
+			signature, err := signChained(device, signer, data)
+			if err != nil {
+				return err
+			}
+			signed = append(signed, signature)
+		}
+		return sd.commitSignatures(*device, signed...)
+	})
 	if err != nil {
 		return nil, err
 	}
+	return signed, nil
+}
+
+// fence marks the device as written under the lock with the token, the repository
+// then refuses the write if the lock was taken over by another holder meanwhile.
+func fence(device *domain.SignatureDevice, token int64) {
+	if token != lockers.NoFencingToken {
+		device.FencingToken = token
+	}
+}
+
+// commitSignatures stores the advanced device together with the records of the
+// consecutive signatures it has created. If any write fails, none is applied.
+func (sd *SignatureDeviceService) commitSignatures(device domain.SignatureDevice, signed ...*dto.SignatureResponse) error {
+	uow, err := sd.unitOfWork.Begin()
+	if err != nil {
+		return err
+	}
+	// the first record takes the counter the device was advanced from
+	uow.RegisterDevice(device, signed[0].Counter)
+	records := make([]domain.Signature, 0, len(signed))
+	for _, signature := range signed {
+		record := newSignatureRecord(device.Id, *signature)
+		uow.RegisterSignature(record)
+		records = append(records, record)
+	}
+	err = uow.Commit()
+	if err != nil {
+		uow.Rollback()
+		return err
+	}
+	for i, record := range records {
+		signed[i].SignatureId = record.Id
+	}
+	return nil
+}
+
+// newSignatureRecord builds the stored record of a signature created by the device.
+func newSignatureRecord(deviceId string, signed dto.SignatureResponse) domain.Signature {
+	return domain.Signature{
+		Id:                uuid.NewString(),
+		Signature:         signed.Signature,
+		Data:              signed.SignedData,
+		SignedBy:          deviceId,
+		Counter:           signed.Counter,
+		PreviousSignature: signed.PreviousSignature,
+		CreatedAt:         time.Now().UTC(),
+		Algorithm:         signed.Algorithm,
+	}
+}
+
+// signChained signs the data as the next link of the device's signature chain
+// and advances the counter and the last signature of the device.
+func signChained(device *domain.SignatureDevice, signer crypto.Signer, data string) (*dto.SignatureResponse, error) {
 	//<signature_counter>_<data_to_be_signed>_<last_signature_base64_encoded>
-	securedDataToBeSigned := fmt.Sprintf("%d_%s_%s", device.SignatureCounter, data, device.LastSignature)
+	counter := device.SignatureCounter
+	previousSignature := device.LastSignature
+	securedDataToBeSigned := fmt.Sprintf("%d_%s_%s", counter, data, previousSignature)
 	sign, err := signer.Sign([]byte(securedDataToBeSigned))
 	if err != nil {
 		return nil, err
@@ -67,40 +377,416 @@ func (sd *SignatureDeviceService) SignTransaction(deviceId string, data string)
 	signatureEncoded := base64.StdEncoding.EncodeToString(sign)
 	device.LastSignature = signatureEncoded
 	device.SignatureCounter = device.SignatureCounter + 1
-	err = sd.repository.Save(*device)
-	if err != nil {
-		return nil, err
-	}
 	return &dto.SignatureResponse{
-		Signature:  signatureEncoded,
-		SignedData: securedDataToBeSigned,
+		Signature:         signatureEncoded,
+		SignedData:        securedDataToBeSigned,
+		Counter:           counter,
+		PreviousSignature: previousSignature,
+		Algorithm:         device.Algorithm,
 	}, nil
 }
 
+// Verify checks the signature with the public key which was current when the
+// signature counter prefixed to the data was signed, so signatures of rotated
+// keys remain verifiable.
 func (sd *SignatureDeviceService) Verify(deviceId, signature, data string) (dto.VerificationResponse, error) {
-	sd.locker.Lock(deviceId)
-	defer sd.locker.Unlock(deviceId)
 	device, err := sd.repository.GetById(deviceId)
 	if err != nil {
 		return dto.ConvertVerificationToResponse(false), err
 	}
-	keyHandler, err := crypto.GenerateKeyPairHandler(device.Algorithm)
-	primaryKey, err := keyHandler.Unmarshal(device.PrivateKey)
-	if err != nil {
-		return dto.ConvertVerificationToResponse(false), err
+	publicKey := device.PublicKey
+	if counter, ok := parseSignatureCounter(data); ok {
+		_, publicKey = device.PublicKeyForCounter(counter)
 	}
-	signer, err := crypto.GenerateSigner(primaryKey)
+	verifier, err := verifierForPublicKey(*device, publicKey)
 	if err != nil {
 		return dto.ConvertVerificationToResponse(false), err
 	}
 	sgn, err := base64.StdEncoding.DecodeString(signature)
-	verified, err := signer.Verify([]byte(data), sgn)
+	if err != nil {
+		return dto.ConvertVerificationToResponse(false), nil
+	}
+	verified, err := verifier.Verify([]byte(data), sgn)
 	if err != nil {
 		return dto.ConvertVerificationToResponse(false), err
 	}
 	return dto.ConvertVerificationToResponse(verified), nil
 }
 
+// RotateKeyPair replaces the key pair of a device. The old key signs a key rollover
+// record binding the new public key into the signature chain; the record takes the
+// next counter, so the chain continues unbroken. The old public key is kept in the
+// key history of the device. Rotation does not queue up behind signing requests,
+// it fails with domain.ErrDeviceBusy while the device is locked.
+func (sd *SignatureDeviceService) RotateKeyPair(deviceId string) (*dto.KeyRotationResponse, error) {
+	sd.kek.RLock()
+	defer sd.kek.RUnlock()
+	token, ok, err := sd.locker.TryLock(deviceId)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, domain.ErrDeviceBusy
+	}
+	defer sd.locker.Unlock(deviceId)
+	device, err := sd.repository.GetById(deviceId)
+	if err != nil {
+		return nil, err
+	}
+	// the rollover record is signed like any other record
+	if err := device.CheckActive(); err != nil {
+		return nil, err
+	}
+	fence(device, token)
+	oldSigner, err := sd.signerForDevice(*device)
+	if err != nil {
+		return nil, err
+	}
+	options := crypto.OptionsFromDevice(*device)
+	kpHandler, err := crypto.GenerateKeyPairHandler(device.Algorithm, options)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, publicKey, err := sd.generateKeyPair(kpHandler, device.Algorithm, options)
+	if err != nil {
+		return nil, err
+	}
+	wrappedKey, err := sd.kek.wrapper.Wrap(device.Id, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	// the new key is wrapped under the current key-encryption key, even if the old one was retired
+	device.KeyEncryptionKeyId = sd.kek.wrapper.Id()
+	rolloverCounter := device.SignatureCounter
+	rollover := KeyRolloverRecord(device.KeyVersion+1, publicKey)
+	signed, err := signChained(device, oldSigner, rollover)
+	if err != nil {
+		return nil, err
+	}
+	device.RotateKeyPair(wrappedKey, publicKey, rolloverCounter, time.Now().UTC())
+	err = sd.commitSignatures(*device, signed)
+	if err != nil {
+		return nil, err
+	}
+	// the retired key must not sign anymore
+	sd.signers.Invalidate(device.Id)
+	return &dto.KeyRotationResponse{
+		KeyVersion:        device.KeyVersion,
+		PublicKey:         string(publicKey),
+		SignatureResponse: *signed,
+	}, nil
+}
+
+// TransitionState moves the device to another lifecycle state and records the reason.
+// The device lock is taken like for signing, so no signature is created with a
+// device after it has been suspended or decommissioned. Decommissioning destroys the
+// private key for good, the public keys remain for verification. The file storage
+// compacts its write-ahead log right away, so no earlier version of the device with the
+// wrapped key is kept either. What the storage cannot remove is left wrapped under the
+// key-encryption key: freed disk blocks are not overwritten, and SQL databases keep old
+// row versions in their own logs until they are vacuumed or recycled.
+func (sd *SignatureDeviceService) TransitionState(ctx context.Context, deviceId, state, reason string) (*dto.SignatureDeviceResponse, error) {
+	sd.kek.RLock()
+	defer sd.kek.RUnlock()
+	token, err := sd.lockDevice(ctx, deviceId)
+	if err != nil {
+		return nil, err
+	}
+	defer sd.locker.Unlock(deviceId)
+	var device *domain.SignatureDevice
+	err = sd.retryPolicy.Do(func() error {
+		device, err = sd.repository.GetById(deviceId)
+		if err != nil {
+			return err
+		}
+		fence(device, token)
+		if err := device.Transition(state, reason, time.Now().UTC()); err != nil {
+			return err
+		}
+		return sd.repository.Save(*device)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the device was stored with the next version
+	device.Version++
+	if state == domain.StateDecommissioned {
+		// the destroyed key must not stay in memory either
+		sd.signers.Invalidate(deviceId)
+	}
+	response := dto.ConvertSignatureDeviceToResponse(*device)
+	return &response, nil
+}
+
+// UpdateDevice changes the label and the tags of a device, counter and key material are
+// left alone. The device lock keeps signing of this instance from interleaving, the version
+// check of the repository protects against writers of other instances. If the request
+// expects a version, the update fails with domain.ErrVersionMismatch on any other version.
+func (sd *SignatureDeviceService) UpdateDevice(ctx context.Context, deviceId string, request dto.UpdateDeviceRequest) (*dto.SignatureDeviceResponse, error) {
+	// RewrapKeys expects the devices to stay unchanged while it holds the KEK lock
+	sd.kek.RLock()
+	defer sd.kek.RUnlock()
+	token, err := sd.lockDevice(ctx, deviceId)
+	if err != nil {
+		return nil, err
+	}
+	defer sd.locker.Unlock(deviceId)
+	var device *domain.SignatureDevice
+	err = sd.retryPolicy.Do(func() error {
+		device, err = sd.repository.GetById(deviceId)
+		if err != nil {
+			return err
+		}
+		if request.ExpectedVersions != nil && !hasVersion(request.ExpectedVersions, device.Version) {
+			return domain.ErrVersionMismatch
+		}
+		fence(device, token)
+		if err := device.UpdateMetadata(request.Label, request.Tags); err != nil {
+			return err
+		}
+		return sd.repository.Save(*device)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the device was stored with the next version
+	device.Version++
+	response := dto.ConvertSignatureDeviceToResponse(*device)
+	return &response, nil
+}
+
+func hasVersion(versions []int, version int) bool {
+	for _, expected := range versions {
+		if expected == version {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyRolloverRecord builds the data of a key rollover record:
+// KEY_ROLLOVER:<new_key_version>:<new_public_key_base64_encoded>
+func KeyRolloverRecord(keyVersion int, publicKey []byte) string {
+	return fmt.Sprintf("%s:%d:%s", domain.KeyRolloverPrefix, keyVersion, base64.StdEncoding.EncodeToString(publicKey))
+}
+
+func verifierForPublicKey(device domain.SignatureDevice, publicKey []byte) (crypto.Verifier, error) {
+	options := crypto.OptionsFromDevice(device)
+	keyHandler, err := crypto.GenerateKeyPairHandler(device.Algorithm, options)
+	if err != nil {
+		return nil, err
+	}
+	key, err := keyHandler.UnmarshalPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.GenerateVerifier(key, options)
+}
+
+// signerForDevice unwraps the private key of the device and builds a Signer from it.
+// The signer is cached, so the plain key stays in memory until it is evicted or rotated.
+// The caller must hold the KEK read lock.
+func (sd *SignatureDeviceService) signerForDevice(device domain.SignatureDevice) (crypto.Signer, error) {
+	wrapper, err := sd.kek.forDevice(device)
+	if err != nil {
+		return nil, err
+	}
+	if signer, ok := sd.signers.Get(device); ok {
+		return signer, nil
+	}
+	signer, err := parseSigner(wrapper, device)
+	if err != nil {
+		return nil, err
+	}
+	sd.signers.Put(device, signer)
+	return signer, nil
+}
+
+func parseSigner(wrapper *crypto.KeyWrapper, device domain.SignatureDevice) (crypto.Signer, error) {
+	privateKey, err := wrapper.Unwrap(device.Id, device.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	options := crypto.OptionsFromDevice(device)
+	keyHandler, err := crypto.GenerateKeyPairHandler(device.Algorithm, options)
+	if err != nil {
+		return nil, err
+	}
+	primaryKey, err := keyHandler.Unmarshal(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.GenerateSigner(primaryKey, options)
+}
+
+// ExportPrivateKey returns the private key of an exportable device encrypted for the
+// holder of the recipient public key. Every export is recorded together with the caller
+// before the key is returned.
+func (sd *SignatureDeviceService) ExportPrivateKey(deviceId string, recipientPublicKey []byte, exportedBy string) (*dto.ExportKeyResponse, error) {
+	sd.kek.RLock()
+	defer sd.kek.RUnlock()
+	device, err := sd.repository.GetById(deviceId)
+	if err != nil {
+		return nil, err
+	}
+	if !device.Exportable {
+		return nil, domain.ErrKeyNotExportable
+	}
+	if device.State == domain.StateDecommissioned {
+		return nil, domain.ErrKeyDestroyed
+	}
+	wrapper, err := sd.kek.forDevice(*device)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := wrapper.Unwrap(device.Id, device.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	exported, err := crypto.ExportKey(recipientPublicKey, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	export := domain.NewKeyExport(uuid.NewString(), device.Id, exported.Scheme, exported.RecipientFingerprint, exportedBy, time.Now().UTC())
+	err = sd.exportRepository.Save(*export)
+	if err != nil {
+		return nil, err
+	}
+	response := dto.ConvertExportedKeyToResponse(export.Id, *exported)
+	return &response, nil
+}
+
+// GetKeyExports returns the export audit trail of a device.
+func (sd *SignatureDeviceService) GetKeyExports(deviceId string) ([]dto.KeyExportResponse, error) {
+	_, err := sd.repository.GetById(deviceId)
+	if err != nil {
+		return nil, err
+	}
+	exports, err := sd.exportRepository.GetByDeviceId(deviceId)
+	if err != nil {
+		return nil, err
+	}
+	response := []dto.KeyExportResponse{}
+	for _, export := range exports {
+		response = append(response, dto.ConvertKeyExportToResponse(export))
+	}
+	return response, nil
+}
+
+// RewrapKeys re-encrypts the private keys of all devices wrapped under a retired
+// key-encryption key under the current one. The devices are rewrapped and saved in
+// batches of one unit of work each, signing and device creation are only blocked while
+// a batch is rewrapped. Retired keys stay known to the service, so devices of a batch
+// which has failed, or has not been reached, remain usable and a repeated run picks them
+// up. Before the first batch every device is checked to be wrapped under a known key.
+// The number of rewrapped devices is returned, also along with an error.
+func (sd *SignatureDeviceService) RewrapKeys() (int, error) {
+	devices, err := sd.repository.GetAll()
+	if err != nil {
+		return 0, err
+	}
+	pending, err := sd.devicesToRewrap(devices)
+	if err != nil {
+		return 0, err
+	}
+	rewrapped := 0
+	for start := 0; start < len(pending); start += sd.rewrapBatchSize {
+		end := start + sd.rewrapBatchSize
+		if end > len(pending) {
+			end = len(pending)
+		}
+		var count int
+		err := sd.retryPolicy.Do(func() error {
+			var err error
+			count, err = sd.rewrapBatch(pending[start:end])
+			return err
+		})
+		if err != nil {
+			return rewrapped, err
+		}
+		rewrapped += count
+	}
+	return rewrapped, nil
+}
+
+// devicesToRewrap returns the ids of the devices with a private key wrapped under a
+// retired key-encryption key, it fails if any key is wrapped under an unknown one.
+func (sd *SignatureDeviceService) devicesToRewrap(devices []domain.SignatureDevice) ([]string, error) {
+	sd.kek.RLock()
+	defer sd.kek.RUnlock()
+	pending := []string{}
+	for _, device := range devices {
+		// decommissioned devices have no key left, others may have been rewrapped by an earlier run
+		if len(device.PrivateKey) == 0 || device.KeyEncryptionKeyId == sd.kek.wrapper.Id() {
+			continue
+		}
+		if _, err := sd.kek.forDevice(device); err != nil {
+			return nil, fmt.Errorf("device %s: %w", device.Id, err)
+		}
+		pending = append(pending, device.Id)
+	}
+	return pending, nil
+}
+
+// rewrapBatch rewraps the keys of the devices and saves them in one unit of work.
+// The devices are read again under the exclusive KEK lock, so no signature is
+// committed for them meanwhile.
+func (sd *SignatureDeviceService) rewrapBatch(ids []string) (int, error) {
+	sd.kek.Lock()
+	defer sd.kek.Unlock()
+	uow, err := sd.unitOfWork.Begin()
+	if err != nil {
+		return 0, err
+	}
+	rewrapped := 0
+	for _, id := range ids {
+		device, err := sd.repository.GetById(id)
+		if err == domain.ErrDeviceNotFound {
+			continue
+		}
+		if err != nil {
+			uow.Rollback()
+			return 0, err
+		}
+		if len(device.PrivateKey) == 0 || device.KeyEncryptionKeyId == sd.kek.wrapper.Id() {
+			continue
+		}
+		wrapper, err := sd.kek.forDevice(*device)
+		if err == nil {
+			var privateKey []byte
+			privateKey, err = wrapper.Unwrap(device.Id, device.PrivateKey)
+			if err == nil {
+				device.PrivateKey, err = sd.kek.wrapper.Wrap(device.Id, privateKey)
+			}
+		}
+		if err != nil {
+			uow.Rollback()
+			return 0, fmt.Errorf("device %s: %w", device.Id, err)
+		}
+		device.KeyEncryptionKeyId = sd.kek.wrapper.Id()
+		// the counter is unchanged, the version check still catches writers of other instances
+		uow.RegisterDevice(*device, device.SignatureCounter)
+		rewrapped++
+	}
+	if rewrapped == 0 {
+		uow.Rollback()
+		return 0, nil
+	}
+	err = uow.Commit()
+	if err != nil {
+		uow.Rollback()
+		return 0, err
+	}
+	return rewrapped, nil
+}
+
+// KeyEncryptionKeyId identifies the key-encryption key new private keys are wrapped under.
+func (sd *SignatureDeviceService) KeyEncryptionKeyId() string {
+	sd.kek.RLock()
+	defer sd.kek.RUnlock()
+	return sd.kek.wrapper.Id()
+}
+
 func (sd *SignatureDeviceService) GetById(deviceId string) (*dto.SignatureDeviceResponse, error) {
 	device, err := sd.repository.GetById(deviceId)
 	if err != nil {
@@ -121,3 +807,82 @@ func (sd *SignatureDeviceService) GetAll() ([]dto.SignatureDeviceResponse, error
 	}
 	return response, nil
 }
+
+// ListDevices returns one page of devices. The cursor of the next page is opaque
+// to clients and only valid for the sort order it was created with.
+func (sd *SignatureDeviceService) ListDevices(request dto.ListDevicesRequest) (*dto.DeviceListResponse, error) {
+	query := repositories.DeviceQuery{
+		Algorithm:   request.Algorithm,
+		LabelPrefix: request.LabelPrefix,
+		Tags:        request.Tags,
+		SortBy:      repositories.SortByCreatedAt,
+		Descending:  request.Order == dto.OrderDescending,
+		Limit:       request.Limit,
+	}
+	if request.Sort == dto.SortByLabel {
+		query.SortBy = repositories.SortByLabel
+	}
+	if query.Limit == 0 {
+		query.Limit = dto.DefaultPageSize
+	}
+	if request.Cursor != "" {
+		after, err := decodeDeviceCursor(request.Cursor, query.SortBy)
+		if err != nil {
+			return nil, err
+		}
+		query.After = &after
+	}
+	page, err := sd.repository.List(query)
+	if err != nil {
+		return nil, err
+	}
+	response := &dto.DeviceListResponse{Devices: []dto.SignatureDeviceResponse{}, Total: page.Total}
+	for _, device := range page.Devices {
+		response.Devices = append(response.Devices, dto.ConvertSignatureDeviceToResponse(device))
+	}
+	if page.HasMore {
+		last := repositories.NewDeviceCursor(page.Devices[len(page.Devices)-1])
+		response.NextCursor, err = encodeDeviceCursor(last, query.SortBy)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return response, nil
+}
+
+// deviceCursor is the serialized form of a device cursor.
+type deviceCursor struct {
+	Sort      string    `json:"s"`
+	CreatedAt time.Time `json:"c"`
+	Label     string    `json:"l"`
+	Id        string    `json:"i"`
+}
+
+func encodeDeviceCursor(cursor repositories.DeviceCursor, sortBy string) (string, error) {
+	encoded, err := json.Marshal(deviceCursor{
+		Sort:      sortBy,
+		CreatedAt: cursor.CreatedAt,
+		Label:     cursor.Label,
+		Id:        cursor.Id,
+	})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(encoded), nil
+}
+
+func decodeDeviceCursor(encoded string, sortBy string) (repositories.DeviceCursor, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return repositories.DeviceCursor{}, domain.ErrInvalidCursor
+	}
+	var cursor deviceCursor
+	if err := json.Unmarshal(decoded, &cursor); err != nil || cursor.Sort != sortBy {
+		return repositories.DeviceCursor{}, domain.ErrInvalidCursor
+	}
+	return repositories.DeviceCursor{
+		CreatedAt: cursor.CreatedAt,
+		Label:     cursor.Label,
+		Id:        cursor.Id,
+	}, nil
+}
@@ -1,12 +1,19 @@
 package services
 
 import (
+	"bytes"
+	"context"
+	gocrypto "crypto"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"signing-service-challenge/crypto"
+	"signing-service-challenge/domain"
 	"signing-service-challenge/dto"
 	"signing-service-challenge/lockers"
 	"signing-service-challenge/persistence"
 	"signing-service-challenge/repositories"
+	"strings"
 	"sync"
 	"testing"
 
@@ -16,16 +23,32 @@ import (
 
 var db = persistence.NewInMemoryDB()
 var repository = repositories.NewSignatureDeviceInMemoryRepository(db)
+var exportRepository = repositories.NewKeyExportInMemoryRepository(db)
+var unitOfWork = repositories.NewInMemoryUnitOfWorkFactory(db)
 var mutex sync.Mutex
 
 var locker = lockers.NewDeviceLockerWithGlobalMapProtection(&mutex)
 
+var keyWrapper = newKeyWrapper()
+
+func newKeyWrapper() *crypto.KeyWrapper {
+	kek, err := crypto.GenerateKeyEncryptionKey()
+	if err != nil {
+		panic(err)
+	}
+	wrapper, err := crypto.NewKeyWrapper(kek)
+	if err != nil {
+		panic(err)
+	}
+	return wrapper
+}
+
 func TestCreateSignatureDevice(t *testing.T) {
-	service := NewSignatureDeviceService(repository, locker)
+	service := NewSignatureDeviceService(repository, exportRepository, unitOfWork, locker, keyWrapper)
 	id := uuid.NewString()
 	algorithm := crypto.RSA
 	label := "First Device"
-	device, _ := service.CreateSignatureDevice(id, algorithm, label)
+	device, _ := service.CreateSignatureDevice(id, algorithm, label, false, crypto.Options{})
 	if device.Id != id {
 		t.Errorf("got ID: %s expected: %s.", device.Id, id)
 	}
@@ -44,12 +67,459 @@ func TestCreateSignatureDevice(t *testing.T) {
 	})
 }
 
+func TestCreateSignatureDeviceStoresWrappedPrivateKey(t *testing.T) {
+	service := NewSignatureDeviceService(repository, exportRepository, unitOfWork, locker, keyWrapper)
+	id := uuid.NewString()
+	service.CreateSignatureDevice(id, crypto.ECC, "Device", false, crypto.Options{})
+	deviceFromDb, _ := repository.GetById(id)
+	if bytes.Contains(deviceFromDb.PrivateKey, []byte("PRIVATE")) {
+		t.Error("private key should not be stored as plain PEM")
+	}
+	if deviceFromDb.KeyEncryptionKeyId != keyWrapper.Id() {
+		t.Errorf("got KEK id %s, expected %s", deviceFromDb.KeyEncryptionKeyId, keyWrapper.Id())
+	}
+	t.Cleanup(func() {
+		repository.DeleteAll()
+	})
+}
+
+func TestRewrapKeysUnderNewKeyEncryptionKey(t *testing.T) {
+	// separate database, so devices of other tests are not affected
+	db := persistence.NewInMemoryDB()
+	repository := repositories.NewSignatureDeviceInMemoryRepository(db)
+	unitOfWork := repositories.NewInMemoryUnitOfWorkFactory(db)
+	oldWrapper := newKeyWrapper()
+	service := NewSignatureDeviceService(repository, exportRepository, unitOfWork, locker, oldWrapper)
+	id := uuid.NewString()
+	service.CreateSignatureDevice(id, crypto.ECC, "Device", false, crypto.Options{})
+	signature, err := service.SignTransaction(context.Background(), id, "before rewrap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// restarted with the new key as the current one and the old one retired
+	newWrapper := newKeyWrapper()
+	service = NewSignatureDeviceService(repository, exportRepository, unitOfWork, locker, newWrapper)
+	service.AddRetiredKeyEncryptionKeys(oldWrapper)
+	if _, err := service.SignTransaction(context.Background(), id, "with retired key"); err != nil {
+		t.Fatalf("signing with a key under a retired key-encryption key failed: %s", err)
+	}
+	rewrapped, err := service.RewrapKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rewrapped != 1 {
+		t.Errorf("got %d rewrapped devices, expected 1", rewrapped)
+	}
+	deviceFromDb, _ := repository.GetById(id)
+	if deviceFromDb.KeyEncryptionKeyId != newWrapper.Id() {
+		t.Errorf("got KEK id %s, expected %s", deviceFromDb.KeyEncryptionKeyId, newWrapper.Id())
+	}
+	if deviceFromDb.SignatureCounter != 2 {
+		t.Errorf("signature counter should be untouched, got %d", deviceFromDb.SignatureCounter)
+	}
+	if rewrapped, _ := service.RewrapKeys(); rewrapped != 0 {
+		t.Errorf("got %d rewrapped devices of a repeated run, expected 0", rewrapped)
+	}
+	// the retired key is not needed anymore
+	service = NewSignatureDeviceService(repository, exportRepository, unitOfWork, locker, newWrapper)
+	verified, _ := service.Verify(id, signature.Signature, signature.SignedData)
+	if !verified.Status {
+		t.Error("signature created before the rewrap should still be verified")
+	}
+	if _, err := service.SignTransaction(context.Background(), id, "after rewrap"); err != nil {
+		t.Errorf("signing after rewrap failed: %s", err)
+	}
+}
+
+func TestRewrapKeysSwitchesNoDeviceIfAnyKeyIsUnknown(t *testing.T) {
+	db := persistence.NewInMemoryDB()
+	repository := repositories.NewSignatureDeviceInMemoryRepository(db)
+	unitOfWork := repositories.NewInMemoryUnitOfWorkFactory(db)
+	oldWrapper, unknownWrapper := newKeyWrapper(), newKeyWrapper()
+	service := NewSignatureDeviceService(repository, exportRepository, unitOfWork, locker, oldWrapper)
+	known := uuid.NewString()
+	service.CreateSignatureDevice(known, crypto.ED25519, "Device", false, crypto.Options{})
+	other := NewSignatureDeviceService(repository, exportRepository, unitOfWork, locker, unknownWrapper)
+	other.CreateSignatureDevice(uuid.NewString(), crypto.ED25519, "Device", false, crypto.Options{})
+
+	service = NewSignatureDeviceService(repository, exportRepository, unitOfWork, locker, newKeyWrapper())
+	service.AddRetiredKeyEncryptionKeys(oldWrapper)
+	if _, err := service.RewrapKeys(); !errors.Is(err, domain.ErrUnknownKeyEncryptionKey) {
+		t.Errorf("got error %v, expected %v", err, domain.ErrUnknownKeyEncryptionKey)
+	}
+	deviceFromDb, _ := repository.GetById(known)
+	if deviceFromDb.KeyEncryptionKeyId != oldWrapper.Id() {
+		t.Error("no device should be switched if any key is wrapped under an unknown key")
+	}
+	if _, err := service.SignTransaction(context.Background(), known, "data"); err != nil {
+		t.Errorf("device should still sign after a failed rewrap, got %v", err)
+	}
+}
+
+func TestRewrapKeysCommitsBatches(t *testing.T) {
+	db := persistence.NewInMemoryDB()
+	repository := repositories.NewSignatureDeviceInMemoryRepository(db)
+	unitOfWork := &countingUnitOfWorkFactory{UnitOfWorkFactory: repositories.NewInMemoryUnitOfWorkFactory(db)}
+	oldWrapper := newKeyWrapper()
+	service := NewSignatureDeviceService(repository, exportRepository, unitOfWork, locker, oldWrapper)
+	ids := []string{}
+	for i := 0; i < 5; i++ {
+		id := uuid.NewString()
+		service.CreateSignatureDevice(id, crypto.ED25519, "Device", false, crypto.Options{})
+		ids = append(ids, id)
+	}
+	newWrapper := newKeyWrapper()
+	service = NewSignatureDeviceService(repository, exportRepository, unitOfWork, locker, newWrapper)
+	service.AddRetiredKeyEncryptionKeys(oldWrapper)
+	service.SetRewrapBatchSize(2)
+	unitOfWork.commits = 0
+	rewrapped, err := service.RewrapKeys()
+	if err != nil || rewrapped != 5 {
+		t.Fatalf("got %d rewrapped devices, expected 5 (%v)", rewrapped, err)
+	}
+	if unitOfWork.commits != 3 {
+		t.Errorf("got %d commits, expected batches of 2, 2 and 1 device", unitOfWork.commits)
+	}
+	for _, id := range ids {
+		device, _ := repository.GetById(id)
+		if device.KeyEncryptionKeyId != newWrapper.Id() {
+			t.Errorf("device %s should be rewrapped", id)
+		}
+	}
+}
+
+// countingUnitOfWorkFactory counts the commits of its units of work.
+type countingUnitOfWorkFactory struct {
+	repositories.UnitOfWorkFactory
+	commits int
+}
+
+func (f *countingUnitOfWorkFactory) Begin() (repositories.UnitOfWork, error) {
+	uow, err := f.UnitOfWorkFactory.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &countingUnitOfWork{UnitOfWork: uow, factory: f}, nil
+}
+
+type countingUnitOfWork struct {
+	repositories.UnitOfWork
+	factory *countingUnitOfWorkFactory
+}
+
+func (u *countingUnitOfWork) Commit() error {
+	u.factory.commits++
+	return u.UnitOfWork.Commit()
+}
+
+func TestExportPrivateKeyOfNonExportableDeviceShouldFail(t *testing.T) {
+	service := NewSignatureDeviceService(repository, exportRepository, unitOfWork, locker, keyWrapper)
+	id := uuid.NewString()
+	service.CreateSignatureDevice(id, crypto.ECC, "Device", false, crypto.Options{})
+	_, err := service.ExportPrivateKey(id, []byte("recipient public key"), "auditor")
+	if err != domain.ErrKeyNotExportable {
+		t.Errorf("got error %v, expected %v", err, domain.ErrKeyNotExportable)
+	}
+	exports, _ := exportRepository.GetByDeviceId(id)
+	if len(exports) != 0 {
+		t.Error("failed export should not be recorded")
+	}
+	t.Cleanup(func() {
+		repository.DeleteAll()
+	})
+}
+
+func TestExportPrivateKeyIsEncryptedForRecipientAndRecorded(t *testing.T) {
+	service := NewSignatureDeviceService(repository, exportRepository, unitOfWork, locker, keyWrapper)
+	id := uuid.NewString()
+	service.CreateSignatureDevice(id, crypto.ED25519, "Device", true, crypto.Options{})
+	generator := crypto.ECCGenerator{Curve: crypto.CurveP256}
+	recipient, _ := generator.Generate()
+	recipientPublicKey, _, _ := crypto.NewECCMarshaler().Encode(*recipient)
+
+	exported, err := service.ExportPrivateKey(id, recipientPublicKey, "auditor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, _ := base64.StdEncoding.DecodeString(exported.Ciphertext)
+	nonce, _ := base64.StdEncoding.DecodeString(exported.Nonce)
+	privateKey, err := crypto.OpenExportedKey(recipient.Private, crypto.ExportedKey{
+		Scheme:             exported.Scheme,
+		EphemeralPublicKey: []byte(exported.EphemeralPublicKey),
+		Nonce:              nonce,
+		Ciphertext:         ciphertext,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := crypto.NewEd25519Marshaler().Decode(privateKey); err != nil {
+		t.Errorf("exported key should be a valid Ed25519 key: %s", err)
+	}
+	exports, _ := service.GetKeyExports(id)
+	if len(exports) != 1 || exports[0].Id != exported.ExportId || exports[0].ExportedBy != "auditor" {
+		t.Errorf("export should be recorded, got %v", exports)
+	}
+	t.Cleanup(func() {
+		repository.DeleteAll()
+	})
+}
+
+func TestImportSignatureDeviceSignsWithTheImportedKey(t *testing.T) {
+	service := NewSignatureDeviceService(repository, exportRepository, unitOfWork, locker, keyWrapper)
+	id := uuid.NewString()
+	generator := crypto.ECCGenerator{Curve: crypto.CurveP521}
+	keys, _ := generator.Generate()
+	publicKey, privateKey, _ := crypto.NewECCMarshaler().Encode(*keys)
+	device, err := service.ImportSignatureDevice(id, "Legacy TSE", false, privateKey, crypto.Options{Hash: crypto.HashSHA512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.Algorithm != crypto.ECC || device.Curve != crypto.CurveP521 || device.Hash != crypto.HashSHA512 {
+		t.Errorf("got %s on %s with %s, expected ECC on P-521 with SHA-512", device.Algorithm, device.Curve, device.Hash)
+	}
+	if device.PublicKey != string(publicKey) {
+		t.Error("device should carry the public key of the imported key")
+	}
+	signature, err := service.SignTransaction(context.Background(), id, "message to be signed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sgn, _ := base64.StdEncoding.DecodeString(signature.Signature)
+	verified, _ := crypto.NewECCSignerWithHash(keys.Private, gocrypto.SHA512).Verify([]byte(signature.SignedData), sgn)
+	if !verified {
+		t.Error("signature should be verifiable with the imported key")
+	}
+	t.Cleanup(func() {
+		repository.DeleteAll()
+	})
+}
+
+func TestImportSignatureDeviceWithMismatchingParametersShouldFail(t *testing.T) {
+	service := NewSignatureDeviceService(repository, exportRepository, unitOfWork, locker, keyWrapper)
+	id := uuid.NewString()
+	generator := crypto.ECCGenerator{Curve: crypto.CurveP256}
+	keys, _ := generator.Generate()
+	_, privateKey, _ := crypto.NewECCMarshaler().Encode(*keys)
+	_, err := service.ImportSignatureDevice(id, "Legacy TSE", false, privateKey, crypto.Options{Curve: crypto.CurveP384})
+	if err == nil {
+		t.Error("import with a curve different from the key's one should fail")
+	}
+	if _, err := repository.GetById(id); err == nil {
+		t.Error("device should not be saved into db.")
+	}
+}
+
+func TestRotateKeyPairKeepsChainAndHistory(t *testing.T) {
+	service := NewSignatureDeviceService(repository, exportRepository, unitOfWork, locker, keyWrapper)
+	for _, algorithm := range []string{crypto.RSA, crypto.ECC, crypto.ED25519} {
+		id := uuid.NewString()
+		created, _ := service.CreateSignatureDevice(id, algorithm, "Device", false, crypto.Options{})
+		before, err := service.SignTransaction(context.Background(), id, "signed with key 1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rotation, err := service.RotateKeyPair(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rotation.KeyVersion != 2 || rotation.PublicKey == created.PublicKey {
+			t.Errorf("%s: expected a new public key with version 2, got version %d", algorithm, rotation.KeyVersion)
+		}
+		if !strings.HasPrefix(rotation.SignedData, "1_"+KeyRolloverRecord(2, []byte(rotation.PublicKey))+"_"+before.Signature) {
+			t.Errorf("%s: rollover record should take the next counter and link the last signature", algorithm)
+		}
+		after, err := service.SignTransaction(context.Background(), id, "signed with key 2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(after.SignedData, "2_") || !strings.HasSuffix(after.SignedData, rotation.Signature) {
+			t.Errorf("%s: chain should continue after the rotation, got %s", algorithm, after.SignedData)
+		}
+		for _, signed := range []*dto.SignatureResponse{before, {Signature: rotation.Signature, SignedData: rotation.SignedData}, after} {
+			verified, err := service.Verify(id, signed.Signature, signed.SignedData)
+			if err != nil || !verified.Status {
+				t.Errorf("%s: signature %q should be verified, but it failed (%v)", algorithm, signed.SignedData, err)
+			}
+		}
+		device, _ := service.GetById(id)
+		if len(device.KeyHistory) != 1 || device.KeyHistory[0].PublicKey != created.PublicKey {
+			t.Errorf("%s: the old public key should be kept in the history", algorithm)
+		}
+		if device.KeyHistory[0].FirstCounter != 0 || device.KeyHistory[0].LastCounter != 1 {
+			t.Errorf("%s: old key should cover counters 0 to 1, got %d to %d", algorithm, device.KeyHistory[0].FirstCounter, device.KeyHistory[0].LastCounter)
+		}
+	}
+	t.Cleanup(func() {
+		repository.DeleteAll()
+	})
+}
+
+func TestSuspendedDeviceSignsOnlyAfterActivation(t *testing.T) {
+	service := NewSignatureDeviceService(repository, exportRepository, unitOfWork, locker, keyWrapper)
+	id := uuid.NewString()
+	created, _ := service.CreateSignatureDevice(id, crypto.ECC, "Device", false, crypto.Options{})
+	if created.State != domain.StateActive {
+		t.Fatalf("new device should be %s, got %s", domain.StateActive, created.State)
+	}
+	if _, err := service.TransitionState(context.Background(), id, domain.StateSuspended, "audit"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.SignTransaction(context.Background(), id, "data"); !errors.Is(err, domain.ErrDeviceNotActive) {
+		t.Errorf("got error %v, expected %v", err, domain.ErrDeviceNotActive)
+	}
+	if _, err := service.RotateKeyPair(id); !errors.Is(err, domain.ErrDeviceNotActive) {
+		t.Errorf("got error %v, expected %v", err, domain.ErrDeviceNotActive)
+	}
+	device, err := service.TransitionState(context.Background(), id, domain.StateActive, "audit passed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(device.StateHistory) != 3 || device.StateHistory[1].Reason != "audit" || device.StateHistory[2].To != domain.StateActive {
+		t.Errorf("every transition should be recorded with its reason, got %+v", device.StateHistory)
+	}
+	if signed, err := service.SignTransaction(context.Background(), id, "data"); err != nil || signed.Counter != 0 {
+		t.Errorf("activated device should sign with counter 0, got %v (%v)", signed, err)
+	}
+	if _, err := service.TransitionState(context.Background(), id, domain.StateActive, "again"); !errors.Is(err, domain.ErrInvalidStateTransition) {
+		t.Errorf("got error %v, expected %v", err, domain.ErrInvalidStateTransition)
+	}
+	t.Cleanup(func() {
+		repository.DeleteAll()
+	})
+}
+
+func TestDecommissionDestroysPrivateKeyAndKeepsVerification(t *testing.T) {
+	service := NewSignatureDeviceService(repository, exportRepository, unitOfWork, locker, keyWrapper)
+	id := uuid.NewString()
+	service.CreateSignatureDevice(id, crypto.ED25519, "Device", true, crypto.Options{})
+	signed, _ := service.SignTransaction(context.Background(), id, "data")
+	if _, err := service.TransitionState(context.Background(), id, domain.StateDecommissioned, "end of life"); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := repository.GetById(id)
+	if len(stored.PrivateKey) != 0 || service.signers.Metrics().Size != 0 {
+		t.Error("private key should be destroyed in the store and in the signer cache")
+	}
+	verified, err := service.Verify(id, signed.Signature, signed.SignedData)
+	if err != nil || !verified.Status {
+		t.Errorf("signatures of a decommissioned device should remain verifiable (%v)", err)
+	}
+	if _, err := service.SignTransaction(context.Background(), id, "data"); !errors.Is(err, domain.ErrDeviceNotActive) {
+		t.Errorf("got error %v, expected %v", err, domain.ErrDeviceNotActive)
+	}
+	if _, err := service.ExportPrivateKey(id, []byte("recipient public key"), "auditor"); err != domain.ErrKeyDestroyed {
+		t.Errorf("got error %v, expected %v", err, domain.ErrKeyDestroyed)
+	}
+	if _, err := service.TransitionState(context.Background(), id, domain.StateActive, "revive"); !errors.Is(err, domain.ErrInvalidStateTransition) {
+		t.Errorf("decommissioning should be final, got %v", err)
+	}
+	if _, err := service.RewrapKeys(); err != nil {
+		t.Errorf("decommissioned devices should be skipped by a rewrap, got %v", err)
+	}
+	t.Cleanup(func() {
+		repository.DeleteAll()
+	})
+}
+
+func TestUpdateDeviceKeepsCounterAndKeys(t *testing.T) {
+	service := NewSignatureDeviceService(repository, exportRepository, unitOfWork, locker, keyWrapper)
+	id := uuid.NewString()
+	service.CreateSignatureDevice(id, crypto.ECC, "Device", false, crypto.Options{})
+	service.SignTransaction(context.Background(), id, "data")
+	before, _ := repository.GetById(id)
+	label, store, register := "Till 1", "berlin", "7"
+	updated, err := service.UpdateDevice(context.Background(), id, dto.UpdateDeviceRequest{
+		Label: &label,
+		Tags:  map[string]*string{"store": &store, "register": &register},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Label != label || len(updated.Tags) != 2 || updated.Tags["store"] != store {
+		t.Errorf("got label %s and tags %v", updated.Label, updated.Tags)
+	}
+	stored, _ := repository.GetById(id)
+	if stored.SignatureCounter != 1 || stored.LastSignature != before.LastSignature ||
+		!bytes.Equal(stored.PrivateKey, before.PrivateKey) || !bytes.Equal(stored.PublicKey, before.PublicKey) {
+		t.Error("counter and keys should not be changed by an update")
+	}
+	if stored.Version != updated.Version {
+		t.Errorf("got version %d, expected the stored version %d", updated.Version, stored.Version)
+	}
+	updated, err = service.UpdateDevice(context.Background(), id, dto.UpdateDeviceRequest{Tags: map[string]*string{"register": nil}})
+	if err != nil || updated.Label != label || len(updated.Tags) != 1 {
+		t.Errorf("tag set to null should be removed and the label kept, got %+v (%v)", updated, err)
+	}
+	if signed, err := service.SignTransaction(context.Background(), id, "data"); err != nil || signed.Counter != 1 {
+		t.Errorf("device should continue signing with counter 1, got %v (%v)", signed, err)
+	}
+	t.Cleanup(func() {
+		repository.DeleteAll()
+	})
+}
+
+func TestUpdateDeviceWithExpectedVersion(t *testing.T) {
+	service := NewSignatureDeviceService(repository, exportRepository, unitOfWork, locker, keyWrapper)
+	id := uuid.NewString()
+	service.CreateSignatureDevice(id, crypto.ECC, "Device", false, crypto.Options{})
+	read, _ := service.GetById(id)
+	// signing writes the device as well, so the version read before is stale
+	service.SignTransaction(context.Background(), id, "data")
+	label := "Renamed"
+	_, err := service.UpdateDevice(context.Background(), id, dto.UpdateDeviceRequest{Label: &label, ExpectedVersions: []int{read.Version}})
+	if err != domain.ErrVersionMismatch {
+		t.Errorf("got error %v, expected %v", err, domain.ErrVersionMismatch)
+	}
+	read, _ = service.GetById(id)
+	if _, err := service.UpdateDevice(context.Background(), id, dto.UpdateDeviceRequest{Label: &label, ExpectedVersions: []int{}}); err != domain.ErrVersionMismatch {
+		t.Errorf("got error %v, expected %v without any expected version", err, domain.ErrVersionMismatch)
+	}
+	if _, err := service.UpdateDevice(context.Background(), id, dto.UpdateDeviceRequest{Label: &label, ExpectedVersions: []int{read.Version - 1, read.Version}}); err != nil {
+		t.Errorf("update of the current version should succeed, got %v", err)
+	}
+	t.Cleanup(func() {
+		repository.DeleteAll()
+	})
+}
+
+func TestUpdateDeviceWhileSigningConcurrently(t *testing.T) {
+	service := NewSignatureDeviceService(repository, exportRepository, unitOfWork, locker, keyWrapper)
+	id := uuid.NewString()
+	service.CreateSignatureDevice(id, crypto.ED25519, "Device", false, crypto.Options{})
+	updates := 20
+	var wg sync.WaitGroup
+	for i := 0; i < updates; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := service.SignTransaction(context.Background(), id, "data"); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			value := fmt.Sprint(i)
+			if _, err := service.UpdateDevice(context.Background(), id, dto.UpdateDeviceRequest{Tags: map[string]*string{"tag-" + value: &value}}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	device, _ := service.GetById(id)
+	if device.SignatureCounter != updates || len(device.Tags) != updates {
+		t.Errorf("got counter %d and %d tags, expected %d each", device.SignatureCounter, len(device.Tags), updates)
+	}
+	t.Cleanup(func() {
+		repository.DeleteAll()
+	})
+}
+
 func TestCreateSignatureDeviceForUnsupportedAlgorithmShouldFail(t *testing.T) {
-	service := NewSignatureDeviceService(repository, locker)
+	service := NewSignatureDeviceService(repository, exportRepository, unitOfWork, locker, keyWrapper)
 	id := uuid.NewString()
 	algorithm := "UNSUPPORTED"
 	label := "First Device"
-	device, err := service.CreateSignatureDevice(id, algorithm, label)
+	device, err := service.CreateSignatureDevice(id, algorithm, label, false, crypto.Options{})
 	if device != nil {
 		t.Error("device should not be created")
 	}
@@ -81,8 +551,22 @@ func TestECCSigningDataWithTheSameDeviceConcurrently(t *testing.T) {
 	})
 }
 
+func TestEd25519SigningDataWithTheSameDeviceConcurrently(t *testing.T) {
+	testSigningDataOneDeviceMultipleClientsConcurrently(t, crypto.ED25519, locker, 1000)
+	t.Cleanup(func() {
+		repository.DeleteAll()
+	})
+}
+
+func TestSigningDataWithTheSameDeviceConcurrentlyWithShardedLocker(t *testing.T) {
+	testSigningDataOneDeviceMultipleClientsConcurrently(t, crypto.ED25519, lockers.NewShardedDeviceLocker(lockers.DefaultShards), 1000)
+	t.Cleanup(func() {
+		repository.DeleteAll()
+	})
+}
+
 func TestSigningDataByMultipleDevicesConcurrentlyEachDeviceUsedOnlyOnce(t *testing.T) {
-	service := NewSignatureDeviceService(repository, locker)
+	service := NewSignatureDeviceService(repository, exportRepository, unitOfWork, locker, keyWrapper)
 
 	createDevices(100, crypto.RSA, *service)
 	createDevices(100, crypto.ECC, *service)
@@ -108,7 +592,7 @@ func TestSigningDataByMultipleDevicesConcurrentlyEachDeviceUsedOnlyOnce(t *testi
 }
 
 func TestSigningDataByMultipleDevicesConcurrentlyMultipleSignaturesPerDevice(t *testing.T) {
-	service := NewSignatureDeviceService(repository, locker)
+	service := NewSignatureDeviceService(repository, exportRepository, unitOfWork, locker, keyWrapper)
 
 	createDevices(100, crypto.RSA, *service)
 	createDevices(100, crypto.ECC, *service)
@@ -184,6 +668,86 @@ func TestECCSignatureVerificationShouldReturnFalse(t *testing.T) {
 	})
 }
 
+func TestEd25519SignatureVerificationShouldReturnTrue(t *testing.T) {
+	verified := testSignatureVerification(t, crypto.ED25519, "")
+	if !verified {
+		t.Error("signature should be verified, but it failed")
+	}
+	t.Cleanup(func() {
+		repository.DeleteAll()
+	})
+}
+
+func TestEd25519SignatureVerificationShouldReturnFalse(t *testing.T) {
+	verified := testSignatureVerification(t, crypto.ED25519, "tempered")
+	if verified {
+		t.Error("verification should fail, but it succeeded")
+	}
+	t.Cleanup(func() {
+		repository.DeleteAll()
+	})
+}
+
+func TestRSAPSSSignatureVerificationShouldReturnTrue(t *testing.T) {
+	service := NewSignatureDeviceService(repository, exportRepository, unitOfWork, locker, keyWrapper)
+	id := uuid.NewString()
+	options := crypto.Options{KeySize: crypto.RSAKeySize3072, Padding: crypto.PaddingPSS}
+	device, err := service.CreateSignatureDevice(id, crypto.RSA, "PSS Device", false, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.KeySize != crypto.RSAKeySize3072 || device.Padding != crypto.PaddingPSS {
+		t.Errorf("got key size %d and padding %s, expected the requested ones", device.KeySize, device.Padding)
+	}
+	signature, err := service.SignTransaction(context.Background(), id, "message to be signed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified, _ := service.Verify(id, signature.Signature, signature.SignedData)
+	if !verified.Status {
+		t.Error("signature should be verified, but it failed")
+	}
+	t.Cleanup(func() {
+		repository.DeleteAll()
+	})
+}
+
+func TestECCSignatureVerificationWithConfiguredCurveAndHash(t *testing.T) {
+	service := NewSignatureDeviceService(repository, exportRepository, unitOfWork, locker, keyWrapper)
+	id := uuid.NewString()
+	options := crypto.Options{Curve: crypto.CurveP256, Hash: crypto.HashSHA512}
+	device, err := service.CreateSignatureDevice(id, crypto.ECC, "P-256 Device", false, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.Curve != crypto.CurveP256 || device.Hash != crypto.HashSHA512 {
+		t.Errorf("got curve %s and hash %s, expected the requested ones", device.Curve, device.Hash)
+	}
+	signature, err := service.SignTransaction(context.Background(), id, "message to be signed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified, _ := service.Verify(id, signature.Signature, signature.SignedData)
+	if !verified.Status {
+		t.Error("signature should be verified, but it failed")
+	}
+	t.Cleanup(func() {
+		repository.DeleteAll()
+	})
+}
+
+func TestCreateSignatureDeviceWithInsecureKeySizeShouldFail(t *testing.T) {
+	service := NewSignatureDeviceService(repository, exportRepository, unitOfWork, locker, keyWrapper)
+	id := uuid.NewString()
+	device, err := service.CreateSignatureDevice(id, crypto.RSA, "Device", false, crypto.Options{KeySize: 512})
+	if device != nil || err == nil {
+		t.Error("device with a 512 bit key should not be created")
+	}
+	t.Cleanup(func() {
+		repository.DeleteAll()
+	})
+}
+
 func testSigningDataByMultipleDevicesOnlyOneSignatureConcurrently(
 	t *testing.T,
 	wg *sync.WaitGroup,
@@ -196,7 +760,7 @@ func testSigningDataByMultipleDevicesOnlyOneSignatureConcurrently(
 		go func(d dto.SignatureDeviceResponse) {
 			defer wg.Done()
 			deviceBeforeSigning, _ := service.GetById(d.Id)
-			result, _ := service.SignTransaction(d.Id, data)
+			result, _ := service.SignTransaction(context.Background(), d.Id, data)
 			deviceAfterSigning, _ := service.GetById(d.Id)
 			if deviceBeforeSigning.LastSignature == deviceAfterSigning.LastSignature {
 				t.Error("last signature value should be different after each sign operation")
@@ -237,7 +801,7 @@ func testSigningDataByMultipleDevicesMultipleSignaturesConcurrently(
 				go func(m string) {
 					defer wg.Done()
 					deviceBeforeSigning, _ := service.GetById(d.Id)
-					result, _ := service.SignTransaction(d.Id, m)
+					result, _ := service.SignTransaction(context.Background(), d.Id, m)
 					deviceAfterSigning, _ := service.GetById(d.Id)
 					if deviceBeforeSigning.LastSignature == deviceAfterSigning.LastSignature {
 						t.Error("last signature value should be different after each sign operation")
@@ -255,16 +819,16 @@ func createDevices(n int, algorithm string, service SignatureDeviceService) {
 	for i := 0; i < n; i++ {
 		id := uuid.NewString()
 		label := fmt.Sprintf("%s Device %d", algorithm, i)
-		service.CreateSignatureDevice(id, algorithm, label)
+		service.CreateSignatureDevice(id, algorithm, label, false, crypto.Options{})
 	}
 }
 
 func testSigningDataOneDeviceMultipleClientsConcurrently(t *testing.T, algorithm string, locker lockers.DeviceLocker, numOfSignatures int) {
-	service := NewSignatureDeviceService(repository, locker)
+	service := NewSignatureDeviceService(repository, exportRepository, unitOfWork, locker, keyWrapper)
 	id := uuid.NewString()
 	label := "First Device"
 	data := "message to be signed"
-	service.CreateSignatureDevice(id, algorithm, label)
+	service.CreateSignatureDevice(id, algorithm, label, false, crypto.Options{})
 	var wg sync.WaitGroup
 	// execute signing concurrently
 	for i := 0; i < numOfSignatures; i++ {
@@ -272,7 +836,7 @@ func testSigningDataOneDeviceMultipleClientsConcurrently(t *testing.T, algorithm
 		go func() {
 			defer wg.Done()
 			deviceBeforeSigning, _ := service.GetById(id)
-			result, _ := service.SignTransaction(id, data)
+			result, _ := service.SignTransaction(context.Background(), id, data)
 			deviceAfterSigning, _ := service.GetById(id)
 			if deviceBeforeSigning.LastSignature == deviceAfterSigning.LastSignature {
 				t.Error("last signature value should be different after each sign operation")
@@ -294,15 +858,47 @@ func testSigningDataOneDeviceMultipleClientsConcurrently(t *testing.T, algorithm
 }
 
 func testSignatureVerification(t *testing.T, algorithm string, temperedData string) bool {
-	service := NewSignatureDeviceService(repository, locker)
+	service := NewSignatureDeviceService(repository, exportRepository, unitOfWork, locker, keyWrapper)
 	id := uuid.NewString()
 	label := "Device"
-	service.CreateSignatureDevice(id, algorithm, label)
+	service.CreateSignatureDevice(id, algorithm, label, false, crypto.Options{})
 	data := "message to be signed"
-	signature, err := service.SignTransaction(id, data)
+	signature, err := service.SignTransaction(context.Background(), id, data)
 	if err != nil {
 		t.Fatal("error occurred, test failed")
 	}
 	verified, _ := service.Verify(id, signature.Signature, signature.SignedData+temperedData)
 	return verified.Status
 }
+
+func TestListDevicesPagesWithCursor(t *testing.T) {
+	fixture := newChainFixture(t, "ED25519")
+	for _, label := range []string{"Till 2", "Till 1"} {
+		_, err := fixture.deviceService.CreateSignatureDevice(uuid.NewString(), "ED25519", label, false, crypto.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	request := dto.ListDevicesRequest{Limit: 1, Sort: dto.SortByLabel, LabelPrefix: "Till"}
+	first, err := fixture.deviceService.ListDevices(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Total != 2 || len(first.Devices) != 1 || first.Devices[0].Label != "Till 1" || first.NextCursor == "" {
+		t.Fatalf("unexpected first page %+v", first)
+	}
+	request.Cursor = first.NextCursor
+	second, err := fixture.deviceService.ListDevices(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(second.Devices) != 1 || second.Devices[0].Label != "Till 2" || second.NextCursor != "" {
+		t.Fatalf("unexpected second page %+v", second)
+	}
+	// a cursor is only valid for the sort order it was created with
+	request.Sort = dto.SortByCreatedAt
+	_, err = fixture.deviceService.ListDevices(request)
+	if !errors.Is(err, domain.ErrInvalidCursor) {
+		t.Errorf("got error %v, expected %v", err, domain.ErrInvalidCursor)
+	}
+}
@@ -0,0 +1,247 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"signing-service-challenge/domain"
+	"signing-service-challenge/dto"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SigningJobs signs transactions asynchronously. Every device has a bounded FIFO queue
+// of jobs. The workers take turns between the devices with queued jobs, but never work
+// on two jobs of the same device at once, so the jobs of a device are signed in the
+// order they were submitted. A full queue rejects new jobs with domain.ErrQueueFull.
+//
+// Jobs only live in the memory of the instance which accepted them. The id of a job
+// starts with the id of that instance, polling another instance fails with
+// domain.ErrJobOfOtherInstance. Finished jobs can be polled until the retention period
+// has passed or, if more are retained, until they are the oldest ones.
+type SigningJobs struct {
+	service *SignatureDeviceService
+	options SigningJobsOptions
+	mutex   sync.Mutex
+	// signals the workers that a device has become ready or the queue was closed
+	cond *sync.Cond
+	jobs map[string]*signingJob
+	// queued jobs per device, in submission order
+	queues map[string][]*signingJob
+	// devices with queued jobs which no worker is busy with, in turn order
+	ready []string
+	// devices a worker is busy with
+	running map[string]bool
+	queued  int
+	// finished jobs in the order they expire, at most MaxRetained
+	finished []*signingJob
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+type SigningJobsOptions struct {
+	// InstanceId prefixes the job ids, a random id is used if it is empty
+	InstanceId string
+	Workers    int
+	// DeviceQueueSize bounds the queued jobs of a single device
+	DeviceQueueSize int
+	// MaxQueued bounds the queued jobs of all devices together
+	MaxQueued int
+	// Retention is how long a finished job can be polled
+	Retention time.Duration
+	// MaxRetained bounds the finished jobs which can be polled, the oldest are dropped first
+	MaxRetained int
+}
+
+var DefaultSigningJobsOptions = SigningJobsOptions{
+	Workers:         4,
+	DeviceQueueSize: 100,
+	MaxQueued:       10000,
+	Retention:       10 * time.Minute,
+	MaxRetained:     10000,
+}
+
+// jobIdSeparator separates the instance id from the rest of a job id.
+const jobIdSeparator = "."
+
+type signingJob struct {
+	id         string
+	deviceId   string
+	data       string
+	status     string
+	createdAt  time.Time
+	startedAt  time.Time
+	finishedAt time.Time
+	result     *dto.SignatureResponse
+	err        error
+}
+
+// NewSigningJobs starts the workers which sign the jobs with the service.
+func NewSigningJobs(service *SignatureDeviceService, options SigningJobsOptions) *SigningJobs {
+	if options.InstanceId == "" {
+		options.InstanceId = uuid.NewString()[:8]
+	}
+	jobs := &SigningJobs{
+		service: service,
+		options: options,
+		jobs:    make(map[string]*signingJob),
+		queues:  make(map[string][]*signingJob),
+		running: make(map[string]bool),
+	}
+	jobs.cond = sync.NewCond(&jobs.mutex)
+	for i := 0; i < options.Workers; i++ {
+		jobs.wg.Add(1)
+		go jobs.work()
+	}
+	return jobs
+}
+
+// Submit queues the data for signing with the device and returns the queued job.
+// Unknown and inactive devices are refused right away, a job can still fail if the
+// device is suspended before the job is signed.
+func (j *SigningJobs) Submit(deviceId, data string) (*dto.SigningJobResponse, error) {
+	device, err := j.service.repository.GetById(deviceId)
+	if err != nil {
+		return nil, err
+	}
+	if err := device.CheckActive(); err != nil {
+		return nil, err
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.closed {
+		return nil, domain.ErrQueueClosed
+	}
+	j.expire(time.Now())
+	if j.queued >= j.options.MaxQueued || len(j.queues[deviceId]) >= j.options.DeviceQueueSize {
+		return nil, domain.ErrQueueFull
+	}
+	job := &signingJob{
+		id:        j.options.InstanceId + jobIdSeparator + uuid.NewString(),
+		deviceId:  deviceId,
+		data:      data,
+		status:    dto.JobQueued,
+		createdAt: time.Now().UTC(),
+	}
+	j.jobs[job.id] = job
+	j.queues[deviceId] = append(j.queues[deviceId], job)
+	j.queued++
+	// a busy device is made ready again by its worker
+	if len(j.queues[deviceId]) == 1 && !j.running[deviceId] {
+		j.ready = append(j.ready, deviceId)
+		j.cond.Signal()
+	}
+	response := job.response(j.options.InstanceId)
+	return &response, nil
+}
+
+// Get returns the current state of a job.
+func (j *SigningJobs) Get(id string) (*dto.SigningJobResponse, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.expire(time.Now())
+	job, ok := j.jobs[id]
+	if !ok {
+		separator := strings.LastIndex(id, jobIdSeparator)
+		if separator > 0 && id[:separator] != j.options.InstanceId {
+			return nil, fmt.Errorf("%w: %s", domain.ErrJobOfOtherInstance, id[:separator])
+		}
+		return nil, domain.ErrJobNotFound
+	}
+	response := job.response(j.options.InstanceId)
+	return &response, nil
+}
+
+// InstanceId is the id of this instance which starts the ids of its jobs.
+func (j *SigningJobs) InstanceId() string {
+	return j.options.InstanceId
+}
+
+// expire forgets the finished jobs whose retention has passed and the oldest ones
+// beyond MaxRetained, the caller must hold the mutex.
+func (j *SigningJobs) expire(now time.Time) {
+	expired := 0
+	for _, job := range j.finished {
+		if now.Sub(job.finishedAt) < j.options.Retention && len(j.finished)-expired <= j.options.MaxRetained {
+			break
+		}
+		delete(j.jobs, job.id)
+		expired++
+	}
+	j.finished = j.finished[expired:]
+}
+
+func (j *SigningJobs) work() {
+	defer j.wg.Done()
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	for {
+		for len(j.ready) == 0 && !j.closed {
+			j.cond.Wait()
+		}
+		// after Close the remaining jobs are still signed
+		if len(j.ready) == 0 {
+			return
+		}
+		deviceId := j.ready[0]
+		j.ready = j.ready[1:]
+		job := j.queues[deviceId][0]
+		j.queues[deviceId] = j.queues[deviceId][1:]
+		j.queued--
+		j.running[deviceId] = true
+		job.status = dto.JobRunning
+		job.startedAt = time.Now().UTC()
+		j.mutex.Unlock()
+		// the lock timeout of the service bounds the wait for the device lock
+		result, err := j.service.SignTransaction(context.Background(), job.deviceId, job.data)
+		j.mutex.Lock()
+		job.finishedAt = time.Now().UTC()
+		job.result, job.err = result, err
+		job.status = dto.JobSucceeded
+		if err != nil {
+			job.status = dto.JobFailed
+		}
+		j.finished = append(j.finished, job)
+		j.expire(job.finishedAt)
+		delete(j.running, deviceId)
+		if len(j.queues[deviceId]) > 0 {
+			// the device goes to the end of the line, so busy devices do not starve the others
+			j.ready = append(j.ready, deviceId)
+			j.cond.Signal()
+		} else {
+			delete(j.queues, deviceId)
+		}
+	}
+}
+
+// Close refuses new jobs and waits until the queued jobs are signed.
+func (j *SigningJobs) Close() {
+	j.mutex.Lock()
+	j.closed = true
+	j.cond.Broadcast()
+	j.mutex.Unlock()
+	j.wg.Wait()
+}
+
+func (job *signingJob) response(instanceId string) dto.SigningJobResponse {
+	response := dto.SigningJobResponse{
+		Id:         job.id,
+		InstanceId: instanceId,
+		DeviceId:   job.deviceId,
+		Status:     job.status,
+		CreatedAt:  job.createdAt,
+		Result:     job.result,
+		Err:        job.err,
+	}
+	if !job.startedAt.IsZero() {
+		startedAt := job.startedAt
+		response.StartedAt = &startedAt
+	}
+	if !job.finishedAt.IsZero() {
+		finishedAt := job.finishedAt
+		response.FinishedAt = &finishedAt
+	}
+	return response
+}
@@ -0,0 +1,174 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"signing-service-challenge/crypto"
+	"signing-service-challenge/domain"
+	"signing-service-challenge/dto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// waitForJob waits until the job has finished and returns its final state.
+func waitForJob(t *testing.T, jobs *SigningJobs, id string) *dto.SigningJobResponse {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		job, err := jobs.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status == dto.JobSucceeded || job.Status == dto.JobFailed {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s is still %s", id, job.Status)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSigningJobsOfADeviceAreSignedInSubmissionOrder(t *testing.T) {
+	fixture := newChainFixture(t, crypto.ED25519)
+	other := newChainFixture(t, crypto.ED25519)
+	jobs := NewSigningJobs(fixture.deviceService, DefaultSigningJobsOptions)
+	defer jobs.Close()
+	ids := []string{}
+	for i := 0; i < 20; i++ {
+		job, err := jobs.Submit(fixture.deviceId, "data")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status != dto.JobQueued {
+			t.Errorf("submitted job should be %s, got %s", dto.JobQueued, job.Status)
+		}
+		ids = append(ids, job.Id)
+	}
+	for counter, id := range ids {
+		job := waitForJob(t, jobs, id)
+		if job.Status != dto.JobSucceeded || job.Result == nil || job.Result.Counter != counter {
+			t.Fatalf("job %d should be signed with counter %d, got %+v", counter, counter, job)
+		}
+		if job.StartedAt == nil || job.FinishedAt == nil {
+			t.Error("finished job should carry its start and finish time")
+		}
+	}
+	result, err := fixture.signatureService.VerifyChain(fixture.deviceId)
+	if err != nil || !result.Valid || result.VerifiedSignatures != len(ids) {
+		t.Errorf("chain of %d signatures should be valid, got %+v (%v)", len(ids), result, err)
+	}
+	// the device of the fixture is unknown to the repository of the other fixture
+	if _, err := jobs.Submit(other.deviceId, "data"); err != domain.ErrDeviceNotFound {
+		t.Errorf("got error %v, expected %v", err, domain.ErrDeviceNotFound)
+	}
+	if _, err := jobs.Get(uuid.NewString()); err != domain.ErrJobNotFound {
+		t.Errorf("got error %v, expected %v", err, domain.ErrJobNotFound)
+	}
+}
+
+func TestSigningJobsRejectJobsOfFullQueues(t *testing.T) {
+	fixture := newChainFixture(t, crypto.ED25519)
+	second, _ := fixture.deviceService.CreateSignatureDevice(uuid.NewString(), crypto.ED25519, "Device", false, crypto.Options{})
+	third, _ := fixture.deviceService.CreateSignatureDevice(uuid.NewString(), crypto.ED25519, "Device", false, crypto.Options{})
+	// without workers the queues are not drained
+	jobs := NewSigningJobs(fixture.deviceService, SigningJobsOptions{DeviceQueueSize: 2, MaxQueued: 3, Retention: time.Minute, MaxRetained: 10})
+	for i := 0; i < 2; i++ {
+		if _, err := jobs.Submit(fixture.deviceId, "data"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := jobs.Submit(fixture.deviceId, "data"); err != domain.ErrQueueFull {
+		t.Errorf("got error %v, expected %v for a full device queue", err, domain.ErrQueueFull)
+	}
+	if _, err := jobs.Submit(second.Id, "data"); err != nil {
+		t.Errorf("another device should still be accepted, got %v", err)
+	}
+	if _, err := jobs.Submit(third.Id, "data"); err != domain.ErrQueueFull {
+		t.Errorf("got error %v, expected %v once all queues are full", err, domain.ErrQueueFull)
+	}
+}
+
+func TestSigningJobFailsIfDeviceIsSuspendedMeanwhile(t *testing.T) {
+	fixture := newChainFixture(t, crypto.ED25519)
+	jobs := NewSigningJobs(fixture.deviceService, SigningJobsOptions{DeviceQueueSize: 10, MaxQueued: 10, Retention: time.Minute, MaxRetained: 10})
+	job, err := jobs.Submit(fixture.deviceId, "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fixture.deviceService.TransitionState(context.Background(), fixture.deviceId, domain.StateSuspended, "audit"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jobs.Submit(fixture.deviceId, "data"); !errors.Is(err, domain.ErrDeviceNotActive) {
+		t.Errorf("got error %v, expected %v", err, domain.ErrDeviceNotActive)
+	}
+	// a worker started late signs the queued job, Close waits for it
+	jobs.wg.Add(1)
+	go jobs.work()
+	jobs.Close()
+	finished, _ := jobs.Get(job.Id)
+	if finished.Status != dto.JobFailed || !errors.Is(finished.Err, domain.ErrDeviceNotActive) {
+		t.Errorf("job should fail with %v, got %s (%v)", domain.ErrDeviceNotActive, finished.Status, finished.Err)
+	}
+	if _, err := fixture.deviceService.TransitionState(context.Background(), fixture.deviceId, domain.StateActive, "audited"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jobs.Submit(fixture.deviceId, "data"); err != domain.ErrQueueClosed {
+		t.Errorf("got error %v, expected %v", err, domain.ErrQueueClosed)
+	}
+}
+
+func TestFinishedSigningJobsExpire(t *testing.T) {
+	fixture := newChainFixture(t, crypto.ED25519)
+	jobs := NewSigningJobs(fixture.deviceService, SigningJobsOptions{Workers: 1, DeviceQueueSize: 10, MaxQueued: 10, Retention: 10 * time.Millisecond, MaxRetained: 10})
+	defer jobs.Close()
+	job, _ := jobs.Submit(fixture.deviceId, "data")
+	waitForJob(t, jobs, job.Id)
+	time.Sleep(20 * time.Millisecond)
+	if _, err := jobs.Get(job.Id); err != domain.ErrJobNotFound {
+		t.Errorf("got error %v, expected the job to be expired", err)
+	}
+}
+
+func TestSigningJobsRetainOnlyTheNewestFinishedJobs(t *testing.T) {
+	fixture := newChainFixture(t, crypto.ED25519)
+	jobs := NewSigningJobs(fixture.deviceService, SigningJobsOptions{Workers: 1, DeviceQueueSize: 10, MaxQueued: 10, Retention: time.Hour, MaxRetained: 2})
+	defer jobs.Close()
+	ids := []string{}
+	for i := 0; i < 3; i++ {
+		job, _ := jobs.Submit(fixture.deviceId, "data")
+		ids = append(ids, job.Id)
+	}
+	waitForJob(t, jobs, ids[2])
+	if _, err := jobs.Get(ids[0]); err != domain.ErrJobNotFound {
+		t.Errorf("got error %v, expected the oldest job to be dropped", err)
+	}
+	for _, id := range ids[1:] {
+		if _, err := jobs.Get(id); err != nil {
+			t.Errorf("newest jobs should be retained, got %v", err)
+		}
+	}
+}
+
+func TestSigningJobIdsNameTheInstance(t *testing.T) {
+	fixture := newChainFixture(t, crypto.ED25519)
+	options := DefaultSigningJobsOptions
+	options.InstanceId = "signing-1.example.com"
+	jobs := NewSigningJobs(fixture.deviceService, options)
+	defer jobs.Close()
+	job, _ := jobs.Submit(fixture.deviceId, "data")
+	if !strings.HasPrefix(job.Id, "signing-1.example.com.") || job.InstanceId != options.InstanceId {
+		t.Errorf("job %s should be named after instance %s, got %s", job.Id, options.InstanceId, job.InstanceId)
+	}
+	options.InstanceId = "signing-2.example.com"
+	other := NewSigningJobs(fixture.deviceService, options)
+	defer other.Close()
+	if _, err := other.Get(job.Id); !errors.Is(err, domain.ErrJobOfOtherInstance) {
+		t.Errorf("got error %v, expected %v", err, domain.ErrJobOfOtherInstance)
+	}
+	if _, err := other.Get("signing-2.example.com." + uuid.NewString()); err != domain.ErrJobNotFound {
+		t.Errorf("got error %v, expected %v", err, domain.ErrJobNotFound)
+	}
+}
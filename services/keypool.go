@@ -0,0 +1,184 @@
+package services
+
+import (
+	"signing-service-challenge/crypto"
+	"signing-service-challenge/dto"
+	"sort"
+	"sync"
+)
+
+// KeyPool generates key pairs in the background, so creating a device does not
+// wait for the key generation, which takes long and varies a lot for RSA.
+// Every key set, an algorithm with the parameters of its keys, has its own pool
+// which the workers keep filled up to the watermark. A key set gets a pool when
+// it is warmed up or when its first key is taken.
+//
+// The pooled private keys are not wrapped yet, they only live in memory.
+type KeyPool struct {
+	watermark int
+	mutex     sync.Mutex
+	// signals the workers that a pool fell below the watermark or the pool was closed
+	cond   *sync.Cond
+	sets   map[keySet]*pooledKeys
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// keySet holds the parameters which determine the key pair, padding and hash
+// only matter for signing.
+type keySet struct {
+	algorithm string
+	keySize   int
+	curve     string
+}
+
+type pooledKeys struct {
+	keys []pooledKeyPair
+	// key pairs in generation
+	generating int
+	hits       uint64
+	misses     uint64
+}
+
+type pooledKeyPair struct {
+	privateKey []byte
+	publicKey  []byte
+}
+
+// NewKeyPool starts the workers of a pool which keeps watermark key pairs per key set.
+func NewKeyPool(watermark, workers int) *KeyPool {
+	pool := &KeyPool{
+		watermark: watermark,
+		sets:      make(map[keySet]*pooledKeys),
+	}
+	pool.cond = sync.NewCond(&pool.mutex)
+	for i := 0; i < workers; i++ {
+		pool.wg.Add(1)
+		go pool.work()
+	}
+	return pool
+}
+
+func newKeySet(algorithm string, options crypto.Options) keySet {
+	return keySet{algorithm: algorithm, keySize: options.KeySize, curve: options.Curve}
+}
+
+// Warm creates the pool of a key set up front, the options must be normalized.
+func (p *KeyPool) Warm(algorithm string, options crypto.Options) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.pool(newKeySet(algorithm, options))
+}
+
+// Take returns a pooled key pair for the normalized options. If the pool is empty
+// the second result is false and the caller generates the key pair itself.
+func (p *KeyPool) Take(algorithm string, options crypto.Options) (privateKey, publicKey []byte, ok bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	pool := p.pool(newKeySet(algorithm, options))
+	// the pool falls below the watermark either way
+	p.cond.Signal()
+	if len(pool.keys) == 0 {
+		pool.misses++
+		return nil, nil, false
+	}
+	keyPair := pool.keys[len(pool.keys)-1]
+	pool.keys[len(pool.keys)-1] = pooledKeyPair{}
+	pool.keys = pool.keys[:len(pool.keys)-1]
+	pool.hits++
+	return keyPair.privateKey, keyPair.publicKey, true
+}
+
+// pool returns the pool of the key set, the caller must hold the mutex.
+func (p *KeyPool) pool(set keySet) *pooledKeys {
+	pool, ok := p.sets[set]
+	if !ok {
+		pool = &pooledKeys{}
+		p.sets[set] = pool
+		p.cond.Broadcast()
+	}
+	return pool
+}
+
+// next returns a key set below the watermark, the caller must hold the mutex.
+func (p *KeyPool) next() (keySet, *pooledKeys, bool) {
+	for set, pool := range p.sets {
+		if len(pool.keys)+pool.generating < p.watermark {
+			return set, pool, true
+		}
+	}
+	return keySet{}, nil, false
+}
+
+func (p *KeyPool) work() {
+	defer p.wg.Done()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for {
+		set, pool, ok := p.next()
+		for !ok && !p.closed {
+			p.cond.Wait()
+			set, pool, ok = p.next()
+		}
+		if p.closed {
+			return
+		}
+		pool.generating++
+		p.mutex.Unlock()
+		privateKey, publicKey, err := generateKeyPair(set)
+		p.mutex.Lock()
+		pool.generating--
+		if err != nil {
+			// the key set was validated by the device creation, the pool is given up
+			delete(p.sets, set)
+			continue
+		}
+		pool.keys = append(pool.keys, pooledKeyPair{privateKey: privateKey, publicKey: publicKey})
+	}
+}
+
+func generateKeyPair(set keySet) ([]byte, []byte, error) {
+	kpHandler, err := crypto.GenerateKeyPairHandler(set.algorithm, crypto.Options{KeySize: set.keySize, Curve: set.curve})
+	if err != nil {
+		return nil, nil, err
+	}
+	return kpHandler.GenerateKeyPair()
+}
+
+// Close stops the workers, the pooled keys are dropped.
+func (p *KeyPool) Close() {
+	p.mutex.Lock()
+	p.closed = true
+	p.sets = make(map[keySet]*pooledKeys)
+	p.cond.Broadcast()
+	p.mutex.Unlock()
+	p.wg.Wait()
+}
+
+// Metrics returns the depth, hits and misses of the pools ordered by key set.
+func (p *KeyPool) Metrics() []dto.KeyPoolMetrics {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	metrics := []dto.KeyPoolMetrics{}
+	for set, pool := range p.sets {
+		metrics = append(metrics, dto.KeyPoolMetrics{
+			Algorithm: set.algorithm,
+			KeySize:   set.keySize,
+			Curve:     set.curve,
+			Depth:     len(pool.keys),
+			Watermark: p.watermark,
+			Hits:      pool.hits,
+			Misses:    pool.misses,
+		})
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].Algorithm != metrics[j].Algorithm {
+			return metrics[i].Algorithm < metrics[j].Algorithm
+		}
+		if metrics[i].KeySize != metrics[j].KeySize {
+			return metrics[i].KeySize < metrics[j].KeySize
+		}
+		return metrics[i].Curve < metrics[j].Curve
+	})
+	return metrics
+}
@@ -0,0 +1,88 @@
+package services
+
+import (
+	"context"
+	"signing-service-challenge/crypto"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// waitForDepth waits until the only pool of the key pool holds depth key pairs.
+func waitForDepth(t *testing.T, pool *KeyPool, depth int) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		metrics := pool.Metrics()
+		if len(metrics) == 1 && metrics[0].Depth == depth {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got pools %+v, expected a depth of %d", metrics, depth)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestKeyPoolRefillsUpToWatermark(t *testing.T) {
+	pool := NewKeyPool(3, 2)
+	defer pool.Close()
+	options, _ := crypto.NormalizeOptions(crypto.ECC, crypto.Options{Curve: crypto.CurveP256})
+	pool.Warm(crypto.ECC, options)
+	waitForDepth(t, pool, 3)
+	// the hash does not change the key pair, so it is taken from the same pool
+	options.Hash = crypto.HashSHA384
+	privateKey, publicKey, ok := pool.Take(crypto.ECC, options)
+	if !ok || len(privateKey) == 0 || len(publicKey) == 0 {
+		t.Fatal("key pair should be taken from the pool")
+	}
+	waitForDepth(t, pool, 3)
+	metrics := pool.Metrics()[0]
+	if metrics.Hits != 1 || metrics.Misses != 0 || metrics.Curve != crypto.CurveP256 {
+		t.Errorf("got metrics %+v", metrics)
+	}
+}
+
+func TestCreateSignatureDeviceFallsBackToInlineGeneration(t *testing.T) {
+	// without workers the pool stays empty
+	pool := NewKeyPool(1, 0)
+	defer pool.Close()
+	fixture := newChainFixture(t, crypto.ED25519)
+	fixture.deviceService.SetKeyPool(pool)
+	id := uuid.NewString()
+	if _, err := fixture.deviceService.CreateSignatureDevice(id, crypto.ED25519, "Device", false, crypto.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fixture.deviceService.SignTransaction(context.Background(), id, "data"); err != nil {
+		t.Fatal(err)
+	}
+	metrics := fixture.deviceService.Metrics().KeyPool
+	if len(metrics) != 1 || metrics[0].Misses != 1 || metrics[0].Depth != 0 {
+		t.Errorf("got pools %+v, expected one miss", metrics)
+	}
+}
+
+func TestCreateSignatureDeviceTakesPooledKey(t *testing.T) {
+	pool := NewKeyPool(2, 1)
+	defer pool.Close()
+	options, _ := crypto.NormalizeOptions(crypto.RSA, crypto.Options{})
+	pool.Warm(crypto.RSA, options)
+	waitForDepth(t, pool, 2)
+	fixture := newChainFixture(t, crypto.ED25519)
+	fixture.deviceService.SetKeyPool(pool)
+	id := uuid.NewString()
+	if _, err := fixture.deviceService.CreateSignatureDevice(id, crypto.RSA, "Device", false, crypto.Options{Padding: crypto.PaddingPSS}); err != nil {
+		t.Fatal(err)
+	}
+	signed, err := fixture.deviceService.SignTransaction(context.Background(), id, "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified, _ := fixture.deviceService.Verify(id, signed.Signature, signed.SignedData)
+	if !verified.Status {
+		t.Error("signature with the pooled key should be valid")
+	}
+	if metrics := pool.Metrics()[0]; metrics.Hits != 1 || metrics.Misses != 0 {
+		t.Errorf("got metrics %+v, expected one hit", metrics)
+	}
+}
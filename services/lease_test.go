@@ -0,0 +1,158 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"signing-service-challenge/crypto"
+	"signing-service-challenge/domain"
+	"signing-service-challenge/lockers"
+	"signing-service-challenge/persistence"
+	"signing-service-challenge/repositories"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func openSQLiteDB(t *testing.T) *persistence.SQLDB {
+	path := filepath.Join(t.TempDir(), "signing.db")
+	db, err := persistence.OpenSQLDB("sqlite3", "file:"+path+"?_busy_timeout=5000&_txlock=immediate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.DB.Close() })
+	return db
+}
+
+// newSQLInstance is one instance of the service on a shared database.
+func newSQLInstance(db *persistence.SQLDB, locker lockers.DeviceLocker) *SignatureDeviceService {
+	return NewSignatureDeviceService(
+		repositories.NewSignatureDeviceSQLRepository(db),
+		repositories.NewKeyExportSQLRepository(db),
+		repositories.NewSQLUnitOfWorkFactory(db),
+		locker,
+		keyWrapper,
+	)
+}
+
+func TestLeaseLockerSerializesInstances(t *testing.T) {
+	db := openSQLiteDB(t)
+	leases := lockers.NewSQLLeaseStore(db)
+	instances := []*SignatureDeviceService{
+		newSQLInstance(db, lockers.NewLeaseLocker(leases, time.Second)),
+		newSQLInstance(db, lockers.NewLeaseLocker(leases, time.Second)),
+	}
+	id := uuid.NewString()
+	if _, err := instances[0].CreateSignatureDevice(id, crypto.ECC, "Device", false, crypto.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(instance *SignatureDeviceService) {
+			defer wg.Done()
+			_, err := instance.SignTransaction(context.Background(), id, "data")
+			errs <- err
+		}(instances[i%2])
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	result, err := NewSignatureService(repositories.NewSignatureSQLRepository(db), repositories.NewSignatureDeviceSQLRepository(db)).VerifyChain(id)
+	if err != nil || !result.Valid || result.VerifiedSignatures != 20 {
+		t.Errorf("got %+v and error %v, expected a valid chain of %d signatures", result, err, 20)
+	}
+	device, _ := instances[1].GetById(id)
+	if device.SignatureCounter != 20 {
+		t.Errorf("got counter %d, expected %d", device.SignatureCounter, 20)
+	}
+}
+
+func TestSQLLeaseExpiresAndAdvancesToken(t *testing.T) {
+	leases := lockers.NewSQLLeaseStore(openSQLiteDB(t))
+	first, acquired, err := leases.Acquire("DEVICE", "first", 50*time.Millisecond)
+	if err != nil || !acquired || first.Token != 1 {
+		t.Fatalf("got %+v, %t and error %v, expected the first lease", first, acquired, err)
+	}
+	if _, acquired, _ := leases.Acquire("DEVICE", "second", time.Second); acquired {
+		t.Error("a held lease should not be granted again")
+	}
+	// the first holder has crashed
+	time.Sleep(60 * time.Millisecond)
+	second, acquired, err := leases.Acquire("DEVICE", "second", time.Second)
+	if err != nil || !acquired || second.Token != 2 {
+		t.Fatalf("got %+v, %t and error %v, expected the expired lease with the next token", second, acquired, err)
+	}
+	if _, err := leases.Renew(first, time.Second); !errors.Is(err, lockers.ErrLeaseLost) {
+		t.Errorf("got error %v, expected %v", err, lockers.ErrLeaseLost)
+	}
+	// releasing a lost lease leaves the current one alone
+	leases.Release(first)
+	if _, err := leases.Renew(second, time.Second); err != nil {
+		t.Error(err)
+	}
+	leases.Release(second)
+	third, acquired, _ := leases.Acquire("DEVICE", "first", time.Second)
+	if !acquired || third.Token != 3 {
+		t.Errorf("got %+v, %t, expected the released lease with token %d", third, acquired, 3)
+	}
+}
+
+func TestInMemoryLeaseExpiresAndAdvancesToken(t *testing.T) {
+	leases := lockers.NewInMemoryLeaseStore()
+	first, _, _ := leases.Acquire("DEVICE", "first", 50*time.Millisecond)
+	if _, acquired, _ := leases.Acquire("DEVICE", "second", time.Second); acquired {
+		t.Error("a held lease should not be granted again")
+	}
+	time.Sleep(60 * time.Millisecond)
+	second, acquired, _ := leases.Acquire("DEVICE", "second", time.Second)
+	if !acquired || second.Token != first.Token+1 {
+		t.Errorf("got %+v, %t, expected the expired lease with the next token", second, acquired)
+	}
+	if _, err := leases.Renew(first, time.Second); !errors.Is(err, lockers.ErrLeaseLost) {
+		t.Errorf("got error %v, expected %v", err, lockers.ErrLeaseLost)
+	}
+}
+
+func TestSignTransactionWithTakenOverLockShouldFail(t *testing.T) {
+	db := openSQLiteDB(t)
+	instance := newSQLInstance(db, lockers.NewLeaseLocker(lockers.NewSQLLeaseStore(db), time.Second))
+	id := uuid.NewString()
+	instance.CreateSignatureDevice(id, crypto.ECC, "Device", false, crypto.Options{})
+	// another holder has written the device under a later lease
+	devices := repositories.NewSignatureDeviceSQLRepository(db)
+	device, _ := devices.GetById(id)
+	device.FencingToken = 10
+	devices.Save(*device)
+
+	_, err := instance.SignTransaction(context.Background(), id, "data")
+	if !errors.Is(err, domain.ErrStaleFencingToken) {
+		t.Errorf("got error %v, expected %v", err, domain.ErrStaleFencingToken)
+	}
+	stored, _ := devices.GetById(id)
+	if stored.SignatureCounter != 0 {
+		t.Errorf("got counter %d, expected %d", stored.SignatureCounter, 0)
+	}
+}
+
+func TestRotateKeyPairReportsLeaseStoreFailure(t *testing.T) {
+	leaseDB := openSQLiteDB(t)
+	instance := newSQLInstance(openSQLiteDB(t), lockers.NewLeaseLocker(lockers.NewSQLLeaseStore(leaseDB), time.Second))
+	id := uuid.NewString()
+	if _, err := instance.CreateSignatureDevice(id, crypto.ED25519, "Device", false, crypto.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	// the lease store is unreachable
+	leaseDB.DB.Close()
+	_, err := instance.RotateKeyPair(id)
+	if err == nil || errors.Is(err, domain.ErrDeviceBusy) {
+		t.Errorf("got error %v, expected the failure of the lease store", err)
+	}
+}
@@ -0,0 +1,95 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"signing-service-challenge/crypto"
+	"signing-service-challenge/domain"
+	"signing-service-challenge/lockers"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSignTransactionGivesUpAfterLockTimeout(t *testing.T) {
+	fixture := newChainFixture(t, crypto.ECC)
+	fixture.deviceService.SetLockTimeout(20 * time.Millisecond)
+	locker.Lock(fixture.deviceId)
+	defer locker.Unlock(fixture.deviceId)
+	if _, err := fixture.deviceService.SignTransaction(context.Background(), fixture.deviceId, "data"); err != domain.ErrLockTimeout {
+		t.Errorf("got error %v, expected %v", err, domain.ErrLockTimeout)
+	}
+}
+
+func TestSignTransactionStopsWaitingWhenCancelled(t *testing.T) {
+	fixture := newChainFixture(t, crypto.ECC)
+	locker.Lock(fixture.deviceId)
+	defer locker.Unlock(fixture.deviceId)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := fixture.deviceService.SignTransaction(ctx, fixture.deviceId, "data"); !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, expected %v", err, context.Canceled)
+	}
+	// the cancelled waiter must not have taken the lock
+	if _, ok, _ := locker.TryLock(fixture.deviceId); ok {
+		t.Error("device should still be locked by its holder")
+	}
+}
+
+func TestRotateKeyPairOfLockedDeviceShouldFail(t *testing.T) {
+	fixture := newChainFixture(t, crypto.ECC)
+	locker.Lock(fixture.deviceId)
+	_, err := fixture.deviceService.RotateKeyPair(fixture.deviceId)
+	locker.Unlock(fixture.deviceId)
+	if err != domain.ErrDeviceBusy {
+		t.Errorf("got error %v, expected %v", err, domain.ErrDeviceBusy)
+	}
+	if _, err := fixture.deviceService.RotateKeyPair(fixture.deviceId); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCancelledWaitersDoNotBlockOthers(t *testing.T) {
+	locker := lockers.NewDeviceLockerWithGlobalMapProtection(&sync.Mutex{})
+	locker.Lock("DEVICE")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := locker.LockContext(ctx, "DEVICE"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, expected %v", err, context.DeadlineExceeded)
+	}
+	acquired := make(chan struct{})
+	go func() {
+		locker.Lock("DEVICE")
+		close(acquired)
+	}()
+	locker.Unlock("DEVICE")
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Error("waiter was not woken up after the unlock")
+	}
+}
+
+func TestLeaseLockerWaitsForLeaseOfOtherInstance(t *testing.T) {
+	leases := lockers.NewInMemoryLeaseStore()
+	first := lockers.NewLeaseLocker(leases, time.Second)
+	second := lockers.NewLeaseLocker(leases, time.Second)
+	firstToken, _ := first.Lock("DEVICE")
+	if _, ok, _ := second.TryLock("DEVICE"); ok {
+		t.Error("lease of another instance should not be taken")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := second.LockContext(ctx, "DEVICE"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, expected %v", err, context.DeadlineExceeded)
+	}
+	first.Unlock("DEVICE")
+	secondToken, ok, _ := second.TryLock("DEVICE")
+	if !ok || secondToken <= firstToken {
+		t.Errorf("got token %d after %d, expected the lease with a higher token", secondToken, firstToken)
+	}
+	second.Unlock("DEVICE")
+}
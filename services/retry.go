@@ -0,0 +1,35 @@
+package services
+
+import (
+	"errors"
+	"signing-service-challenge/domain"
+	"time"
+)
+
+// RetryPolicy bounds the retries of an operation which lost a race against
+// a concurrent modification of the device, e.g. by another instance.
+type RetryPolicy struct {
+	// Attempts is the total number of tries, including the first one
+	Attempts int
+	// Backoff is the wait before the first retry, it doubles with every retry
+	Backoff time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts: 3,
+	Backoff:  5 * time.Millisecond,
+}
+
+// Do runs the operation until it succeeds, fails with another error than
+// domain.ErrConcurrentModification or the attempts are used up.
+func (p RetryPolicy) Do(operation func() error) error {
+	backoff := p.Backoff
+	for attempt := 1; ; attempt++ {
+		err := operation()
+		if !errors.Is(err, domain.ErrConcurrentModification) || attempt >= p.Attempts {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
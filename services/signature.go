@@ -1,24 +1,27 @@
 package services
 
 import (
+	"encoding/base64"
 	"signing-service-challenge/domain"
 	"signing-service-challenge/dto"
 	"signing-service-challenge/repositories"
+	"strconv"
 )
 
 type SignatureService struct {
-	repository repositories.SignatureRepository
+	repository       repositories.SignatureRepository
+	deviceRepository repositories.SignatureDeviceRepository
 }
 
-func NewSignatureService(repository repositories.SignatureRepository) *SignatureService {
+func NewSignatureService(repository repositories.SignatureRepository, deviceRepository repositories.SignatureDeviceRepository) *SignatureService {
 	return &SignatureService{
-		repository: repository,
+		repository:       repository,
+		deviceRepository: deviceRepository,
 	}
 }
 
 func (sd SignatureService) Save(signature domain.Signature) error {
-	sd.repository.Save(signature)
-	return nil
+	return sd.repository.Save(signature)
 }
 
 func (sd SignatureService) GetById(signatureId string) (*dto.SignatureFullResponse, error) {
@@ -30,6 +33,16 @@ func (sd SignatureService) GetById(signatureId string) (*dto.SignatureFullRespon
 	return &response, nil
 }
 
+// GetByDeviceIdAndCounter returns the signature at the given position of the device's chain.
+func (sd SignatureService) GetByDeviceIdAndCounter(deviceId string, counter int) (*dto.SignatureFullResponse, error) {
+	signature, err := sd.repository.GetByDeviceIdAndCounter(deviceId, counter)
+	if err != nil {
+		return nil, err
+	}
+	response := dto.ConvertSignatureToResponse(*signature)
+	return &response, nil
+}
+
 func (sd SignatureService) GetAll() ([]dto.SignatureFullResponse, error) {
 	signatures, err := sd.repository.GetAll()
 	if err != nil {
@@ -41,3 +54,59 @@ func (sd SignatureService) GetAll() ([]dto.SignatureFullResponse, error) {
 	}
 	return response, nil
 }
+
+// ListByDeviceId returns one page of the signatures of a device.
+// The cursor of the next page is opaque to clients, it encodes the counter
+// of the last signature of the page.
+func (sd SignatureService) ListByDeviceId(deviceId string, request dto.ListSignaturesRequest) (*dto.SignatureListResponse, error) {
+	if _, err := sd.deviceRepository.GetById(deviceId); err != nil {
+		return nil, err
+	}
+	query := repositories.SignatureQuery{
+		DeviceId:    deviceId,
+		FromCounter: request.FromCounter,
+		ToCounter:   request.ToCounter,
+		From:        request.From,
+		To:          request.To,
+		Descending:  request.Order == dto.OrderDescending,
+		Limit:       request.Limit,
+	}
+	if query.Limit == 0 {
+		query.Limit = dto.DefaultPageSize
+	}
+	if request.Cursor != "" {
+		after, err := decodeCursor(request.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		query.AfterCounter = &after
+	}
+	signatures, more, err := sd.repository.ListByDeviceId(query)
+	if err != nil {
+		return nil, err
+	}
+	response := &dto.SignatureListResponse{Signatures: []dto.SignatureFullResponse{}}
+	for _, signature := range signatures {
+		response.Signatures = append(response.Signatures, dto.ConvertSignatureToResponse(signature))
+	}
+	if more {
+		response.NextCursor = encodeCursor(signatures[len(signatures)-1].Counter)
+	}
+	return response, nil
+}
+
+func encodeCursor(counter int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(counter)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, domain.ErrInvalidCursor
+	}
+	counter, err := strconv.Atoi(string(decoded))
+	if err != nil {
+		return 0, domain.ErrInvalidCursor
+	}
+	return counter, nil
+}
@@ -0,0 +1,58 @@
+package services
+
+import (
+	"errors"
+	"signing-service-challenge/domain"
+	"signing-service-challenge/dto"
+	"strconv"
+	"testing"
+)
+
+func TestListByDeviceIdPagesWithCursor(t *testing.T) {
+	fixture := newChainFixture(t, "ECC")
+	for i := 0; i < 7; i++ {
+		fixture.sign(t, "transaction "+strconv.Itoa(i))
+	}
+	request := dto.ListSignaturesRequest{Limit: 3, Order: dto.OrderDescending}
+	counters := []int{}
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("paging did not stop")
+		}
+		page, err := fixture.signatureService.ListByDeviceId(fixture.deviceId, request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, signature := range page.Signatures {
+			counters = append(counters, signature.Counter)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		request.Cursor = page.NextCursor
+	}
+	if len(counters) != 7 {
+		t.Fatalf("got %d signatures, %d expected", len(counters), 7)
+	}
+	for i, counter := range counters {
+		if counter != 6-i {
+			t.Errorf("got counter %d at position %d, expected %d", counter, i, 6-i)
+		}
+	}
+}
+
+func TestListByDeviceIdWithInvalidCursorShouldFail(t *testing.T) {
+	fixture := newChainFixture(t, "ECC")
+	_, err := fixture.signatureService.ListByDeviceId(fixture.deviceId, dto.ListSignaturesRequest{Cursor: "not a cursor"})
+	if !errors.Is(err, domain.ErrInvalidCursor) {
+		t.Errorf("got error %v, expected %v", err, domain.ErrInvalidCursor)
+	}
+}
+
+func TestListByDeviceIdForUnknownDeviceShouldFail(t *testing.T) {
+	fixture := newChainFixture(t, "ECC")
+	_, err := fixture.signatureService.ListByDeviceId("unknown", dto.ListSignaturesRequest{})
+	if !errors.Is(err, domain.ErrDeviceNotFound) {
+		t.Errorf("got error %v, expected %v", err, domain.ErrDeviceNotFound)
+	}
+}
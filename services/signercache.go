@@ -0,0 +1,124 @@
+package services
+
+import (
+	"bytes"
+	"container/list"
+	"signing-service-challenge/crypto"
+	"signing-service-challenge/domain"
+	"signing-service-challenge/dto"
+	"sync"
+)
+
+const DefaultSignerCacheSize = 1024
+
+// SignerCache keeps the signers of the recently used devices, so the private key
+// of a device is not unwrapped and parsed on every request. The least recently
+// used signer is evicted once the cache is full.
+//
+// The signers hold plain private keys, the size limit bounds how many of them
+// stay in memory between requests.
+type SignerCache struct {
+	mutex    sync.Mutex
+	capacity int
+	entries  map[signerCacheKey]*list.Element
+	// most recently used first
+	order     *list.List
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+type signerCacheKey struct {
+	deviceId   string
+	keyVersion int
+}
+
+type signerCacheEntry struct {
+	key signerCacheKey
+	// a device deleted and created again with the same id has another key,
+	// a rewrapped key is parsed once more under the new key-encryption key
+	wrappedKey []byte
+	signer     crypto.Signer
+}
+
+// NewSignerCache creates a cache of at most capacity signers, 0 disables caching.
+func NewSignerCache(capacity int) *SignerCache {
+	return &SignerCache{
+		capacity: capacity,
+		entries:  make(map[signerCacheKey]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// Get returns the signer of the current key pair of the device.
+func (c *SignerCache) Get(device domain.SignatureDevice) (crypto.Signer, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.entries[signerCacheKey{device.Id, device.KeyVersion}]
+	if !ok || !bytes.Equal(element.Value.(*signerCacheEntry).wrappedKey, device.PrivateKey) {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(element)
+	return element.Value.(*signerCacheEntry).signer, true
+}
+
+// Put adds the signer of the current key pair of the device.
+func (c *SignerCache) Put(device domain.SignatureDevice, signer crypto.Signer) {
+	if c.capacity <= 0 {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := signerCacheKey{device.Id, device.KeyVersion}
+	entry := &signerCacheEntry{key: key, wrappedKey: device.PrivateKey, signer: signer}
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.capacity {
+		c.remove(c.order.Back())
+		c.evictions++
+	}
+}
+
+// Invalidate removes the signers of all key versions of the device.
+func (c *SignerCache) Invalidate(deviceId string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for element := c.order.Front(); element != nil; {
+		next := element.Next()
+		if element.Value.(*signerCacheEntry).key.deviceId == deviceId {
+			c.remove(element)
+		}
+		element = next
+	}
+}
+
+// Purge removes all signers.
+func (c *SignerCache) Purge() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries = make(map[signerCacheKey]*list.Element)
+	c.order.Init()
+}
+
+func (c *SignerCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*signerCacheEntry).key)
+}
+
+func (c *SignerCache) Metrics() dto.SignerCacheMetrics {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return dto.SignerCacheMetrics{
+		Size:      c.order.Len(),
+		Capacity:  c.capacity,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+}
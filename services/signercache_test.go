@@ -0,0 +1,74 @@
+package services
+
+import (
+	"context"
+	"signing-service-challenge/crypto"
+	"signing-service-challenge/domain"
+	"testing"
+)
+
+func cachedDevice(id string, keyVersion int) domain.SignatureDevice {
+	return domain.SignatureDevice{Id: id, KeyVersion: keyVersion, PrivateKey: []byte(id)}
+}
+
+func TestSignerCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := NewSignerCache(2)
+	signer := crypto.NewEd25519Signer(nil)
+	cache.Put(cachedDevice("first", 1), signer)
+	cache.Put(cachedDevice("second", 1), signer)
+	// first is used more recently than second now
+	if _, ok := cache.Get(cachedDevice("first", 1)); !ok {
+		t.Error("first signer should be cached")
+	}
+	cache.Put(cachedDevice("third", 1), signer)
+	if _, ok := cache.Get(cachedDevice("second", 1)); ok {
+		t.Error("least recently used signer should be evicted")
+	}
+	if _, ok := cache.Get(cachedDevice("first", 1)); !ok {
+		t.Error("recently used signer should stay cached")
+	}
+	metrics := cache.Metrics()
+	if metrics.Size != 2 || metrics.Hits != 2 || metrics.Misses != 1 || metrics.Evictions != 1 {
+		t.Errorf("got metrics %+v", metrics)
+	}
+}
+
+func TestSignerCacheMissesOtherKeys(t *testing.T) {
+	cache := NewSignerCache(10)
+	cache.Put(cachedDevice("DEVICE", 1), crypto.NewEd25519Signer(nil))
+	if _, ok := cache.Get(cachedDevice("DEVICE", 2)); ok {
+		t.Error("signer of another key version should not be returned")
+	}
+	recreated := cachedDevice("DEVICE", 1)
+	recreated.PrivateKey = []byte("another key")
+	if _, ok := cache.Get(recreated); ok {
+		t.Error("signer of another private key should not be returned")
+	}
+	cache.Put(cachedDevice("DEVICE", 2), crypto.NewEd25519Signer(nil))
+	cache.Invalidate("DEVICE")
+	if cache.Metrics().Size != 0 {
+		t.Errorf("got %d signers, expected none after the invalidation", cache.Metrics().Size)
+	}
+}
+
+func TestSignTransactionReusesCachedSigner(t *testing.T) {
+	fixture := newChainFixture(t, crypto.RSA)
+	fixture.deviceService.SetSignerCache(NewSignerCache(10))
+	for i := 0; i < 3; i++ {
+		if _, err := fixture.deviceService.SignTransaction(context.Background(), fixture.deviceId, "data"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fixture.deviceService.RotateKeyPair(fixture.deviceId); err != nil {
+		t.Fatal(err)
+	}
+	fixture.sign(t, "signed with the new key")
+	// the rotation was signed with the cached signer, then the new key was parsed
+	metrics := fixture.deviceService.Metrics().SignerCache
+	if metrics.Misses != 2 || metrics.Hits != 3 || metrics.Size != 1 {
+		t.Errorf("got metrics %+v, expected %d misses and %d hits", metrics, 2, 3)
+	}
+	if result, err := fixture.signatureService.VerifyChain(fixture.deviceId); err != nil || !result.Valid {
+		t.Errorf("got %+v and error %v, expected a valid chain", result, err)
+	}
+}